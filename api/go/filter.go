@@ -0,0 +1,30 @@
+package apogy
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// UnmarshalJSON keeps an explicit "equal": null, which searches for null values,
+// instead of dropping it like a missing equal. numbers are decoded as json.Number
+func (f *Filter) UnmarshalJSON(b []byte) error {
+	type filter Filter
+	var ff filter
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&ff); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if v, ok := raw["equal"]; ok && bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+		ff.Equal = new(interface{})
+	}
+
+	*f = Filter(ff)
+	return nil
+}
@@ -19,8 +19,31 @@ import (
 	strictecho "github.com/oapi-codegen/runtime/strictmiddleware/echo"
 )
 
+// Aggregate defines model for Aggregate.
+type Aggregate struct {
+	// Fn count, sum, min, max or avg
+	Fn string `json:"fn"`
+
+	// Key The path to aggregate. count does not need one
+	Key *string `json:"key,omitempty"`
+}
+
+// AggregateGroup defines model for AggregateGroup.
+type AggregateGroup struct {
+	// Count How many documents are in the group
+	Count int `json:"count"`
+
+	// Key The value of the groupBy path. Missing without a groupBy
+	Key *interface{} `json:"key,omitempty"`
+
+	// Values The result of every aggregate of the request, in the same order
+	Values []interface{} `json:"values"`
+}
+
 // Document defines model for Document.
 type Document struct {
+	// Expires The document is deleted after this time. Defaults to now plus the ttl of the model, if it has one
+	Expires *time.Time              `json:"expires,omitempty"`
 	History *History                `json:"history,omitempty"`
 	Id      string                  `json:"id"`
 	Model   string                  `json:"model"`
@@ -32,17 +55,32 @@ type Document struct {
 
 // ErrorResponse defines model for ErrorResponse.
 type ErrorResponse struct {
-	Message *string `json:"message,omitempty"`
+	// Conflict A write that would give a unique index a value that another document already has
+	Conflict *UniqueConflict `json:"conflict,omitempty"`
+	Message  *string         `json:"message,omitempty"`
 }
 
 // Filter defines model for Filter.
 type Filter struct {
+	// Contains Words that must all appear in the value. Requires a fulltext index on the key
+	Contains *string `json:"contains,omitempty"`
+
+	// Equal The value to match. null matches documents where the value is null
 	Equal   *interface{} `json:"equal,omitempty"`
 	Greater *interface{} `json:"greater,omitempty"`
-	Key     string       `json:"key"`
-	Less    *interface{} `json:"less,omitempty"`
-	Prefix  *interface{} `json:"prefix,omitempty"`
-	Skip    *interface{} `json:"skip,omitempty"`
+
+	// In Values of which the value must be one, like several equal filters combined with or
+	In   *[]interface{} `json:"in,omitempty"`
+	Key  string         `json:"key"`
+	Less *interface{}   `json:"less,omitempty"`
+
+	// Not If true, match the documents that the filter would not match
+	Not *bool `json:"not,omitempty"`
+
+	// Or Filters of which at least one must match. The key of this filter is ignored
+	Or     *[]Filter    `json:"or,omitempty"`
+	Prefix *interface{} `json:"prefix,omitempty"`
+	Skip   *interface{} `json:"skip,omitempty"`
 }
 
 // History defines model for History.
@@ -65,8 +103,17 @@ type Mutation struct {
 // Mutations defines model for Mutations.
 type Mutations map[string]Mutation
 
+// Order Return documents sorted by an indexed path, or by id
+type Order struct {
+	// Desc If true, the largest value comes first
+	Desc *bool  `json:"desc,omitempty"`
+	Key  string `json:"key"`
+}
+
 // Query defines model for Query.
 type Query struct {
+	// AsOf Run the query against the database as it was at this time
+	AsOf   *time.Time     `json:"asOf,omitempty"`
 	Cursor *string        `json:"cursor,omitempty"`
 	Limit  *int           `json:"limit,omitempty"`
 	Params *[]interface{} `json:"params,omitempty"`
@@ -105,21 +152,46 @@ type ReactorWorking = map[string]interface{}
 
 // SearchRequest defines model for SearchRequest.
 type SearchRequest struct {
-	Cursor  *string   `json:"cursor,omitempty"`
-	Filters *[]Filter `json:"filters,omitempty"`
+	// Aggregates If set, return one group of aggregates of the matching documents instead of the documents
+	Aggregates *[]Aggregate `json:"aggregates,omitempty"`
+
+	// AsOf Search the database as it was at this time
+	AsOf    *time.Time `json:"asOf,omitempty"`
+	Cursor  *string    `json:"cursor,omitempty"`
+	Filters *[]Filter  `json:"filters,omitempty"`
 
 	// Full If true, return full documents instead of just the ids
-	Full  *bool            `json:"full,omitempty"`
-	Limit *int             `json:"limit,omitempty"`
-	Links *[]SearchRequest `json:"links,omitempty"`
-	Model string           `json:"model"`
+	Full *bool `json:"full,omitempty"`
+
+	// GroupBy Return a group for every value of this indexed path instead of a single one
+	GroupBy *string          `json:"groupBy,omitempty"`
+	Limit   *int             `json:"limit,omitempty"`
+	Links   *[]SearchRequest `json:"links,omitempty"`
+	Model   string           `json:"model"`
+
+	// Order Return documents sorted by an indexed path, or by id
+	Order *Order `json:"order,omitempty"`
+
+	// Reverse If true, return documents in descending order of the first filter, or of the id if there is no filter
+	Reverse *bool `json:"reverse,omitempty"`
 }
 
 // SearchResponse defines model for SearchResponse.
 type SearchResponse struct {
-	Cursor    *string    `json:"cursor,omitempty"`
-	Documents []Document `json:"documents"`
-	Error     *string    `json:"error,omitempty"`
+	Cursor    *string           `json:"cursor,omitempty"`
+	Documents []Document        `json:"documents"`
+	Error     *string           `json:"error,omitempty"`
+	Groups    *[]AggregateGroup `json:"groups,omitempty"`
+}
+
+// UniqueConflict A write that would give a unique index a value that another document already has
+type UniqueConflict struct {
+	// Id The document that already has the value
+	Id string `json:"id"`
+
+	// Index The path of the unique index, or the comma separated paths of a composite one
+	Index string `json:"index"`
+	Model string `json:"model"`
 }
 
 // ValidationRequest defines model for ValidationRequest.
@@ -136,6 +208,12 @@ type ValidationResponse struct {
 	} `json:"reject,omitempty"`
 }
 
+// GetDocumentParams defines parameters for GetDocument.
+type GetDocumentParams struct {
+	// AsOf Return the document as it was at this time
+	AsOf *time.Time `form:"asOf,omitempty" json:"asOf,omitempty"`
+}
+
 // PutDocumentJSONRequestBody defines body for PutDocument for application/json ContentType.
 type PutDocumentJSONRequestBody = Document
 
@@ -237,7 +315,7 @@ type ClientInterface interface {
 	DeleteDocument(ctx context.Context, model string, id string, reqEditors ...RequestEditorFn) (*http.Response, error)
 
 	// GetDocument request
-	GetDocument(ctx context.Context, model string, id string, reqEditors ...RequestEditorFn) (*http.Response, error)
+	GetDocument(ctx context.Context, model string, id string, params *GetDocumentParams, reqEditors ...RequestEditorFn) (*http.Response, error)
 }
 
 func (c *Client) PutDocumentWithBody(ctx context.Context, contentType string, body io.Reader, reqEditors ...RequestEditorFn) (*http.Response, error) {
@@ -324,8 +402,8 @@ func (c *Client) DeleteDocument(ctx context.Context, model string, id string, re
 	return c.Client.Do(req)
 }
 
-func (c *Client) GetDocument(ctx context.Context, model string, id string, reqEditors ...RequestEditorFn) (*http.Response, error) {
-	req, err := NewGetDocumentRequest(c.Server, model, id)
+func (c *Client) GetDocument(ctx context.Context, model string, id string, params *GetDocumentParams, reqEditors ...RequestEditorFn) (*http.Response, error) {
+	req, err := NewGetDocumentRequest(c.Server, model, id, params)
 	if err != nil {
 		return nil, err
 	}
@@ -498,7 +576,7 @@ func NewDeleteDocumentRequest(server string, model string, id string) (*http.Req
 }
 
 // NewGetDocumentRequest generates requests for GetDocument
-func NewGetDocumentRequest(server string, model string, id string) (*http.Request, error) {
+func NewGetDocumentRequest(server string, model string, id string, params *GetDocumentParams) (*http.Request, error) {
 	var err error
 
 	var pathParam0 string
@@ -530,6 +608,28 @@ func NewGetDocumentRequest(server string, model string, id string) (*http.Reques
 		return nil, err
 	}
 
+	if params != nil {
+		queryValues := queryURL.Query()
+
+		if params.AsOf != nil {
+
+			if queryFrag, err := runtime.StyleParamWithLocation("form", true, "asOf", runtime.ParamLocationQuery, *params.AsOf); err != nil {
+				return nil, err
+			} else if parsed, err := url.ParseQuery(queryFrag); err != nil {
+				return nil, err
+			} else {
+				for k, v := range parsed {
+					for _, v2 := range v {
+						queryValues.Add(k, v2)
+					}
+				}
+			}
+
+		}
+
+		queryURL.RawQuery = queryValues.Encode()
+	}
+
 	req, err := http.NewRequest("GET", queryURL.String(), nil)
 	if err != nil {
 		return nil, err
@@ -600,7 +700,7 @@ type ClientWithResponsesInterface interface {
 	DeleteDocumentWithResponse(ctx context.Context, model string, id string, reqEditors ...RequestEditorFn) (*DeleteDocumentResponse, error)
 
 	// GetDocumentWithResponse request
-	GetDocumentWithResponse(ctx context.Context, model string, id string, reqEditors ...RequestEditorFn) (*GetDocumentResponse, error)
+	GetDocumentWithResponse(ctx context.Context, model string, id string, params *GetDocumentParams, reqEditors ...RequestEditorFn) (*GetDocumentResponse, error)
 }
 
 type PutDocumentResponse struct {
@@ -779,8 +879,8 @@ func (c *ClientWithResponses) DeleteDocumentWithResponse(ctx context.Context, mo
 }
 
 // GetDocumentWithResponse request returning *GetDocumentResponse
-func (c *ClientWithResponses) GetDocumentWithResponse(ctx context.Context, model string, id string, reqEditors ...RequestEditorFn) (*GetDocumentResponse, error) {
-	rsp, err := c.GetDocument(ctx, model, id, reqEditors...)
+func (c *ClientWithResponses) GetDocumentWithResponse(ctx context.Context, model string, id string, params *GetDocumentParams, reqEditors ...RequestEditorFn) (*GetDocumentResponse, error) {
+	rsp, err := c.GetDocument(ctx, model, id, params, reqEditors...)
 	if err != nil {
 		return nil, err
 	}
@@ -968,7 +1068,7 @@ type ServerInterface interface {
 	DeleteDocument(ctx echo.Context, model string, id string) error
 	// Get a document by model and ID
 	// (GET /v1/{model}/{id})
-	GetDocument(ctx echo.Context, model string, id string) error
+	GetDocument(ctx echo.Context, model string, id string, params GetDocumentParams) error
 }
 
 // ServerInterfaceWrapper converts echo contexts to parameters.
@@ -1046,8 +1146,17 @@ func (w *ServerInterfaceWrapper) GetDocument(ctx echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid format for parameter id: %s", err))
 	}
 
+	// Parameter object where we will unmarshal all parameters from the context
+	var params GetDocumentParams
+	// ------------- Optional query parameter "asOf" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "asOf", ctx.QueryParams(), &params.AsOf)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid format for parameter asOf: %s", err))
+	}
+
 	// Invoke the callback with all the unmarshaled arguments
-	err = w.Handler.GetDocument(ctx, model, id)
+	err = w.Handler.GetDocument(ctx, model, id, params)
 	return err
 }
 
@@ -1218,8 +1327,9 @@ func (response DeleteDocument404Response) VisitDeleteDocumentResponse(w http.Res
 }
 
 type GetDocumentRequestObject struct {
-	Model string `json:"model"`
-	Id    string `json:"id"`
+	Model  string `json:"model"`
+	Id     string `json:"id"`
+	Params GetDocumentParams
 }
 
 type GetDocumentResponseObject interface {
@@ -1380,11 +1490,12 @@ func (sh *strictHandler) DeleteDocument(ctx echo.Context, model string, id strin
 }
 
 // GetDocument operation middleware
-func (sh *strictHandler) GetDocument(ctx echo.Context, model string, id string) error {
+func (sh *strictHandler) GetDocument(ctx echo.Context, model string, id string, params GetDocumentParams) error {
 	var request GetDocumentRequestObject
 
 	request.Model = model
 	request.Id = id
+	request.Params = params
 
 	handler := func(ctx echo.Context, request interface{}) (interface{}, error) {
 		return sh.ssi.GetDocument(ctx.Request().Context(), request.(GetDocumentRequestObject))
@@ -17,6 +17,35 @@ func (client *ClientWithResponses) QueryOne(ctx context.Context, q string, args
 	return queryOne[Document](client.ClientInterface, ctx, q, args...)
 }
 
+// Aggregate runs a query with aggregates or a group by, like Book group by val.author count, and returns its groups
+func (client *ClientWithResponses) Aggregate(ctx context.Context, q string, args ...interface{}) ([]AggregateGroup, error) {
+	rsp, err := client.QueryDocuments(ctx, Query{
+		Q:      q,
+		Params: &args,
+	}, addTracingContext())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != 200 {
+		return nil, parseError(rsp)
+	}
+
+	var searchResponse SearchResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&searchResponse); err != nil {
+		return nil, err
+	}
+	if searchResponse.Error != nil {
+		return nil, errors.New(*searchResponse.Error)
+	}
+	if searchResponse.Groups == nil {
+		return nil, errors.New("query has no aggregates")
+	}
+	return *searchResponse.Groups, nil
+}
+
 type searchResponseT[Document any] struct {
 	Cursor    *string    `json:"cursor,omitempty"`
 	Documents []Document `json:"documents"`
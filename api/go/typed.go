@@ -76,7 +76,7 @@ func addTracingContext() RequestEditorFn {
 func (c *TypedClient[Doc]) Get(ctx context.Context, id string, reqEditors ...RequestEditorFn) (*Doc, error) {
 	reqEditors = append([]RequestEditorFn{addTracingContext()}, reqEditors...)
 
-	rsp, err := c.GetDocument(ctx, c.Model, id, reqEditors...)
+	rsp, err := c.GetDocument(ctx, c.Model, id, nil, reqEditors...)
 	if err != nil {
 		return nil, err
 	}
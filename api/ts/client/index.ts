@@ -7,12 +7,15 @@ export { CancelablePromise, CancelError } from './core/CancelablePromise';
 export { OpenAPI } from './core/OpenAPI';
 export type { OpenAPIConfig } from './core/OpenAPI';
 
+export type { Aggregate } from './models/Aggregate';
+export type { AggregateGroup } from './models/AggregateGroup';
 export type { Document } from './models/Document';
 export type { ErrorResponse } from './models/ErrorResponse';
 export type { Filter } from './models/Filter';
 export type { History } from './models/History';
 export type { Mutation } from './models/Mutation';
 export type { Mutations } from './models/Mutations';
+export type { Order } from './models/Order';
 export type { Query } from './models/Query';
 export type { ReactorActivation } from './models/ReactorActivation';
 export type { ReactorDone } from './models/ReactorDone';
@@ -22,6 +25,7 @@ export type { ReactorStart } from './models/ReactorStart';
 export type { ReactorWorking } from './models/ReactorWorking';
 export type { SearchRequest } from './models/SearchRequest';
 export type { SearchResponse } from './models/SearchResponse';
+export type { UniqueConflict } from './models/UniqueConflict';
 export type { ValidationRequest } from './models/ValidationRequest';
 export type { ValidationResponse } from './models/ValidationResponse';
 
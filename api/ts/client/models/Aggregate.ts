@@ -0,0 +1,15 @@
+/* generated using openapi-typescript-codegen -- do not edit */
+/* istanbul ignore file */
+/* tslint:disable */
+/* eslint-disable */
+export type Aggregate = {
+    /**
+     * count, sum, min, max or avg
+     */
+    fn: string;
+    /**
+     * The path to aggregate. count does not need one
+     */
+    key?: string;
+};
+
@@ -0,0 +1,19 @@
+/* generated using openapi-typescript-codegen -- do not edit */
+/* istanbul ignore file */
+/* tslint:disable */
+/* eslint-disable */
+export type AggregateGroup = {
+    /**
+     * The value of the groupBy path. Missing without a groupBy
+     */
+    key?: any;
+    /**
+     * How many documents are in the group
+     */
+    count: number;
+    /**
+     * The result of every aggregate of the request, in the same order
+     */
+    values: Array<any>;
+};
+
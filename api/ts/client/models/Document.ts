@@ -12,5 +12,9 @@ export type Document = {
     val: any;
     mut?: Mutations;
     status?: Record<string, any>;
+    /**
+     * The document is deleted after this time. Defaults to now plus the ttl of the model, if it has one
+     */
+    expires?: string;
 };
 
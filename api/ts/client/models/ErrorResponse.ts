@@ -2,7 +2,9 @@
 /* istanbul ignore file */
 /* tslint:disable */
 /* eslint-disable */
+import type { UniqueConflict } from './UniqueConflict';
 export type ErrorResponse = {
     message?: string;
+    conflict?: UniqueConflict;
 };
 
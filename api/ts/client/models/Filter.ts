@@ -4,10 +4,29 @@
 /* eslint-disable */
 export type Filter = {
     key: string;
+    /**
+     * The value to match. null matches documents where the value is null
+     */
     equal?: any;
     greater?: any;
     less?: any;
     prefix?: any;
     skip?: any;
+    /**
+     * Words that must all appear in the value. Requires a fulltext index on the key
+     */
+    contains?: string;
+    /**
+     * Values of which the value must be one, like several equal filters combined with or
+     */
+    in?: Array<any>;
+    /**
+     * If true, match the documents that the filter would not match
+     */
+    not?: boolean;
+    /**
+     * Filters of which at least one must match. The key of this filter is ignored
+     */
+    or?: Array<Filter>;
 };
 
@@ -0,0 +1,15 @@
+/* generated using openapi-typescript-codegen -- do not edit */
+/* istanbul ignore file */
+/* tslint:disable */
+/* eslint-disable */
+/**
+ * Return documents sorted by an indexed path, or by id
+ */
+export type Order = {
+    key: string;
+    /**
+     * If true, the largest value comes first
+     */
+    desc?: boolean;
+};
+
@@ -7,5 +7,9 @@ export type Query = {
     limit?: number;
     cursor?: string;
     params?: any[];
+    /**
+     * Run the query against the database as it was at this time
+     */
+    asOf?: string;
 };
 
@@ -2,7 +2,9 @@
 /* istanbul ignore file */
 /* tslint:disable */
 /* eslint-disable */
+import type { Aggregate } from './Aggregate';
 import type { Filter } from './Filter';
+import type { Order } from './Order';
 export type SearchRequest = {
     model: string;
     filters?: Array<Filter>;
@@ -13,5 +15,22 @@ export type SearchRequest = {
      * If true, return full documents instead of just the ids
      */
     full?: boolean;
+    /**
+     * If true, return documents in descending order of the first filter, or of the id if there is no filter
+     */
+    reverse?: boolean;
+    order?: Order;
+    /**
+     * If set, return one group of aggregates of the matching documents instead of the documents
+     */
+    aggregates?: Array<Aggregate>;
+    /**
+     * Return a group for every value of this indexed path instead of a single one
+     */
+    groupBy?: string;
+    /**
+     * Search the database as it was at this time
+     */
+    asOf?: string;
 };
 
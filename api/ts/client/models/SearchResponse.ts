@@ -2,10 +2,12 @@
 /* istanbul ignore file */
 /* tslint:disable */
 /* eslint-disable */
+import type { AggregateGroup } from './AggregateGroup';
 import type { Document } from './Document';
 export type SearchResponse = {
     error?: string;
     documents: Array<Document>;
     cursor?: string;
+    groups?: Array<AggregateGroup>;
 };
 
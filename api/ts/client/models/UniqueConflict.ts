@@ -0,0 +1,19 @@
+/* generated using openapi-typescript-codegen -- do not edit */
+/* istanbul ignore file */
+/* tslint:disable */
+/* eslint-disable */
+/**
+ * A write that would give a unique index a value that another document already has
+ */
+export type UniqueConflict = {
+    model: string;
+    /**
+     * The document that already has the value
+     */
+    id: string;
+    /**
+     * The path of the unique index, or the comma separated paths of a composite one
+     */
+    index: string;
+};
+
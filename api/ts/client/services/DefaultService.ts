@@ -14,12 +14,14 @@ export class DefaultService {
      * Get a document by model and ID
      * @param model
      * @param id
+     * @param asOf Return the document as it was at this time
      * @returns Document Successfully retrieved document
      * @throws ApiError
      */
     public static getDocument(
         model: string,
         id: string,
+        asOf?: string,
     ): CancelablePromise<Document> {
         return __request(OpenAPI, {
             method: 'GET',
@@ -28,6 +30,9 @@ export class DefaultService {
                 'model': model,
                 'id': id,
             },
+            query: {
+                'asOf': asOf,
+            },
         });
     }
     /**
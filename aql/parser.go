@@ -25,9 +25,12 @@ const (
 	TOKEN_RBRACE
 	TOKEN_STRING
 	TOKEN_COMMA
-	TOKEN_PARAM // New token type for parameter placeholders
-	TOKEN_AND   // Logical AND operator (& or &&)
-	TOKEN_SKIP  // Skip operator ($)
+	TOKEN_PARAM    // New token type for parameter placeholders
+	TOKEN_AND      // Logical AND operator (& or &&)
+	TOKEN_SKIP     // Skip operator ($)
+	TOKEN_CONTAINS // Full text contains operator (~)
+	TOKEN_OR       // Logical OR operator (| or ||)
+	TOKEN_NOT      // Negation of the next filter (!)
 )
 
 func tokenName(i TokenType) string {
@@ -62,6 +65,12 @@ func tokenName(i TokenType) string {
 		return "AND"
 	case TOKEN_SKIP:
 		return "SKIP"
+	case TOKEN_CONTAINS:
+		return "CONTAINS"
+	case TOKEN_OR:
+		return "OR"
+	case TOKEN_NOT:
+		return "NOT"
 	}
 	return "ILLEGAL"
 }
@@ -123,11 +132,21 @@ func (l *Lexer) isAmpersandOperator() bool {
 	return true
 }
 
+// readNumber reads an optionally negative number with an optional fraction, like -1.5
 func (l *Lexer) readNumber() string {
 	position := l.position
+	if l.ch == '-' {
+		l.readChar()
+	}
 	for isDigit(l.ch) {
 		l.readChar()
 	}
+	if l.ch == '.' && l.readPosition < len(l.input) && isDigit(l.input[l.readPosition]) {
+		l.readChar()
+		for isDigit(l.ch) {
+			l.readChar()
+		}
+	}
 	return l.input[position:l.position]
 }
 
@@ -161,6 +180,8 @@ func (l *Lexer) NextToken() Token {
 		tok = Token{TOKEN_PREFIX, string(l.ch)}
 	case '$':
 		tok = Token{TOKEN_SKIP, string(l.ch)}
+	case '~':
+		tok = Token{TOKEN_CONTAINS, string(l.ch)}
 	case '(':
 		tok = Token{TOKEN_LPAREN, string(l.ch)}
 	case ')':
@@ -181,6 +202,15 @@ func (l *Lexer) NextToken() Token {
 		} else {
 			tok = Token{TOKEN_AND, string(l.ch)}
 		}
+	case '|':
+		if l.readPosition < len(l.input) && l.input[l.readPosition] == '|' {
+			l.readChar() // consume the second |
+			tok = Token{TOKEN_OR, "||"}
+		} else {
+			tok = Token{TOKEN_OR, string(l.ch)}
+		}
+	case '!':
+		tok = Token{TOKEN_NOT, string(l.ch)}
 	case '"':
 		if str, err := l.readString(); err == nil {
 			tok = Token{TOKEN_STRING, str}
@@ -194,7 +224,7 @@ func (l *Lexer) NextToken() Token {
 			tok.Literal = l.readIdentifier()
 			tok.Type = TOKEN_IDENT
 			return tok
-		} else if isDigit(l.ch) {
+		} else if isDigit(l.ch) || (l.ch == '-' && l.readPosition < len(l.input) && isDigit(l.input[l.readPosition])) {
 			tok.Literal = l.readNumber()
 			tok.Type = TOKEN_IDENT // Numbers are treated as identifiers
 			return tok
@@ -208,9 +238,12 @@ func (l *Lexer) NextToken() Token {
 }
 
 type Query struct {
-	Type   string
-	Filter []openapi.Filter
-	Links  []*Query
+	Type       string
+	Filter     []openapi.Filter
+	Order      *openapi.Order
+	GroupBy    string
+	Aggregates []openapi.Aggregate
+	Links      []*Query
 }
 
 func (q *Query) String() string {
@@ -220,63 +253,29 @@ func (q *Query) String() string {
 	if len(q.Filter) > 0 {
 		filters := make([]string, 0)
 		for _, filter := range q.Filter {
-			var operator string = "="
-			var value interface{} = nil
-			var skipValue interface{} = nil
-
-			if filter.Equal != nil {
-				operator = "="
-				value = *filter.Equal
-			} else if filter.Less != nil {
-				operator = "<"
-				value = *filter.Less
-			} else if filter.Greater != nil {
-				operator = ">"
-				value = *filter.Greater
-			} else if filter.Prefix != nil {
-				operator = "^"
-				value = *filter.Prefix
-
-				// Check for Skip value
-				if filter.Skip != nil {
-					skipValue = *filter.Skip
-				}
-			}
-
-			if value == nil {
-				filters = append(filters, filter.Key)
-				continue
-			}
+			filters = append(filters, filterString(filter))
+		}
+		parts = append(parts, fmt.Sprintf("(%s)", strings.Join(filters, " ")))
+	}
 
-			var filterStr string
-			switch val := value.(type) {
-			case string:
-				filterStr = fmt.Sprintf(`%s%s"%s"`, filter.Key, operator, val)
-			case float64:
-				filterStr = fmt.Sprintf(`%s%s%g`, filter.Key, operator, val)
-			case bool:
-				filterStr = fmt.Sprintf(`%s%s%v`, filter.Key, operator, val)
-			default:
-				filterStr = fmt.Sprintf(`%s%s%v`, filter.Key, operator, val)
-			}
+	if q.Order != nil {
+		order := "order by " + q.Order.Key
+		if q.Order.Desc != nil && *q.Order.Desc {
+			order += " desc"
+		}
+		parts = append(parts, order)
+	}
 
-			// Append skip part if it exists
-			if skipValue != nil {
-				switch skipVal := skipValue.(type) {
-				case string:
-					filterStr += fmt.Sprintf(`$"%s"`, skipVal)
-				case float64:
-					filterStr += fmt.Sprintf(`$%g`, skipVal)
-				case bool:
-					filterStr += fmt.Sprintf(`$%v`, skipVal)
-				default:
-					filterStr += fmt.Sprintf(`$%v`, skipVal)
-				}
-			}
+	if q.GroupBy != "" {
+		parts = append(parts, "group by "+q.GroupBy)
+	}
 
-			filters = append(filters, filterStr)
+	for _, a := range q.Aggregates {
+		if a.Key != nil {
+			parts = append(parts, fmt.Sprintf("%s(%s)", a.Fn, *a.Key))
+		} else {
+			parts = append(parts, a.Fn)
 		}
-		parts = append(parts, fmt.Sprintf("(%s)", strings.Join(filters, " ")))
 	}
 
 	if len(q.Links) > 0 {
@@ -290,6 +289,85 @@ func (q *Query) String() string {
 	return strings.Join(parts, " ")
 }
 
+// filterString writes a filter the way the parser reads it
+func filterString(filter openapi.Filter) string {
+	var not string
+	if filter.Not != nil && *filter.Not {
+		not = "!"
+	}
+
+	if filter.Or != nil {
+		or := make([]string, 0, len(*filter.Or))
+		for _, o := range *filter.Or {
+			or = append(or, filterString(o))
+		}
+		return not + strings.Join(or, " | ")
+	}
+
+	if filter.In != nil {
+		values := make([]string, 0, len(*filter.In))
+		for _, v := range *filter.In {
+			values = append(values, valueString(v))
+		}
+		return fmt.Sprintf("%s%s in (%s)", not, filter.Key, strings.Join(values, ", "))
+	}
+
+	var operator string = "="
+	var value interface{} = nil
+	var skipValue interface{} = nil
+
+	if filter.Equal != nil {
+		operator = "="
+		value = *filter.Equal
+	} else if filter.Less != nil {
+		operator = "<"
+		value = *filter.Less
+	} else if filter.Greater != nil {
+		operator = ">"
+		value = *filter.Greater
+	} else if filter.Contains != nil {
+		operator = "~"
+		value = *filter.Contains
+	} else if filter.Prefix != nil {
+		operator = "^"
+		value = *filter.Prefix
+
+		// Check for Skip value
+		if filter.Skip != nil {
+			skipValue = *filter.Skip
+		}
+	}
+
+	if value == nil && filter.Equal != nil {
+		return not + filter.Key + "=null"
+	}
+	if value == nil {
+		return not + filter.Key
+	}
+
+	filterStr := filter.Key + operator + valueString(value)
+
+	// Append skip part if it exists
+	if skipValue != nil {
+		filterStr += "$" + valueString(skipValue)
+	}
+
+	return not + filterStr
+}
+
+func valueString(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf(`"%s"`, val)
+	case float64:
+		return fmt.Sprintf(`%g`, val)
+	default:
+		return fmt.Sprintf(`%v`, val)
+	}
+}
+
 type Parser struct {
 	l              *Lexer
 	curToken       Token
@@ -333,6 +411,35 @@ func (p *Parser) ParseQuery() (*Query, error) {
 		query.Filter = filter
 	}
 
+	if p.curToken.Type == TOKEN_IDENT && p.curToken.Literal == "order" {
+		order, err := p.parseOrder()
+		if err != nil {
+			return nil, err
+		}
+		query.Order = order
+	}
+
+	if p.curToken.Type == TOKEN_IDENT && p.curToken.Literal == "group" {
+		p.nextToken()
+		if p.curToken.Type != TOKEN_IDENT || p.curToken.Literal != "by" {
+			return nil, fmt.Errorf("expected by after group, got %s", tokenName(p.curToken.Type))
+		}
+		p.nextToken()
+		if p.curToken.Type != TOKEN_IDENT {
+			return nil, fmt.Errorf("expected identifier to group by, got %s", tokenName(p.curToken.Type))
+		}
+		query.GroupBy = p.curToken.Literal
+		p.nextToken()
+	}
+
+	for p.curToken.Type == TOKEN_IDENT && isAggregate(p.curToken.Literal) {
+		aggregate, err := p.parseAggregate()
+		if err != nil {
+			return nil, err
+		}
+		query.Aggregates = append(query.Aggregates, aggregate)
+	}
+
 	if p.curToken.Type == TOKEN_LBRACE {
 		links, err := p.parseNested()
 		if err != nil {
@@ -356,157 +463,293 @@ func (p *Parser) parseFilter() ([]openapi.Filter, error) {
 			p.nextToken()
 		}
 
-		if p.curToken.Type != TOKEN_IDENT {
-			return nil, fmt.Errorf("expected identifier in filter, got %s", tokenName(p.curToken.Type))
+		filter, err := p.parseTerm()
+		if err != nil {
+			return nil, err
 		}
 
-		key := p.curToken.Literal
+		// | binds tighter than the and between filters, a | b c is (a or b) and c
+		if p.curToken.Type == TOKEN_OR {
+			or := []openapi.Filter{filter}
+			for p.curToken.Type == TOKEN_OR {
+				p.nextToken()
+				next, err := p.parseTerm()
+				if err != nil {
+					return nil, err
+				}
+				or = append(or, next)
+			}
+			filter = openapi.Filter{Or: &or}
+		}
+
+		filters = append(filters, filter)
+	}
+
+	if p.curToken.Type != TOKEN_RPAREN {
+		return nil, errors.New("expected )")
+	}
+	p.nextToken()
+
+	return filters, nil
+}
+
+// parseTerm parses a single filter, optionally negated with !
+func (p *Parser) parseTerm() (openapi.Filter, error) {
+
+	if p.curToken.Type == TOKEN_NOT {
 		p.nextToken()
+		filter, err := p.parseTerm()
+		if err != nil {
+			return filter, err
+		}
+		not := !(filter.Not != nil && *filter.Not)
+		filter.Not = &not
+		return filter, nil
+	}
 
-		if p.curToken.Type == TOKEN_RPAREN || p.curToken.Type == TOKEN_IDENT {
-			// Create a filter with just a key (no operator/value)
-			filter := openapi.Filter{
-				Key: key,
-			}
-			filters = append(filters, filter)
-			continue
+	if p.curToken.Type != TOKEN_IDENT {
+		return openapi.Filter{}, fmt.Errorf("expected identifier in filter, got %s", tokenName(p.curToken.Type))
+	}
+
+	key := p.curToken.Literal
+	p.nextToken()
+
+	// Create filter with appropriate operator
+	filter := openapi.Filter{
+		Key: key,
+	}
+
+	if p.curToken.Type == TOKEN_IDENT && p.curToken.Literal == "in" {
+		values, err := p.parseIn()
+		if err != nil {
+			return filter, err
+		}
+		filter.In = &values
+		return filter, nil
+	}
+
+	if p.curToken.Type == TOKEN_RPAREN || p.curToken.Type == TOKEN_IDENT || p.curToken.Type == TOKEN_OR || p.curToken.Type == TOKEN_NOT {
+		// a filter with just a key (no operator/value)
+		return filter, nil
+	}
+
+	var operator TokenType = p.curToken.Type
+	if operator != TOKEN_EQUALS && operator != TOKEN_LESS && operator != TOKEN_GREATER && operator != TOKEN_PREFIX && operator != TOKEN_CONTAINS {
+		return filter, fmt.Errorf("expected =, <, >, ^, ~ or in in filter, got %s", tokenName(p.curToken.Type))
+	}
+	p.nextToken()
+
+	processedValue, err := p.parseValue()
+	if err != nil {
+		return filter, err
+	}
+
+	// Set the operator-specific field
+	switch operator {
+	case TOKEN_EQUALS:
+		filter.Equal = &processedValue
+	case TOKEN_LESS:
+		filter.Less = &processedValue
+	case TOKEN_GREATER:
+		filter.Greater = &processedValue
+	case TOKEN_CONTAINS:
+		// words, even if they look like a number
+		words, ok := processedValue.(string)
+		if !ok && p.curToken.Type == TOKEN_PARAM && !p.collectingOnly {
+			return filter, fmt.Errorf("contains needs a string parameter, got %T", processedValue)
+		}
+		if !ok {
+			words = p.curToken.Literal
 		}
+		filter.Contains = &words
+	case TOKEN_PREFIX:
+		filter.Prefix = &processedValue
 
-		var operator TokenType = p.curToken.Type
-		if operator != TOKEN_EQUALS && operator != TOKEN_LESS && operator != TOKEN_GREATER && operator != TOKEN_PREFIX {
-			return nil, fmt.Errorf("expected =, <, >, or ^ in filter, got %s", tokenName(p.curToken.Type))
+		// Check for SKIP operation after a PREFIX
+		p.nextToken()
+
+		if p.curToken.Type != TOKEN_SKIP {
+			// No skip operation, the filter has just the prefix
+			return filter, nil
 		}
+
+		// We found a skip operation, advance and get the skip value
 		p.nextToken()
 
-		// Parse the value
 		if p.curToken.Type != TOKEN_IDENT && p.curToken.Type != TOKEN_STRING && p.curToken.Type != TOKEN_PARAM {
-			return nil, fmt.Errorf("expected identifier, string, or parameter placeholder as value, got %s", tokenName(p.curToken.Type))
+			return filter, fmt.Errorf("expected identifier, string, or parameter placeholder as skip value, got %s", tokenName(p.curToken.Type))
 		}
 
-		var processedValue interface{}
+		var skipValue interface{}
 
 		if p.curToken.Type == TOKEN_PARAM {
-			// Handle parameter placeholder
+			// Handle parameter placeholder for skip
 			if p.collectingOnly {
-				// Just increment the parameter count during collection phase
 				p.paramIndex++
-				processedValue = nil
+				skipValue = nil
 			} else {
-				// Check if we have enough parameters
 				if p.paramIndex >= len(p.params) {
-					return nil, fmt.Errorf("not enough parameters provided, needed at least %d", p.paramIndex+1)
+					return filter, fmt.Errorf("not enough parameters provided for skip, needed at least %d", p.paramIndex+1)
 				}
-				processedValue = p.params[p.paramIndex]
+				skipValue = p.params[p.paramIndex]
 				p.paramIndex++
 			}
 		} else {
-			// Handle literal values
-			value := p.curToken.Literal
+			// Handle literal skip values
+			skip := p.curToken.Literal
 
 			if p.curToken.Type == TOKEN_IDENT {
-				if value == "true" {
-					processedValue = true
-				} else if value == "false" {
-					processedValue = false
-				} else if num, err := strconv.ParseFloat(value, 64); err == nil {
-					processedValue = num
+				if skip == "true" {
+					skipValue = true
+				} else if skip == "false" {
+					skipValue = false
+				} else if num, err := strconv.ParseFloat(skip, 64); err == nil {
+					skipValue = num
 				} else {
-					processedValue = value
+					skipValue = skip
 				}
 			} else if p.curToken.Type == TOKEN_STRING {
-				processedValue = value
-			} else {
-				return nil, fmt.Errorf("expected value, got %s", tokenName(p.curToken.Type))
+				skipValue = skip
 			}
 		}
 
-		// Create filter with appropriate operator
-		filter := openapi.Filter{
-			Key: key,
-		}
+		// Set the Skip field in the filter
+		filter.Skip = &skipValue
+	}
 
-		// Set the operator-specific field
-		switch operator {
-		case TOKEN_EQUALS:
-			filter.Equal = &processedValue
-		case TOKEN_LESS:
-			filter.Less = &processedValue
-		case TOKEN_GREATER:
-			filter.Greater = &processedValue
-		case TOKEN_PREFIX:
-			filter.Prefix = &processedValue
+	p.nextToken()
+	return filter, nil
+}
 
-			// Check for SKIP operation after a PREFIX
-			p.nextToken()
+// parseIn parses the list of values after in, like in ("pending", "failed")
+func (p *Parser) parseIn() ([]interface{}, error) {
+	p.nextToken() // consume in
 
-			if p.curToken.Type == TOKEN_SKIP {
-				// We found a skip operation, advance and get the skip value
-				p.nextToken()
+	if p.curToken.Type != TOKEN_LPAREN {
+		return nil, fmt.Errorf("expected ( after in, got %s", tokenName(p.curToken.Type))
+	}
+	p.nextToken()
 
-				if p.curToken.Type != TOKEN_IDENT && p.curToken.Type != TOKEN_STRING && p.curToken.Type != TOKEN_PARAM {
-					return nil, fmt.Errorf("expected identifier, string, or parameter placeholder as skip value, got %s", tokenName(p.curToken.Type))
-				}
+	values := make([]interface{}, 0)
+	for p.curToken.Type != TOKEN_RPAREN {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.nextToken()
 
-				var skipValue interface{}
-
-				if p.curToken.Type == TOKEN_PARAM {
-					// Handle parameter placeholder for skip
-					if p.collectingOnly {
-						p.paramIndex++
-						skipValue = nil
-					} else {
-						if p.paramIndex >= len(p.params) {
-							return nil, fmt.Errorf("not enough parameters provided for skip, needed at least %d", p.paramIndex+1)
-						}
-						skipValue = p.params[p.paramIndex]
-						p.paramIndex++
-					}
-				} else {
-					// Handle literal skip values
-					skip := p.curToken.Literal
-
-					if p.curToken.Type == TOKEN_IDENT {
-						if skip == "true" {
-							skipValue = true
-						} else if skip == "false" {
-							skipValue = false
-						} else if num, err := strconv.ParseFloat(skip, 64); err == nil {
-							skipValue = num
-						} else {
-							skipValue = skip
-						}
-					} else if p.curToken.Type == TOKEN_STRING {
-						skipValue = skip
-					}
-				}
+		if p.curToken.Type == TOKEN_COMMA {
+			p.nextToken()
+		} else if p.curToken.Type != TOKEN_RPAREN {
+			return nil, fmt.Errorf("expected , or ) in list, got %s", tokenName(p.curToken.Type))
+		}
+	}
+	if len(values) == 0 {
+		return nil, errors.New("expected at least one value in list")
+	}
+	p.nextToken()
 
-				// Set the Skip field in the filter
-				filter.Skip = &skipValue
+	return values, nil
+}
 
-				// Add the filter with both Prefix and Skip to the filters slice
-				filters = append(filters, filter)
+// parseValue reads the value at the current token, a literal or a parameter, without consuming it
+func (p *Parser) parseValue() (interface{}, error) {
+	if p.curToken.Type != TOKEN_IDENT && p.curToken.Type != TOKEN_STRING && p.curToken.Type != TOKEN_PARAM {
+		return nil, fmt.Errorf("expected identifier, string, or parameter placeholder as value, got %s", tokenName(p.curToken.Type))
+	}
 
-				p.nextToken()
-				continue // Skip the next token advancement since we've already done it
-			} else {
-				// No skip operation, add the filter with just the prefix
-				filters = append(filters, filter)
-				continue // Skip the p.nextToken() at the end of the loop since we already advanced
-			}
-		default:
-			// For other operators, proceed normally
+	if p.curToken.Type == TOKEN_PARAM {
+		// Handle parameter placeholder
+		if p.collectingOnly {
+			// Just increment the parameter count during collection phase
+			p.paramIndex++
+			return nil, nil
+		}
+		// Check if we have enough parameters
+		if p.paramIndex >= len(p.params) {
+			return nil, fmt.Errorf("not enough parameters provided, needed at least %d", p.paramIndex+1)
 		}
+		value := p.params[p.paramIndex]
+		p.paramIndex++
+		return value, nil
+	}
 
-		filters = append(filters, filter)
+	// Handle literal values
+	value := p.curToken.Literal
+
+	if p.curToken.Type == TOKEN_STRING {
+		return value, nil
+	}
+	if value == "true" {
+		return true, nil
+	} else if value == "false" {
+		return false, nil
+	} else if value == "null" {
+		return nil, nil
+	} else if num, err := strconv.ParseFloat(value, 64); err == nil {
+		return num, nil
+	}
+	return value, nil
+}
+
+// parseOrder parses order by key, optionally followed by asc or desc
+func (p *Parser) parseOrder() (*openapi.Order, error) {
+	p.nextToken() // consume order
+
+	if p.curToken.Type != TOKEN_IDENT || p.curToken.Literal != "by" {
+		return nil, fmt.Errorf("expected by after order, got %s", tokenName(p.curToken.Type))
+	}
+	p.nextToken()
+
+	if p.curToken.Type != TOKEN_IDENT {
+		return nil, fmt.Errorf("expected identifier to order by, got %s", tokenName(p.curToken.Type))
+	}
+	order := &openapi.Order{Key: p.curToken.Literal}
+	p.nextToken()
+
+	if p.curToken.Type == TOKEN_IDENT && (p.curToken.Literal == "asc" || p.curToken.Literal == "desc") {
+		desc := p.curToken.Literal == "desc"
+		order.Desc = &desc
 		p.nextToken()
 	}
 
+	return order, nil
+}
+
+func isAggregate(fn string) bool {
+	switch fn {
+	case "count", "sum", "min", "max", "avg":
+		return true
+	}
+	return false
+}
+
+// parseAggregate parses count, or one of sum, min, max and avg with the key in parens, like sum(val.pages)
+func (p *Parser) parseAggregate() (openapi.Aggregate, error) {
+	aggregate := openapi.Aggregate{Fn: p.curToken.Literal}
+	p.nextToken()
+
+	if aggregate.Fn == "count" {
+		return aggregate, nil
+	}
+
+	if p.curToken.Type != TOKEN_LPAREN {
+		return aggregate, fmt.Errorf("expected ( after %s, got %s", aggregate.Fn, tokenName(p.curToken.Type))
+	}
+	p.nextToken()
+	if p.curToken.Type != TOKEN_IDENT {
+		return aggregate, fmt.Errorf("expected identifier to %s, got %s", aggregate.Fn, tokenName(p.curToken.Type))
+	}
+	key := p.curToken.Literal
+	aggregate.Key = &key
+	p.nextToken()
 	if p.curToken.Type != TOKEN_RPAREN {
-		return nil, errors.New("expected )")
+		return aggregate, errors.New("expected )")
 	}
 	p.nextToken()
 
-	return filters, nil
+	return aggregate, nil
 }
 
 func (p *Parser) parseNested() ([]*Query, error) {
@@ -307,6 +307,174 @@ func TestParser(t *testing.T) {
 			},
 			shouldError: false,
 		},
+		{
+			input: `Book(price>-1.5 price<20.25 count=-3)`,
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Key:     "price",
+						Greater: createValue(float64(-1.5)),
+					},
+					{
+						Key:  "price",
+						Less: createValue(float64(20.25)),
+					},
+					{
+						Key:   "count",
+						Equal: createValue(float64(-3)),
+					},
+				},
+			},
+			shouldError: false,
+		},
+		{
+			input: `Book(deleted=null active=false)`,
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Key:   "deleted",
+						Equal: createValue(nil),
+					},
+					{
+						Key:   "active",
+						Equal: createValue(false),
+					},
+				},
+			},
+			shouldError: false,
+		},
+		{
+			input: `Book(blurb~"sand worms" year~1965)`,
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Key:      "blurb",
+						Contains: createString("sand worms"),
+					},
+					{
+						Key:      "year",
+						Contains: createString("1965"),
+					},
+				},
+			},
+			shouldError: false,
+		},
+		{
+			input: `Book(val.status in ("pending", "failed") !val.deleted=true val.a=1 | val.b~"spice" val.c=2)`,
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Key: "val.status",
+						In:  &[]interface{}{"pending", "failed"},
+					},
+					{
+						Key:   "val.deleted",
+						Equal: createValue(true),
+						Not:   createBool(true),
+					},
+					{
+						Or: &[]openapi.Filter{
+							{Key: "val.a", Equal: createValue(1.0)},
+							{Key: "val.b", Contains: createString("spice")},
+						},
+					},
+					{
+						Key:   "val.c",
+						Equal: createValue(2.0),
+					},
+				},
+			},
+			shouldError: false,
+		},
+		{
+			input: `Book(!val.n in (1) || val.m)`,
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Or: &[]openapi.Filter{
+							{Key: "val.n", In: &[]interface{}{1.0}, Not: createBool(true)},
+							{Key: "val.m"},
+						},
+					},
+				},
+			},
+			shouldError: false,
+		},
+		{
+			input:       `Book(val.status in ())`,
+			shouldError: true,
+		},
+		{
+			input:       `Book(val.status in ("a" "b"))`,
+			shouldError: true,
+		},
+		{
+			input:       `Book(val.a=1 |)`,
+			shouldError: true,
+		},
+		{
+			input: `Book(val.author="Frank Herbert") order by val.year desc { Author }`,
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Key:   "val.author",
+						Equal: createValue("Frank Herbert"),
+					},
+				},
+				Order: &openapi.Order{Key: "val.year", Desc: createBool(true)},
+				Links: []*Query{{Type: "Author"}},
+			},
+			shouldError: false,
+		},
+		{
+			input: `Book order by id asc`,
+			expected: &Query{
+				Type:  "Book",
+				Order: &openapi.Order{Key: "id", Desc: createBool(false)},
+			},
+			shouldError: false,
+		},
+		{
+			input: `Book(val.lang="en") group by val.author count sum(val.pages) avg(val.year)`,
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Key:   "val.lang",
+						Equal: createValue("en"),
+					},
+				},
+				GroupBy: "val.author",
+				Aggregates: []openapi.Aggregate{
+					{Fn: "count"},
+					{Fn: "sum", Key: createString("val.pages")},
+					{Fn: "avg", Key: createString("val.year")},
+				},
+			},
+			shouldError: false,
+		},
+		{
+			input:       `Book group val.author`,
+			shouldError: true,
+		},
+		{
+			input:       `Book sum val.pages`,
+			shouldError: true,
+		},
+		{
+			input:       `Book order val.year`,
+			shouldError: true,
+		},
+		{
+			input:       `Book order by`,
+			shouldError: true,
+		},
 		{
 			input: `Book(name="test" & count=42 & enabled=true)`,
 			expected: &Query{
@@ -456,6 +624,27 @@ func TestParser(t *testing.T) {
 	}
 }
 
+func TestQueryString(t *testing.T) {
+	for _, input := range []string{
+		`Book(val.name="Dune" val.year>1960 val.blurb~"sand worms" val.path^"a"$"b")`,
+		`Book(val.status in ("pending", 1, true, null) !val.deleted=true val.a=1 | !val.b~"spice") order by val.year desc`,
+		`Book { Author(val.active=true) }`,
+		`Book(val.lang="en") group by val.author count max(val.year)`,
+	} {
+		q, err := Parse(input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		again, err := Parse(q.String())
+		if err != nil {
+			t.Fatalf("%s: %v", q.String(), err)
+		}
+		if !reflect.DeepEqual(q, again) {
+			t.Errorf("%s was written as %s", input, q.String())
+		}
+	}
+}
+
 func TestEdgeCases(t *testing.T) {
 	tests := []struct {
 		input       string
@@ -541,6 +730,29 @@ func TestParameterizedQueries(t *testing.T) {
 			},
 			shouldError: false,
 		},
+		{
+			name:  "Contains parameter",
+			input: `Book(blurb~?)`,
+			params: []interface{}{
+				"spice",
+			},
+			expected: &Query{
+				Type: "Book",
+				Filter: []openapi.Filter{
+					{
+						Key:      "blurb",
+						Contains: createString("spice"),
+					},
+				},
+			},
+			shouldError: false,
+		},
+		{
+			name:        "Contains needs a string",
+			input:       `Book(blurb~?)`,
+			params:      []interface{}{float64(1)},
+			shouldError: true,
+		},
 		{
 			name:  "Multiple parameters of different types",
 			input: `Book(name=? count=? available=?)`,
@@ -723,3 +935,11 @@ func TestParameterizedQueries(t *testing.T) {
 func createValue(value interface{}) *interface{} {
 	return &value
 }
+
+func createString(value string) *string {
+	return &value
+}
+
+func createBool(value bool) *bool {
+	return &value
+}
@@ -19,6 +19,15 @@ func (q *Query) ToSearchRequest() *openapi.SearchRequest {
 		req.Filters = &q.Filter
 	}
 
+	req.Order = q.Order
+
+	if q.GroupBy != "" {
+		req.GroupBy = &q.GroupBy
+	}
+	if len(q.Aggregates) > 0 {
+		req.Aggregates = &q.Aggregates
+	}
+
 	// Map nested/linked queries
 	if len(q.Links) > 0 {
 		links := make([]openapi.SearchRequest, 0, len(q.Links))
@@ -11,8 +11,10 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/aql"
 
 	"github.com/spf13/cobra"
 	"sigs.k8s.io/yaml"
@@ -22,6 +24,9 @@ var (
 	file string
 
 	fullDoc bool
+	reverse bool
+
+	asOf string
 
 	putCmd = &cobra.Command{
 		Use:     "put",
@@ -88,6 +93,9 @@ func RegisterCommands(root *cobra.Command) {
 	putCmd.MarkFlagRequired("file")
 
 	searchCmd.Flags().BoolVarP(&fullDoc, "full", "f", false, "Request full document for search results")
+	searchCmd.Flags().BoolVarP(&reverse, "reverse", "r", false, "Return results in descending order")
+	searchCmd.Flags().StringVar(&asOf, "as-of", "", "Search the database as it was at this time (RFC3339)")
+	getCmd.Flags().StringVar(&asOf, "as-of", "", "Get the document as it was at this time (RFC3339)")
 
 	root.AddCommand(putCmd)
 	root.AddCommand(getCmd)
@@ -233,13 +241,24 @@ func put(cmd *cobra.Command, args []string) {
 	}
 }
 
+func parseAsOf() *time.Time {
+	if asOf == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, asOf)
+	if err != nil {
+		log.Fatalf("invalid --as-of: %v", err)
+	}
+	return &t
+}
+
 func get(cmd *cobra.Command, args []string) {
 	client, err := getClient()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := client.GetDocumentWithResponse(context.Background(), args[0], args[1])
+	resp, err := client.GetDocumentWithResponse(context.Background(), args[0], args[1], &openapi.GetDocumentParams{AsOf: parseAsOf()})
 	if err != nil {
 		log.Fatalf("Failed to get document: %v", err)
 	}
@@ -310,6 +329,8 @@ func search(cmd *cobra.Command, args []string) {
 		filters = append(filters, parseFilter(arg))
 	}
 
+	at := parseAsOf()
+
 	var cursor *string
 	for {
 		req := openapi.SearchRequest{
@@ -317,6 +338,8 @@ func search(cmd *cobra.Command, args []string) {
 			Filters: &filters,
 			Cursor:  cursor,
 			Full:    &fullDoc,
+			Reverse: &reverse,
+			AsOf:    at,
 		}
 
 		resp, err := client.SearchDocumentsWithResponse(context.Background(), req)
@@ -361,6 +384,20 @@ func query(cmd *cobra.Command, args []string) {
 		argss = append(argss, interface{}(arg))
 	}
 
+	// aggregates return groups instead of documents
+	if q, err := aql.Parse(args[0], argss...); err == nil && (q.GroupBy != "" || len(q.Aggregates) > 0) {
+		groups, err := client.Aggregate(context.Background(), args[0], argss...)
+		if err != nil {
+			log.Fatalf("query error: %s", err)
+		}
+		enc, err := yaml.Marshal(groups)
+		if err != nil {
+			log.Fatalf("Failed to encode as YAML: %v", err)
+		}
+		os.Stdout.Write(enc)
+		return
+	}
+
 	it := client.Query(context.Background(), args[0], argss...)
 
 	for doc, err := range it {
@@ -411,7 +448,7 @@ func edit(cmd *cobra.Command, args []string) {
 	}
 
 	// Get the document first
-	resp, err := client.GetDocumentWithResponse(context.Background(), model, id)
+	resp, err := client.GetDocumentWithResponse(context.Background(), model, id, nil)
 	if err != nil {
 		log.Fatalf("Failed to get document: %v", err)
 	}
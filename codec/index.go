@@ -0,0 +1,144 @@
+// Package codec has the encodings of stored documents and of values in index keys,
+// shared by the server and the tools that read the database directly.
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// strings are indexed as they are. every other value starts with a tag byte that valid utf8 never contains,
+// so it can not collide with a string, and all of them sort after all strings.
+const (
+	IndexTagNull   = 0xf5
+	IndexTagFalse  = 0xf6
+	IndexTagTrue   = 0xf7
+	IndexTagNumber = 0xf8
+)
+
+// IndexValue encodes a null, a bool or a number from a document or a filter
+func IndexValue(v any) ([]byte, bool) {
+	switch v := v.(type) {
+	case nil:
+		return []byte{IndexTagNull}, true
+	case bool:
+		if v {
+			return []byte{IndexTagTrue}, true
+		}
+		return []byte{IndexTagFalse}, true
+	}
+	return IndexNumber(v)
+}
+
+// numbers are indexed as 16 bytes after their tag, which compare like the numbers themselves,
+// ints and floats alike, so a range of numbers is a range of keys. the first 8 bytes are the nearest float64,
+// the last 8 how far an int is from it, which is only ever not 0 beyond 2^53.
+// both are big endian with the sign bit flipped, negative floats have all their bits flipped.
+const IndexNumberLen = 1 + 16
+
+// IndexNumber encodes a value from a document or a filter, if it is a number
+func IndexNumber(v any) ([]byte, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return IndexInt(i), true
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, false
+		}
+		return indexFloat(f)
+	case float64:
+		return indexFloat(n)
+	case float32:
+		return indexFloat(float64(n))
+	case int:
+		return IndexInt(int64(n)), true
+	case int64:
+		return IndexInt(n), true
+	case int32:
+		return IndexInt(int64(n)), true
+	}
+	return nil, false
+}
+
+// IsIndexNumber tells if IndexNumber can encode v
+func IsIndexNumber(v any) bool {
+	_, ok := IndexNumber(v)
+	return ok
+}
+
+// IndexInt encodes an int like IndexNumber does
+func IndexInt(i int64) []byte {
+	f := float64(i)
+	var d int64
+	if f >= 0x1p63 {
+		// rounded up past the largest int64
+		d = int64(uint64(i) - uint64(f))
+	} else {
+		d = i - int64(f)
+	}
+	return encodeIndexNumber(f, d)
+}
+
+func indexFloat(f float64) ([]byte, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+	if f == 0 {
+		// -0 is 0
+		f = 0
+	}
+	return encodeIndexNumber(f, 0), true
+}
+
+func encodeIndexNumber(f float64, d int64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	b := make([]byte, IndexNumberLen)
+	b[0] = IndexTagNumber
+	binary.BigEndian.PutUint64(b[1:], bits)
+	binary.BigEndian.PutUint64(b[9:], uint64(d)^(1<<63))
+	return b
+}
+
+// DecodeIndexValue turns the encoding of IndexValue back into nil, a bool or a json.Number
+func DecodeIndexValue(b []byte) (any, bool) {
+	if len(b) == 1 {
+		switch b[0] {
+		case IndexTagNull:
+			return nil, true
+		case IndexTagFalse:
+			return false, true
+		case IndexTagTrue:
+			return true, true
+		}
+	}
+	if len(b) != IndexNumberLen || b[0] != IndexTagNumber {
+		return nil, false
+	}
+	b = b[1:]
+
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	f := math.Float64frombits(bits)
+	d := int64(binary.BigEndian.Uint64(b[8:]) ^ (1 << 63))
+
+	if f != math.Trunc(f) || f < -0x1p63 || f > 0x1p63 || (d == 0 && f == 0x1p63) {
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), true
+	}
+	if f == 0x1p63 {
+		return json.Number(strconv.FormatUint(uint64(f)+uint64(d), 10)), true
+	}
+	return json.Number(strconv.FormatInt(int64(f)+d, 10)), true
+}
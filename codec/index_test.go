@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexNumberOrder(t *testing.T) {
+	// ascending, ints and floats mixed
+	numbers := []json.Number{
+		"-1e+300",
+		"-9223372036854775808",
+		"-9007199254740993",
+		"-9007199254740992",
+		"-1.5",
+		"-1",
+		"-0.25",
+		"0",
+		"0.5",
+		"1",
+		"1.0000001",
+		"2",
+		"9007199254740992",
+		"9007199254740993",
+		"9223372036854775807",
+		"1e+19",
+		"1e+300",
+	}
+
+	var last []byte
+	for _, n := range numbers {
+		b, ok := IndexNumber(n)
+		assert.True(t, ok, n)
+		assert.Len(t, b, IndexNumberLen)
+		if last != nil {
+			assert.Equal(t, -1, bytes.Compare(last, b), "%s must sort after the number before it", n)
+		}
+		last = b
+
+		decoded, ok := DecodeIndexValue(b)
+		assert.True(t, ok)
+		assert.Equal(t, n, decoded)
+	}
+
+	// the same number is the same key, however it was written
+	for _, same := range [][]any{
+		{json.Number("1"), json.Number("1.0"), json.Number("1e0"), float64(1), 1},
+		{json.Number("0"), json.Number("-0"), json.Number("-0.0"), float64(0)},
+		{json.Number("-3"), float64(-3), int64(-3)},
+	} {
+		want, _ := IndexNumber(same[0])
+		for _, n := range same[1:] {
+			got, ok := IndexNumber(n)
+			assert.True(t, ok)
+			assert.Equal(t, want, got, "%v and %v", same[0], n)
+		}
+	}
+
+	// strings sort before all tagged values, and a string never starts with a tag
+	for _, v := range []any{nil, false, true, json.Number("-1e+300")} {
+		b, ok := IndexValue(v)
+		assert.True(t, ok)
+		assert.Equal(t, -1, bytes.Compare([]byte("\U0010ffff"), b))
+		assert.False(t, utf8.Valid(b[:1]))
+	}
+
+	_, ok := IndexNumber(json.Number("1e400"))
+	assert.False(t, ok)
+	_, ok = IndexNumber("1")
+	assert.False(t, ok)
+}
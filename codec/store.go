@@ -0,0 +1,237 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// every stored document starts with a byte naming its encoding:
+//
+//	'j' json
+//	'c' cbor
+//	'z' zstd compressed, the decompressed bytes start with their own encoding byte
+//	'e' encrypted, see server/encryption.go
+//
+// reads understand all of them, so the write encoding can be changed at any time
+// and old records are converted as they get written again.
+
+// Encoding selects how SerializeStore writes documents.
+// the zero value writes uncompressed json, which is what apogy always did
+type Encoding struct {
+	// 'j' or 'c'
+	Format byte
+	// compress records larger than this many bytes. 0 never compresses
+	CompressAbove int
+}
+
+// documents smaller than this rarely get smaller with zstd
+const defaultCompressAbove = 1024
+
+// ParseEncoding parses the --storage-encoding flag: json or cbor, optionally followed by +zstd
+func ParseEncoding(s string) (Encoding, error) {
+	var enc Encoding
+
+	format, compression, _ := strings.Cut(s, "+")
+	switch format {
+	case "", "json":
+		enc.Format = 'j'
+	case "cbor":
+		enc.Format = 'c'
+	default:
+		return enc, fmt.Errorf("unknown storage encoding: %s", format)
+	}
+
+	switch compression {
+	case "":
+	case "zstd":
+		enc.CompressAbove = defaultCompressAbove
+	default:
+		return enc, fmt.Errorf("unknown storage compression: %s", compression)
+	}
+
+	return enc, nil
+}
+
+func (e Encoding) String() string {
+	s := "json"
+	if e.Format == 'c' {
+		s = "cbor"
+	}
+	if e.CompressAbove > 0 {
+		s += "+zstd"
+	}
+	return s
+}
+
+// ErrEncrypted is returned for a document that was encrypted at rest, which needs the keys of the server
+var ErrEncrypted = errors.New("document is encrypted, but no encryption key is configured")
+
+// DeserializeStore decodes a stored document in any of the encodings
+func DeserializeStore(b []byte, doc *openapi.Document) error {
+	if len(b) < 1 {
+		return nil
+	}
+	switch b[0] {
+	case 'j':
+		dec := json.NewDecoder(bytes.NewReader(b[1:]))
+		dec.UseNumber()
+		return dec.Decode(doc)
+	case 'c':
+		return deserializeCBOR(b[1:], doc)
+	case 'z':
+		inner, err := zstdDecoder.DecodeAll(b[1:], nil)
+		if err != nil {
+			return fmt.Errorf("invalid compressed document in database: %w", err)
+		}
+		if len(inner) > 0 && inner[0] == 'z' {
+			return errors.New("invalid encoding stored in database")
+		}
+		return DeserializeStore(inner, doc)
+	case 'e':
+		return ErrEncrypted
+	default:
+		return errors.New("invalid encoding stored in database")
+	}
+}
+
+// SerializeStore encodes a document for storage
+func SerializeStore(doc *openapi.Document, enc Encoding) ([]byte, error) {
+	var b []byte
+	var err error
+
+	switch enc.Format {
+	case 0, 'j':
+		b, err = json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		b = append([]byte{'j'}, b...)
+	case 'c':
+		b, err = serializeCBOR(doc)
+		if err != nil {
+			return nil, err
+		}
+		b = append([]byte{'c'}, b...)
+	default:
+		return nil, fmt.Errorf("unknown storage encoding: %c", enc.Format)
+	}
+
+	if enc.CompressAbove > 0 && len(b) > enc.CompressAbove {
+		z := zstdEncoder.EncodeAll(b, []byte{'z'})
+		if len(z) < len(b) {
+			return z, nil
+		}
+	}
+
+	return b, nil
+}
+
+// both are safe for concurrent EncodeAll and DecodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// numbers are json.Number in documents, and must come back exactly as they were stored,
+// otherwise deleting the index of an old document would not find the keys it wrote.
+// numbers are stored as cbor ints or floats when that gives back the same text,
+// and everything else (1.50, 1e400, huge ints) keeps its text inside this tag.
+const cborNumberTag = 27666
+
+var cborEnc, _ = cbor.EncOptions{
+	Time: cbor.TimeRFC3339Nano,
+}.EncMode()
+
+var cborDec, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+func serializeCBOR(doc *openapi.Document) ([]byte, error) {
+	out := *doc
+	out.Val = toCBOR(doc.Val)
+	if doc.Status != nil {
+		status, _ := toCBOR(*doc.Status).(map[string]interface{})
+		out.Status = &status
+	}
+	return cborEnc.Marshal(&out)
+}
+
+func deserializeCBOR(b []byte, doc *openapi.Document) error {
+	if err := cborDec.Unmarshal(b, doc); err != nil {
+		return err
+	}
+	doc.Val = fromCBOR(doc.Val)
+	if doc.Status != nil {
+		status, _ := fromCBOR(*doc.Status).(map[string]interface{})
+		doc.Status = &status
+	}
+	return nil
+}
+
+func toCBOR(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *map[string]interface{}:
+		if v == nil {
+			return nil
+		}
+		return toCBOR(*v)
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			ret[k] = toCBOR(vv)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, vv := range v {
+			ret[i] = toCBOR(vv)
+		}
+		return ret
+	case json.Number:
+		s := string(v)
+		if i, err := v.Int64(); err == nil && strconv.FormatInt(i, 10) == s {
+			return i
+		}
+		if f, err := v.Float64(); err == nil && strconv.FormatFloat(f, 'g', -1, 64) == s {
+			return f
+		}
+		return cbor.Tag{Number: cborNumberTag, Content: s}
+	default:
+		return v
+	}
+}
+
+func fromCBOR(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range v {
+			v[k] = fromCBOR(vv)
+		}
+		return v
+	case []interface{}:
+		for i, vv := range v {
+			v[i] = fromCBOR(vv)
+		}
+		return v
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	case cbor.Tag:
+		if s, ok := v.Content.(string); ok && v.Number == cborNumberTag {
+			return json.Number(s)
+		}
+		return v
+	default:
+		return v
+	}
+}
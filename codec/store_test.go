@@ -0,0 +1,121 @@
+package codec
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serdeTestDocument() *openapi.Document {
+	version := uint64(7)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	status := map[string]interface{}{
+		"ok":    true,
+		"count": json.Number("3"),
+	}
+	return &openapi.Document{
+		Model:   "com.example.Serde",
+		Id:      "doc1",
+		Version: &version,
+		History: &openapi.History{Created: &created, Updated: &created},
+		Status:  &status,
+		Val: map[string]interface{}{
+			"name": "Document 1",
+			"none": nil,
+			"numbers": []interface{}{
+				json.Number("1"),
+				json.Number("-5"),
+				json.Number("0"),
+				json.Number("-0"),
+				json.Number("1.5"),
+				json.Number("1.50"),
+				json.Number("0.1"),
+				json.Number("1e21"),
+				json.Number("1e400"),
+				json.Number("9223372036854775807"),
+				json.Number("18446744073709551615"),
+				json.Number("123456789012345678901234567890"),
+			},
+			"nested": map[string]interface{}{
+				"deep": []interface{}{"a", json.Number("2"), false},
+			},
+		},
+	}
+}
+
+func TestSerde_RoundTrip(t *testing.T) {
+	for _, name := range []string{"json", "cbor", "json+zstd", "cbor+zstd"} {
+		t.Run(name, func(t *testing.T) {
+			enc, err := ParseEncoding(name)
+			require.NoError(t, err)
+			// make sure the small test document is compressed too
+			if enc.CompressAbove > 0 {
+				enc.CompressAbove = 1
+			}
+
+			doc := serdeTestDocument()
+			b, err := SerializeStore(doc, enc)
+			require.NoError(t, err)
+
+			var got openapi.Document
+			require.NoError(t, DeserializeStore(b, &got))
+
+			// numbers must come back as the exact same text, the index depends on it
+			assert.Equal(t, doc.Val, got.Val)
+			assert.Equal(t, *doc.Status, *got.Status)
+			assert.Equal(t, *doc.Version, *got.Version)
+			assert.True(t, doc.History.Created.Equal(*got.History.Created))
+			assert.Equal(t, doc.Id, got.Id)
+			assert.Equal(t, doc.Model, got.Model)
+		})
+	}
+}
+
+func TestSerde_ReadsExistingJSON(t *testing.T) {
+	var doc openapi.Document
+	err := DeserializeStore([]byte(`j{"id":"a","model":"m","version":1,"val":{"n":1.50}}`), &doc)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"n": json.Number("1.50")}, doc.Val)
+}
+
+func TestSerde_Compression(t *testing.T) {
+	enc, err := ParseEncoding("cbor+zstd")
+	require.NoError(t, err)
+
+	doc := serdeTestDocument()
+	doc.Val = map[string]interface{}{"text": strings.Repeat("apogy ", 1000)}
+
+	b, err := SerializeStore(doc, enc)
+	require.NoError(t, err)
+	assert.Equal(t, byte('z'), b[0])
+	assert.Less(t, len(b), 1000)
+
+	// small documents are not worth compressing
+	doc.Val = map[string]interface{}{"text": "apogy"}
+	b, err = SerializeStore(doc, enc)
+	require.NoError(t, err)
+	assert.Equal(t, byte('c'), b[0])
+}
+
+func TestSerde_ParseEncoding(t *testing.T) {
+	enc, err := ParseEncoding("")
+	require.NoError(t, err)
+	assert.Equal(t, "json", enc.String())
+
+	enc, err = ParseEncoding("cbor+zstd")
+	require.NoError(t, err)
+	assert.Equal(t, "cbor+zstd", enc.String())
+
+	_, err = ParseEncoding("xml")
+	assert.Error(t, err)
+	_, err = ParseEncoding("json+gzip")
+	assert.Error(t, err)
+
+	var doc openapi.Document
+	assert.Error(t, DeserializeStore([]byte("xwhat"), &doc))
+}
@@ -0,0 +1,133 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"iter"
+)
+
+// BulkChunk is when a BulkWrite commits and starts the next transaction.
+// it is well below DefaultTxnLimits, so a single large put does not push a chunk over
+var BulkChunk = TxnLimits{
+	MaxKeys:  10000,
+	MaxBytes: 4 << 20,
+}
+
+// BulkWrite is a Write for imports and reindexing, which may write more than fits into one transaction.
+// it commits whenever the pending writes reach BulkChunk and continues in a new transaction.
+// it is not atomic: when it fails, the chunks before are committed,
+// so use it only for work that can simply be run again.
+// reads see the writes of earlier chunks, but a key read in one chunk is not protected
+// from concurrent writers once the chunk is committed
+type BulkWrite struct {
+	kv  KV
+	ctx context.Context
+	w   Write
+
+	keys  int
+	bytes int
+
+	// Chunks is the number of chunks committed so far
+	Chunks int
+}
+
+// NewBulkWrite starts a bulk write. ctx is used for the commits of full chunks
+func NewBulkWrite(ctx context.Context, k KV) *BulkWrite {
+	return &BulkWrite{kv: k, ctx: ctx, w: k.Write()}
+}
+
+func (b *BulkWrite) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	return b.w.BatchGet(ctx, keys)
+}
+
+func (b *BulkWrite) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return b.w.Get(ctx, key)
+}
+
+func (b *BulkWrite) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	return b.w.Iter(ctx, start, end, opts...)
+}
+
+func (b *BulkWrite) Put(key []byte, value []byte) error {
+	if err := b.w.Put(key, value); err != nil {
+		return err
+	}
+	return b.grow(len(key) + len(value))
+}
+
+func (b *BulkWrite) Del(key []byte) error {
+	if err := b.w.Del(key); err != nil {
+		return err
+	}
+	return b.grow(len(key))
+}
+
+// grow counts every write, even to the same key, so a chunk is committed early rather than late
+func (b *BulkWrite) grow(size int) error {
+	b.keys++
+	b.bytes += size
+	if b.keys < BulkChunk.MaxKeys && b.bytes < BulkChunk.MaxBytes {
+		return nil
+	}
+	return b.flush(b.ctx)
+}
+
+func (b *BulkWrite) flush(ctx context.Context) error {
+	err := b.w.Commit(ctx)
+	b.w.Close()
+	b.w = b.kv.Write()
+	if err != nil {
+		return err
+	}
+	b.Chunks++
+	b.keys = 0
+	b.bytes = 0
+	return nil
+}
+
+// Commit commits the last chunk. the BulkWrite can be used for more writes after it
+func (b *BulkWrite) Commit(ctx context.Context) error {
+	return b.flush(ctx)
+}
+
+// Rollback drops the writes of the current chunk only
+func (b *BulkWrite) Rollback() error {
+	err := b.w.Rollback()
+	b.w.Close()
+	b.w = b.kv.Write()
+	b.keys = 0
+	b.bytes = 0
+	return err
+}
+
+func (b *BulkWrite) Close() {
+	b.w.Close()
+}
+
+// RangeDeleter is implemented by backends that can delete a range without reading it first
+type RangeDeleter interface {
+	DeleteRange(ctx context.Context, start []byte, end []byte) error
+}
+
+// DeleteRange deletes all keys from start up to, but not including, end.
+// backends without a RangeDeleter get the keys deleted in bulk
+func DeleteRange(ctx context.Context, k KV, start []byte, end []byte) error {
+	if rd, ok := k.(RangeDeleter); ok {
+		return rd.DeleteRange(ctx, start, end)
+	}
+
+	r := k.Read()
+	defer r.Close()
+	b := NewBulkWrite(ctx, k)
+	defer b.Close()
+
+	for kv, err := range r.Iter(ctx, start, end, KeysOnly) {
+		if err != nil {
+			return err
+		}
+		if err := b.Del(bytes.Clone(kv.K)); err != nil {
+			return err
+		}
+	}
+	return b.Commit(ctx)
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+)
+
+// keys are printed and typed with non printable bytes as \xNN and a backslash as \\,
+// so a key from ls can be pasted into get, del or ls again
+
+func escapeNonPrintable(b []byte) string {
+	var result strings.Builder
+	for _, c := range b {
+		if c == '\\' {
+			result.WriteString(`\\`)
+		} else if c >= 32 && c <= 126 {
+			result.WriteByte(c)
+		} else {
+			result.WriteString(fmt.Sprintf("\\x%02x", c))
+		}
+	}
+	return result.String()
+}
+
+func unescapeKey(s string) ([]byte, error) {
+	var ret []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			ret = append(ret, s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\\' {
+			ret = append(ret, '\\')
+			i++
+			continue
+		}
+		if i+3 < len(s) && s[i+1] == 'x' {
+			b, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			if err == nil {
+				ret = append(ret, byte(b))
+				i += 3
+				continue
+			}
+		}
+		return nil, fmt.Errorf("invalid escape at %d in %q, use \\xNN or \\\\", i, s)
+	}
+	return ret, nil
+}
+
+// decodeKey describes a key in the layout the server writes
+func decodeKey(k []byte) string {
+	var ns string
+	if rest, ok := bytes.CutPrefix(k, []byte("n\xff")); ok {
+		name, inner, found := bytes.Cut(rest, []byte{0xff})
+		if !found {
+			return "unknown " + escapeNonPrintable(k)
+		}
+		ns = "namespace=" + escapeNonPrintable(name) + " "
+		k = inner
+	}
+
+	if len(k) < 2 || k[1] != 0xff {
+		return ns + "unknown " + escapeNonPrintable(k)
+	}
+	parts := bytes.Split(bytes.TrimSuffix(k[2:], []byte{0xff}), []byte{0xff})
+
+	switch k[0] {
+	case 'o':
+		if len(parts) == 2 {
+			return fmt.Sprintf("%sdocument model=%s id=%s", ns, parts[0], parts[1])
+		}
+	case 'e':
+		if len(parts) == 2 {
+			return fmt.Sprintf("%sexpiry model=%s id=%s", ns, parts[0], parts[1])
+		}
+	case 'x':
+		if len(k) > 2+8 {
+			at := time.Unix(0, int64(binary.BigEndian.Uint64(k[2:10]))).UTC()
+			model, id, _ := bytes.Cut(bytes.TrimSuffix(k[10:], []byte{0xff}), []byte{0xff})
+			return fmt.Sprintf("%sexpiry sweep at=%s model=%s id=%s", ns, at.Format(time.RFC3339Nano), model, id)
+		}
+	case 'f':
+		if s, ok := decodeIndexKey(k); ok {
+			return ns + s
+		}
+	case 'c':
+		if s, ok := decodeCompositeKey(k); ok {
+			return ns + s
+		}
+	case 't':
+		if len(parts) > 0 {
+			return fmt.Sprintf("%stask %s", ns, bytes.Join(parts, []byte(" ")))
+		}
+	case 's':
+		if len(parts) == 4 {
+			return fmt.Sprintf("%sfulltext model=%s path=%s word=%s id=%s", ns, parts[0], parts[1], parts[2], parts[3])
+		}
+	}
+	return ns + "unknown " + escapeNonPrintable(k)
+}
+
+// f 0xff model 0xff path 0xff value 0xff id 0xff, or value 0xff 0xff for unique entries.
+// numbers are 17 bytes and may contain 0xff, but model, path and id never do
+func decodeIndexKey(k []byte) (string, bool) {
+	model, rest, ok := bytes.Cut(k[2:], []byte{0xff})
+	if !ok {
+		return "", false
+	}
+	path, rest, ok := bytes.Cut(rest, []byte{0xff})
+	if !ok {
+		return "", false
+	}
+	rest, ok = bytes.CutSuffix(rest, []byte{0xff})
+	if !ok {
+		return "", false
+	}
+
+	if value, ok := bytes.CutSuffix(rest, []byte{0xff}); ok {
+		return fmt.Sprintf("unique model=%s path=%s value=%s", model, path, decodeIndexValue(value)), true
+	}
+	i := bytes.LastIndexByte(rest, 0xff)
+	if i < 0 {
+		return "", false
+	}
+	return fmt.Sprintf("index model=%s path=%s value=%s id=%s", model, path, decodeIndexValue(rest[:i]), rest[i+1:]), true
+}
+
+// c 0xff model 0xff paths 0xff value 0xff ... value 0xff id 0xff, with one value for each of the comma separated paths,
+// or no id for unique entries.
+// numbers are always 17 bytes, everything else ends at the next 0xff
+func decodeCompositeKey(k []byte) (string, bool) {
+	model, rest, ok := bytes.Cut(k[2:], []byte{0xff})
+	if !ok {
+		return "", false
+	}
+	paths, rest, ok := bytes.Cut(rest, []byte{0xff})
+	if !ok {
+		return "", false
+	}
+
+	var values []string
+	for range bytes.Split(paths, []byte(",")) {
+		var value []byte
+		if len(rest) > 0 && rest[0] == codec.IndexTagNumber {
+			if len(rest) < codec.IndexNumberLen {
+				return "", false
+			}
+			value, rest = rest[:codec.IndexNumberLen], rest[codec.IndexNumberLen:]
+			if rest, ok = bytes.CutPrefix(rest, []byte{0xff}); !ok {
+				return "", false
+			}
+		} else if value, rest, ok = bytes.Cut(rest, []byte{0xff}); !ok {
+			return "", false
+		}
+		values = append(values, decodeIndexValue(value))
+	}
+
+	id, ok := bytes.CutSuffix(rest, []byte{0xff})
+	if !ok || bytes.IndexByte(id, 0xff) >= 0 {
+		return "", false
+	}
+	if len(id) == 0 {
+		return fmt.Sprintf("composite unique model=%s paths=%s values=%s", model, paths, strings.Join(values, ",")), true
+	}
+	return fmt.Sprintf("composite model=%s paths=%s values=%s id=%s", model, paths, strings.Join(values, ","), id), true
+}
+
+// a string, or a null, bool or number as codec.DecodeIndexValue reads it
+func decodeIndexValue(v []byte) string {
+	if value, ok := codec.DecodeIndexValue(v); ok {
+		if value == nil {
+			return "null"
+		}
+		return fmt.Sprint(value)
+	}
+	return strconv.Quote(string(v))
+}
+
+// formatValue prints documents as indented json and everything else escaped
+func formatValue(k []byte, v []byte) string {
+	if rest, ok := bytes.CutPrefix(k, []byte("n\xff")); ok {
+		if _, inner, found := bytes.Cut(rest, []byte{0xff}); found {
+			k = inner
+		}
+	}
+	if !bytes.HasPrefix(k, []byte("o\xff")) || len(v) == 0 {
+		return escapeNonPrintable(v)
+	}
+
+	if v[0] == 'j' {
+		var out bytes.Buffer
+		if err := json.Indent(&out, v[1:], "", "  "); err == nil {
+			return out.String()
+		}
+	}
+
+	var doc openapi.Document
+	if err := codec.DeserializeStore(v, &doc); err != nil {
+		return fmt.Sprintf("%s (%v)", escapeNonPrintable(v), err)
+	}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return escapeNonPrintable(v)
+	}
+	return string(out)
+}
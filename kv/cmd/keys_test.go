@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscapeRoundTrip(t *testing.T) {
+	for _, k := range []string{"", "plain", "o\xffBook\xffb1\xff", `back\slash`, "\x00\x01\xfe\xff"} {
+		b, err := unescapeKey(escapeNonPrintable([]byte(k)))
+		require.NoError(t, err)
+		assert.Equal(t, k, string(b))
+	}
+
+	_, err := unescapeKey(`f\xf`)
+	assert.Error(t, err)
+	_, err = unescapeKey(`f\n`)
+	assert.Error(t, err)
+}
+
+func TestDecodeKey(t *testing.T) {
+	tests := map[string]string{
+		"o\xffBook\xffb1\xff":                      "document model=Book id=b1",
+		"f\xffBook\xffval.title\xffDune\xffb1\xff": `index model=Book path=val.title value="Dune" id=b1`,
+		"f\xffBook\xffval.title\xffDune\xff\xff":   `unique model=Book path=val.title value="Dune"`,
+		"f\xffBook\xffval.n\xff\xf8\xc0\x45\x00\x00\x00\x00\x00\x00\x80\x00\x00\x00\x00\x00\x00\x00\xffb1\xff": "index model=Book path=val.n value=42 id=b1",
+		"f\xffBook\xffval.n\xff\xf8\xc3\x40\x00\x00\x00\x00\x00\x00\x80\x00\x00\x00\x00\x00\x00\x01\xffb1\xff": "index model=Book path=val.n value=9007199254740993 id=b1",
+		// a number may contain 0xff itself
+		"f\xffBook\xffval.n\xff\xf8\x40\x07\xff\xff\xff\xff\xff\xff\x80\x00\x00\x00\x00\x00\x00\x00\xff\xff": "unique model=Book path=val.n value=-1.5",
+		"f\xffBook\xffval.ok\xff\xf7\xffb1\xff":    "index model=Book path=val.ok value=true id=b1",
+		"f\xffBook\xffval.ok\xff\xf5\xffb1\xff":    "index model=Book path=val.ok value=null id=b1",
+		"s\xffBook\xffval.blurb\xffsand\xffb1\xff": "fulltext model=Book path=val.blurb word=sand id=b1",
+		"c\xffBook\xffval.author,val.year\xffHerbert\xff\xf8\xc0\x9e\xb4\x00\x00\x00\x00\x00\x80\x00\x00\x00\x00\x00\x00\x00\xffb1\xff": `composite model=Book paths=val.author,val.year values="Herbert",1965 id=b1`,
+		"c\xffUser\xffval.tenant,val.email\xffacme\xffbob@example.com\xff\xff":                                                          `composite unique model=User paths=val.tenant,val.email values="acme","bob@example.com"`,
+		"n\xffprod\xffe\xffBook\xffb1\xff": "namespace=prod expiry model=Book id=b1",
+		"zzz":                              "unknown zzz",
+	}
+	for k, want := range tests {
+		assert.Equal(t, want, decodeKey([]byte(k)), escapeNonPrintable([]byte(k)))
+	}
+}
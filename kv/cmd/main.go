@@ -1,37 +1,150 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"sort"
+
 	"github.com/aep/apogy/kv"
 	"github.com/spf13/cobra"
-	"strings"
+)
+
+var (
+	namespace   string
+	leveldbPath string
+
+	lsStart   string
+	lsEnd     string
+	lsLimit   int
+	lsValues  bool
+	lsDecode  bool
+	lsReverse bool
+	getRaw    bool
+	duDepth   int
+	delDryRun bool
 )
 
 var CMD = &cobra.Command{
 	Use:   "kv",
-	Short: "direct low level tikv",
+	Short: "direct low level kv access",
+	Long: `direct low level kv access.
+
+keys are printed and typed with non printable bytes as \xNN and a backslash as \\,
+for example: apogy kv ls 'f\xffcom.example.Book\xff'`,
 }
 
 func init() {
+	CMD.PersistentFlags().StringVar(&namespace, "namespace", os.Getenv("KV_NAMESPACE"), "Only see the keys of this namespace")
+	CMD.PersistentFlags().StringVar(&leveldbPath, "leveldb-path", os.Getenv("LEVELDB_PATH"), "Directory of the leveldb backend, default ./apogy-data")
+
 	CMD.AddCommand(listCmd)
 	CMD.AddCommand(getCmd)
 	CMD.AddCommand(putCmd)
 	CMD.AddCommand(delCmd)
+	CMD.AddCommand(decodeCmd)
+	CMD.AddCommand(duCmd)
+	CMD.AddCommand(delRangeCmd)
+	CMD.AddCommand(namespaceCmd)
+	namespaceCmd.AddCommand(namespaceListCmd)
+	namespaceCmd.AddCommand(namespaceDropCmd)
+
+	listCmd.Flags().StringVar(&lsStart, "start", "", "First key, inclusive")
+	listCmd.Flags().StringVar(&lsEnd, "end", "", "Last key, exclusive")
+	listCmd.Flags().IntVarP(&lsLimit, "limit", "n", 0, "Stop after this many keys")
+	listCmd.Flags().BoolVarP(&lsValues, "values", "v", false, "Print values too")
+	listCmd.Flags().BoolVarP(&lsDecode, "decode", "d", false, "Print what the key means to the server")
+	listCmd.Flags().BoolVarP(&lsReverse, "reverse", "r", false, "Walk the range from the end")
+	getCmd.Flags().BoolVar(&getRaw, "raw", false, "Print the value escaped, instead of documents as json")
+	duCmd.Flags().IntVar(&duDepth, "depth", 2, "Group keys by this many 0xff separated parts")
+	delRangeCmd.Flags().BoolVar(&delDryRun, "dry-run", false, "Only print the keys that would be deleted")
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func open() kv.KV {
+	k, err := kv.New(os.Getenv("KV_BACKEND"), leveldbPath)
+	if err != nil {
+		fail(err)
+	}
+	if namespace != "" {
+		k, err = kv.WithNamespace(k, namespace)
+		if err != nil {
+			fail(err)
+		}
+	}
+	return k
+}
+
+func mustUnescape(s string) []byte {
+	b, err := unescapeKey(s)
+	if err != nil {
+		fail(err)
+	}
+	return b
+}
+
+// keyRange turns a prefix or a start and end argument into a range
+func keyRange(args []string) ([]byte, []byte) {
+	switch len(args) {
+	case 0:
+		return []byte{}, []byte{}
+	case 1:
+		prefix := mustUnescape(args[0])
+		return prefix, kv.PrefixEnd(prefix)
+	default:
+		return mustUnescape(args[0]), mustUnescape(args[1])
+	}
 }
 
 var listCmd = &cobra.Command{
-	Use:   "ls",
-	Short: "List all key-value pairs",
+	Use:   "ls [prefix]",
+	Short: "List keys, all of them or those starting with prefix",
+	Args:  cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		kv, err := kv.NewTikv()
-		if err != nil {
-			panic(err)
+		k := open()
+		defer k.Close()
+
+		start, end := keyRange(args)
+		if lsStart != "" {
+			start = mustUnescape(lsStart)
 		}
-		for kv, err := range kv.Read().Iter(cmd.Context(), []byte{}, []byte{}) {
+		if lsEnd != "" {
+			end = mustUnescape(lsEnd)
+		}
+
+		var opts []kv.IterOption
+		if !lsValues {
+			opts = append(opts, kv.KeysOnly)
+		}
+		if lsReverse {
+			opts = append(opts, kv.Reverse)
+		}
+
+		r := k.Read()
+		defer r.Close()
+
+		n := 0
+		for kv, err := range r.Iter(cmd.Context(), start, end, opts...) {
 			if err != nil {
-				panic(err)
+				fail(err)
+			}
+			line := escapeNonPrintable(kv.K)
+			if lsDecode {
+				line += "\t" + decodeKey(kv.K)
+			}
+			if lsValues {
+				line += "\t" + escapeNonPrintable(kv.V)
+			}
+			fmt.Println(line)
+
+			n++
+			if lsLimit > 0 && n >= lsLimit {
+				break
 			}
-			fmt.Println(escapeNonPrintable(kv.K))
 		}
 	},
 }
@@ -41,15 +154,19 @@ var getCmd = &cobra.Command{
 	Short: "Get value for a key",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		kv, err := kv.NewTikv()
+		k := open()
+		defer k.Close()
+
+		key := mustUnescape(args[0])
+		v, err := k.Read().Get(cmd.Context(), key)
 		if err != nil {
-			panic(err)
+			fail(err)
 		}
-		v, err := kv.Read().Get(cmd.Context(), []byte(args[0]))
-		if err != nil {
-			panic(err)
+		if getRaw {
+			fmt.Println(escapeNonPrintable(v))
+		} else {
+			fmt.Println(formatValue(key, v))
 		}
-		fmt.Println(string(v))
 	},
 }
 
@@ -58,15 +175,14 @@ var putCmd = &cobra.Command{
 	Short: "Put a key-value pair",
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		kv, err := kv.NewTikv()
-		if err != nil {
-			panic(err)
-		}
-		w := kv.Write()
-		w.Put([]byte(args[0]), []byte(args[1]))
-		err = w.Commit(cmd.Context())
-		if err != nil {
-			panic(err)
+		k := open()
+		defer k.Close()
+
+		w := k.Write()
+		defer w.Close()
+		w.Put(mustUnescape(args[0]), mustUnescape(args[1]))
+		if err := w.Commit(cmd.Context()); err != nil {
+			fail(err)
 		}
 	},
 }
@@ -77,27 +193,161 @@ var delCmd = &cobra.Command{
 	Short:   "Delete a key-value pair",
 	Args:    cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		kv, err := kv.NewTikv()
+		k := open()
+		defer k.Close()
+
+		w := k.Write()
+		defer w.Close()
+		w.Del(mustUnescape(args[0]))
+		if err := w.Commit(cmd.Context()); err != nil {
+			fail(err)
+		}
+	},
+}
+
+var decodeCmd = &cobra.Command{
+	Use:   "decode [key]...",
+	Short: "Print what keys mean to the server: documents, index entries with their values, expiry",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, arg := range args {
+			fmt.Println(decodeKey(mustUnescape(arg)))
+		}
+	},
+}
+
+var duCmd = &cobra.Command{
+	Use:   "du [prefix]",
+	Short: "Count keys and their sizes, grouped by prefix",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		k := open()
+		defer k.Close()
+
+		type usage struct {
+			keys   int
+			kbytes int
+			vbytes int
+		}
+		groups := make(map[string]*usage)
+		var total usage
+
+		r := k.Read()
+		defer r.Close()
+
+		start, end := keyRange(args)
+		for kv, err := range r.Iter(cmd.Context(), start, end) {
+			if err != nil {
+				fail(err)
+			}
+			group := kv.K
+			for i, parts := 0, 0; i < len(kv.K); i++ {
+				if kv.K[i] == 0xff {
+					parts++
+					if parts == duDepth {
+						group = kv.K[:i+1]
+						break
+					}
+				}
+			}
+			u, ok := groups[string(group)]
+			if !ok {
+				u = &usage{}
+				groups[string(group)] = u
+			}
+			for _, u := range []*usage{u, &total} {
+				u.keys++
+				u.kbytes += len(kv.K)
+				u.vbytes += len(kv.V)
+			}
+		}
+
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Printf("%10s %12s %12s  %s\n", "KEYS", "KEY BYTES", "VALUE BYTES", "PREFIX")
+		for _, name := range names {
+			u := groups[name]
+			fmt.Printf("%10d %12d %12d  %s\n", u.keys, u.kbytes, u.vbytes, escapeNonPrintable([]byte(name)))
+		}
+		fmt.Printf("%10d %12d %12d  %s\n", total.keys, total.kbytes, total.vbytes, "total")
+	},
+}
+
+var delRangeCmd = &cobra.Command{
+	Use:   "delrange [prefix | start end]",
+	Short: "Delete all keys starting with prefix, or from start up to end",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		k := open()
+		defer k.Close()
+
+		start, end := keyRange(args)
+		if bytes.Compare(start, end) >= 0 && len(end) > 0 {
+			fail(fmt.Errorf("empty range: start must be before end"))
+		}
+
+		if !delDryRun {
+			if err := kv.DeleteRange(cmd.Context(), k, start, end); err != nil {
+				fail(err)
+			}
+			return
+		}
+
+		r := k.Read()
+		defer r.Close()
+		n := 0
+		for kv, err := range r.Iter(cmd.Context(), start, end, kv.KeysOnly) {
+			if err != nil {
+				fail(err)
+			}
+			fmt.Println(escapeNonPrintable(kv.K))
+			n++
+		}
+		fmt.Fprintf(os.Stderr, "would delete %d keys\n", n)
+	},
+}
+
+var namespaceCmd = &cobra.Command{
+	Use:     "namespace",
+	Aliases: []string{"ns"},
+	Short:   "Manage the databases kept apart by the server's --namespace",
+}
+
+var namespaceListCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List namespaces that have data",
+	Run: func(cmd *cobra.Command, args []string) {
+		k, err := kv.New(os.Getenv("KV_BACKEND"), leveldbPath)
 		if err != nil {
-			panic(err)
+			fail(err)
 		}
-		w := kv.Write()
-		w.Del([]byte(args[0]))
-		err = w.Commit(cmd.Context())
+		defer k.Close()
+		namespaces, err := kv.Namespaces(cmd.Context(), k)
 		if err != nil {
-			panic(err)
+			fail(err)
+		}
+		for _, ns := range namespaces {
+			fmt.Println(ns)
 		}
 	},
 }
 
-func escapeNonPrintable(b []byte) string {
-	var result strings.Builder
-	for _, c := range b {
-		if c >= 32 && c <= 126 {
-			result.WriteByte(c)
-		} else {
-			result.WriteString(fmt.Sprintf("\\x%02x", c))
+var namespaceDropCmd = &cobra.Command{
+	Use:   "drop [namespace]",
+	Short: "Delete every key of a namespace. stop the servers that use it first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		k, err := kv.New(os.Getenv("KV_BACKEND"), leveldbPath)
+		if err != nil {
+			fail(err)
 		}
-	}
-	return result.String()
+		defer k.Close()
+		if err := kv.DropNamespace(cmd.Context(), k, args[0]); err != nil {
+			fail(err)
+		}
+	},
 }
@@ -0,0 +1,55 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+)
+
+// ErrNotFound is returned by Get when the key does not exist.
+// it is the same value tikv returns, so both backends can be checked with IsErrNotFound
+var ErrNotFound = tikverr.ErrNotExist
+
+// ErrWriteConflict is returned by Commit when a key written by the transaction
+// was changed by a different transaction after it started
+var ErrWriteConflict = errors.New("write conflict")
+
+// ErrHistoryUnavailable is returned by reads opened with ReadAt
+// when the requested time is older than the history the backend keeps
+var ErrHistoryUnavailable = errors.New("history not available")
+
+func IsErrNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || tikverr.IsErrNotFound(err)
+}
+
+func IsErrWriteConflict(err error) bool {
+	return errors.Is(err, ErrWriteConflict) || tikverr.IsErrWriteConflict(err)
+}
+
+// TxnTooLargeError is returned by Put, Del and Commit of a write that grew past its TxnLimits.
+// the transaction cannot be committed anymore, use a BulkWrite to split it
+type TxnTooLargeError struct {
+	// size of the transaction including the write that was refused
+	Keys  int
+	Bytes int
+	// size of a single entry that is too large by itself, or 0
+	Entry  int
+	Limits TxnLimits
+}
+
+func (e *TxnTooLargeError) Error() string {
+	if e.Entry > 0 {
+		return fmt.Sprintf("transaction too large: entry of %d bytes exceeds the limit of %d bytes", e.Entry, e.Limits.MaxEntryBytes)
+	}
+	return fmt.Sprintf("transaction too large: %d keys and %d bytes exceed the limit of %d keys and %d bytes",
+		e.Keys, e.Bytes, e.Limits.MaxKeys, e.Limits.MaxBytes)
+}
+
+// IsErrTxnTooLarge also matches the errors tikv returns when its own limits are lower
+func IsErrTxnTooLarge(err error) bool {
+	var e *TxnTooLargeError
+	var txn *tikverr.ErrTxnTooLarge
+	var entry *tikverr.ErrEntryTooLarge
+	return errors.As(err, &e) || errors.As(err, &txn) || errors.As(err, &entry)
+}
@@ -0,0 +1,194 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"math/rand"
+	"sync"
+	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+)
+
+// ErrLockWaitTimeout is returned by ExclusiveWrite when the keys could not be locked in time
+var ErrLockWaitTimeout = tikverr.ErrLockWaitTimeout
+
+// ErrInjected is wrapped by every error a FaultKV makes up
+var ErrInjected = errors.New("injected fault")
+
+// Faults are the failures a FaultKV injects. rates are probabilities from 0 to 1,
+// so 1 fails every time and 0 never does
+type Faults struct {
+	// Commit fails with a write conflict and writes nothing
+	CommitConflict float64
+	// Commit writes everything and fails anyway, like a commit whose response was lost
+	CommitAmbiguous float64
+	// ExclusiveWrite fails with ErrLockWaitTimeout
+	LockWaitTimeout float64
+	// Get and BatchGet fail, as if the backend was briefly unreachable
+	ReadError float64
+	// Iter waits this long before every key
+	IterDelay time.Duration
+}
+
+// FaultKV is a KV for resilience tests, see WithFaults
+type FaultKV struct {
+	KV
+
+	mu     sync.Mutex
+	faults Faults
+	rnd    *rand.Rand
+}
+
+// WithFaults returns a KV that injects failures into k. it starts without any,
+// use Set to change them at any time. seed makes the injected failures repeatable
+func WithFaults(k KV, seed int64) *FaultKV {
+	return &FaultKV{KV: k, rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (f *FaultKV) Set(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+}
+
+// roll decides if the fault picked from the current Faults happens
+func (f *FaultKV) roll(rate func(Faults) float64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := rate(f.faults)
+	return r > 0 && f.rnd.Float64() < r
+}
+
+func (f *FaultKV) iterDelay() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.faults.IterDelay
+}
+
+func (f *FaultKV) Read() Read {
+	return &faultRead{r: f.KV.Read(), f: f}
+}
+
+func (f *FaultKV) ReadAt(at time.Time) Read {
+	return &faultRead{r: f.KV.ReadAt(at), f: f}
+}
+
+func (f *FaultKV) Write() Write {
+	w := f.KV.Write()
+	return &faultWrite{faultRead: faultRead{r: w, f: f}, w: w}
+}
+
+func (f *FaultKV) ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error) {
+	if f.roll(func(f Faults) float64 { return f.LockWaitTimeout }) {
+		return nil, fmt.Errorf("%w: %w", ErrInjected, ErrLockWaitTimeout)
+	}
+	w, err := f.KV.ExclusiveWrite(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return &faultWrite{faultRead: faultRead{r: w, f: f}, w: w}, nil
+}
+
+func (f *FaultKV) DeleteRange(ctx context.Context, start []byte, end []byte) error {
+	return DeleteRange(ctx, f.KV, start, end)
+}
+
+type faultRead struct {
+	r Read
+	f *FaultKV
+}
+
+type faultWrite struct {
+	faultRead
+	w Write
+}
+
+func (r *faultRead) readError() error {
+	if r.f.roll(func(f Faults) float64 { return f.ReadError }) {
+		return fmt.Errorf("%w: read failed", ErrInjected)
+	}
+	return nil
+}
+
+func (r *faultRead) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	if err := r.readError(); err != nil {
+		return nil, err
+	}
+	return r.r.BatchGet(ctx, keys)
+}
+
+func (r *faultRead) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := r.readError(); err != nil {
+		return nil, err
+	}
+	return r.r.Get(ctx, key)
+}
+
+func (r *faultRead) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	return func(yield func(KeyAndValue, error) bool) {
+		for kv, err := range r.r.Iter(ctx, start, end, opts...) {
+			if d := r.f.iterDelay(); d > 0 && err == nil {
+				select {
+				case <-ctx.Done():
+					yield(KeyAndValue{}, ctx.Err())
+					return
+				case <-time.After(d):
+				}
+			}
+			if !yield(kv, err) {
+				return
+			}
+		}
+	}
+}
+
+func (r *faultRead) Close() {
+	r.r.Close()
+}
+
+func (w *faultWrite) Put(key []byte, value []byte) error {
+	return w.w.Put(key, value)
+}
+
+func (w *faultWrite) Del(key []byte) error {
+	return w.w.Del(key)
+}
+
+func (w *faultWrite) Commit(ctx context.Context) error {
+	if w.f.roll(func(f Faults) float64 { return f.CommitConflict }) {
+		w.w.Rollback()
+		return fmt.Errorf("%w: %w", ErrInjected, ErrWriteConflict)
+	}
+	if err := w.w.Commit(ctx); err != nil {
+		return err
+	}
+	if w.f.roll(func(f Faults) float64 { return f.CommitAmbiguous }) {
+		return fmt.Errorf("%w: commit result unknown", ErrInjected)
+	}
+	return nil
+}
+
+func (w *faultWrite) Rollback() error {
+	return w.w.Rollback()
+}
+
+func (w *faultWrite) Close() {
+	w.w.Close()
+}
+
+func (w *faultWrite) Stat() int {
+	if st, ok := w.w.(LockStat); ok {
+		return st.Stat()
+	}
+	return 0
+}
+
+func (w *faultWrite) TxnSize() (int, int) {
+	if st, ok := w.w.(TxnSize); ok {
+		return st.TxnSize()
+	}
+	return 0, 0
+}
@@ -2,7 +2,9 @@ package kv
 
 import (
 	"context"
+	"fmt"
 	"iter"
+	"time"
 )
 
 type KeyAndValue struct {
@@ -15,13 +17,35 @@ type KV interface {
 	Write() Write
 	ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error)
 	Read() Read
+	// ReadAt opens a snapshot of the database as it was at the given time.
+	// if the backend no longer has the versions from that time, the returned Read fails with ErrHistoryUnavailable
+	ReadAt(at time.Time) Read
 	Ping() error
 }
 
+// IterOption changes how Iter walks its range
+type IterOption int
+
+const (
+	// Reverse walks the range from end down to start.
+	// the bounds mean the same as going forward: start is inclusive, end is exclusive
+	Reverse IterOption = 1 << iota
+	// KeysOnly leaves KeyAndValue.V nil, so backends that can skip reading the values do
+	KeysOnly
+)
+
+func iterOptions(opts []IterOption) (reverse bool, keysOnly bool) {
+	for _, o := range opts {
+		reverse = reverse || o&Reverse != 0
+		keysOnly = keysOnly || o&KeysOnly != 0
+	}
+	return reverse, keysOnly
+}
+
 type Read interface {
 	BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error)
 	Get(ctx context.Context, key []byte) ([]byte, error)
-	Iter(ctx context.Context, srart []byte, end []byte) iter.Seq2[KeyAndValue, error]
+	Iter(ctx context.Context, srart []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error]
 	Close()
 }
 
@@ -33,3 +57,29 @@ type Write interface {
 	Rollback() error
 	Close()
 }
+
+// LockStat is implemented by writes returned from ExclusiveWrite
+type LockStat interface {
+	Stat() (statLockRetries int)
+}
+
+// New opens the backend with the given name, with DefaultTxnLimits.
+// leveldbPath is the directory of the leveldb backend, the others ignore it
+func New(backend string, leveldbPath string) (KV, error) {
+	var k KV
+	var err error
+	switch backend {
+	case "", "tikv":
+		k, err = NewTikv()
+	case "memory":
+		k, err = NewMemory()
+	case "leveldb":
+		k, err = NewLevelDB(leveldbPath)
+	default:
+		return nil, fmt.Errorf("unknown kv backend: %s", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return WithTxnLimits(k, DefaultTxnLimits), nil
+}
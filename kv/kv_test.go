@@ -1,184 +1,297 @@
-package kv
+package kv_test
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aep/apogy/kv"
+	"github.com/aep/apogy/kv/kvtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
-	"go.uber.org/atomic"
 )
 
-func TestKVDoesPreventOutdatedWrites(t *testing.T) {
-
-	k, err := NewTikv()
-	require.NoError(t, err)
-	defer k.Close()
-
-	w1 := k.Write()
-	w2 := k.Write()
-	w3 := k.Write()
-
-	w1.Put([]byte("alice"), []byte("1"))
-	w2.Put([]byte("alice"), []byte("2"))
-	w3.Put([]byte("bob"), []byte("3"))
-
-	err = w1.Commit(context.Background())
-	require.NoError(t, err)
-
-	err = w2.Commit(context.Background())
-	require.Error(t, err, "w2 must fail because it is older than the last write")
+func TestMemory(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.KV {
+		k, err := kv.NewMemory()
+		require.NoError(t, err)
+		return k
+	})
+}
 
-	err = w3.Commit(context.Background())
-	require.NoError(t, err, "w3 must succeed because it is writing an unrelated key")
+func TestLevelDB(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.KV {
+		k, err := kv.NewLevelDB(t.TempDir())
+		require.NoError(t, err)
+		return k
+	})
+}
 
-	w4 := k.Write()
-	w4.Put([]byte("alice"), []byte("4"))
-	err = w4.Commit(context.Background())
-	require.NoError(t, err, "w4 must succeed because it is fresh")
+func TestTikv(t *testing.T) {
+	if os.Getenv("KV_BACKEND") != "tikv" {
+		t.Skip("set KV_BACKEND=tikv to run against a live tikv")
+	}
+	kvtest.Run(t, func(t *testing.T) kv.KV {
+		k, err := kv.NewTikv()
+		require.NoError(t, err)
+		return k
+	})
 }
 
-// this behaviour actually sucks because it means Delete in apogy must be locked
-// this test is just here in case they change their mind about it
-func TestKVDoesPreventOutdatedDoubleDelete(t *testing.T) {
+func TestMemoryWithTxnLimits(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.KV {
+		k, err := kv.NewMemory()
+		require.NoError(t, err)
+		return kv.WithTxnLimits(k, kv.DefaultTxnLimits)
+	})
+}
 
-	k, err := NewTikv()
+func TestTxnLimits(t *testing.T) {
+	ctx := t.Context()
+	m, err := kv.NewMemory()
 	require.NoError(t, err)
+	k := kv.WithTxnLimits(m, kv.TxnLimits{MaxKeys: 3, MaxBytes: 80, MaxEntryBytes: 50})
 	defer k.Close()
 
-	var ctx = t.Context()
-	var key = []byte("TestKVDoesNotPreventOutdatedDoubleDelete")
+	w := k.Write()
+	require.NoError(t, w.Put([]byte("a"), []byte("1")))
+	// writing the same key again does not count twice
+	require.NoError(t, w.Put([]byte("a"), []byte("2")))
+	require.NoError(t, w.Del([]byte("a")))
+	require.NoError(t, w.Put([]byte("b"), []byte("1")))
+	require.NoError(t, w.Put([]byte("c"), []byte("1")))
+	keys, bytes := w.(kv.TxnSize).TxnSize()
+	require.Equal(t, 3, keys)
+	require.Equal(t, 5, bytes)
+
+	err = w.Put([]byte("d"), []byte("1"))
+	require.True(t, kv.IsErrTxnTooLarge(err))
+	var tooLarge *kv.TxnTooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, 4, tooLarge.Keys)
+
+	// the transaction is refused even if the error of Put was ignored
+	require.True(t, kv.IsErrTxnTooLarge(w.Commit(ctx)))
+	w.Close()
+	_, err = k.Read().Get(ctx, []byte("b"))
+	require.True(t, kv.IsErrNotFound(err))
+
+	w = k.Write()
+	err = w.Put([]byte("big"), make([]byte, 60))
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, 63, tooLarge.Entry)
+	w.Close()
+
+	w = k.Write()
+	require.NoError(t, w.Put([]byte("x"), make([]byte, 45)))
+	require.True(t, kv.IsErrTxnTooLarge(w.Put([]byte("y"), make([]byte, 45))))
+	w.Close()
+}
 
-	prep := k.Write()
-	prep.Put(key, []byte("1"))
-	err = prep.Commit(ctx)
+func TestBulkWrite(t *testing.T) {
+	ctx := t.Context()
+	m, err := kv.NewMemory()
 	require.NoError(t, err)
+	k := kv.WithTxnLimits(m, kv.TxnLimits{MaxKeys: kv.BulkChunk.MaxKeys, MaxBytes: kv.BulkChunk.MaxBytes * 2})
+	defer k.Close()
 
-	w1 := k.Write()
-	w2 := k.Write()
-
-	w1.Del(key)
-	w2.Del(key)
-
-	err = w1.Commit(context.Background())
+	// more keys than one transaction may hold
+	n := kv.BulkChunk.MaxKeys*2 + 10
+	b := kv.NewBulkWrite(ctx, k)
+	for i := range n {
+		require.NoError(t, b.Put(fmt.Appendf(nil, "bulk\xff%06d", i), []byte("v")))
+	}
+	// earlier chunks are visible to reads of the bulk write
+	v, err := b.Get(ctx, []byte("bulk\xff000000"))
 	require.NoError(t, err)
+	require.Equal(t, "v", string(v))
+	require.NoError(t, b.Commit(ctx))
+	b.Close()
+	require.Equal(t, 3, b.Chunks)
 
-	err = w2.Commit(context.Background())
-	require.Error(t, err)
+	count := 0
+	for _, err := range k.Read().Iter(ctx, []byte("bulk\xff"), []byte("bulk\xff\xff"), kv.KeysOnly) {
+		require.NoError(t, err)
+		count++
+	}
+	require.Equal(t, n, count)
 }
 
-func TestKVDeleteAndPutMustConflict1(t *testing.T) {
+func TestMemoryWithNamespace(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.KV {
+		m, err := kv.NewMemory()
+		require.NoError(t, err)
+		k, err := kv.WithNamespace(m, "test")
+		require.NoError(t, err)
+		return k
+	})
+}
 
-	k, err := NewTikv()
+func TestNamespace(t *testing.T) {
+	ctx := t.Context()
+	root, err := kv.NewLevelDB(t.TempDir())
 	require.NoError(t, err)
-	defer k.Close()
+	defer root.Close()
 
-	var ctx = t.Context()
-	var key = []byte("TestKVDoesNotPreventOutdatedDoubleDelete")
+	_, err = kv.WithNamespace(root, "")
+	require.ErrorIs(t, err, kv.ErrInvalidNamespace)
 
-	prep := k.Write()
-	prep.Put(key, []byte("1"))
-	err = prep.Commit(ctx)
+	// a is a prefix of ab, which must not leak into a
+	a, err := kv.WithNamespace(root, "a")
 	require.NoError(t, err)
-
-	w1 := k.Write()
-	w2 := k.Write()
-
-	w1.Put(key, []byte("2"))
-	w2.Del(key)
-
-	err = w1.Commit(context.Background())
+	ab, err := kv.WithNamespace(root, "ab")
 	require.NoError(t, err)
 
-	err = w2.Commit(context.Background())
-	require.Error(t, err)
-}
-
-func TestKVDeleteAndPutMustConflict2(t *testing.T) {
+	for _, k := range []kv.KV{root, a, ab} {
+		w := k.Write()
+		require.NoError(t, w.Put([]byte("o\xffkey"), []byte("v")))
+		require.NoError(t, w.Commit(ctx))
+		w.Close()
+	}
+	w := a.Write()
+	require.NoError(t, w.Put([]byte("\xff\xff"), []byte("last")))
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	keys := func(k kv.KV) []string {
+		var ret []string
+		for kv, err := range k.Read().Iter(ctx, []byte{}, []byte{}, kv.KeysOnly) {
+			require.NoError(t, err)
+			ret = append(ret, string(kv.K))
+		}
+		return ret
+	}
+	require.Equal(t, []string{"o\xffkey", "\xff\xff"}, keys(a))
+	require.Equal(t, []string{"o\xffkey"}, keys(ab))
 
-	k, err := NewTikv()
+	vals, err := a.Read().BatchGet(ctx, [][]byte{[]byte("o\xffkey")})
 	require.NoError(t, err)
-	defer k.Close()
+	require.Equal(t, map[string][]byte{"o\xffkey": []byte("v")}, vals)
 
-	var ctx = t.Context()
-	var key = []byte("TestKVDoesNotPreventOutdatedDoubleDelete")
-
-	prep := k.Write()
-	prep.Put(key, []byte("1"))
-	err = prep.Commit(ctx)
+	namespaces, err := kv.Namespaces(ctx, root)
 	require.NoError(t, err)
+	require.Equal(t, []string{"ab", "a"}, namespaces)
 
-	w1 := k.Write()
-	w2 := k.Write()
-
-	w1.Del(key)
-	w2.Put(key, []byte("2"))
-
-	err = w1.Commit(context.Background())
+	require.NoError(t, kv.DropNamespace(ctx, root, "a"))
+	require.Empty(t, keys(a))
+	require.Equal(t, []string{"o\xffkey"}, keys(ab))
+	_, err = root.Read().Get(ctx, []byte("o\xffkey"))
 	require.NoError(t, err)
 
-	err = w2.Commit(context.Background())
-	require.Error(t, err)
-}
-
-func TestKVDoesNotPreventDup(t *testing.T) {
-	k, err := NewTikv()
+	namespaces, err = kv.Namespaces(ctx, root)
 	require.NoError(t, err)
-	defer k.Close()
-
-	w1 := k.Write()
-	w1.Put([]byte("alice"), []byte("1"))
-	w1.Put([]byte("alice"), []byte("2"))
+	require.Equal(t, []string{"ab"}, namespaces)
+}
 
-	err = w1.Commit(context.Background())
-	require.NoError(t, err, "kv must allow setting the same key twice within a tx")
+func TestMemoryWithMetrics(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.KV {
+		k, err := kv.NewMemory()
+		require.NoError(t, err)
+		return kv.WithMetrics(k, kv.NewMetrics())
+	})
 }
 
-func TestKVLockReordering(t *testing.T) {
-	k, err := NewTikv()
+func TestMetrics(t *testing.T) {
+	ctx := t.Context()
+	m, err := kv.NewMemory()
 	require.NoError(t, err)
+	metrics := kv.NewMetrics()
+	k := kv.WithMetrics(m, metrics)
 	defer k.Close()
 
-	var ctx = t.Context()
-	var key = []byte("reordertest")
-
-	w1, err := k.ExclusiveWrite(ctx, key)
-	require.NoError(t, err)
-	defer w1.Rollback()
-
-	var w1commited = atomic.NewBool(false)
-	go func() {
-		time.Sleep(time.Millisecond * 101)
-
-		err = w1.Put(key, []byte("1"))
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(metrics))
+
+	w := k.Write()
+	require.NoError(t, w.Put([]byte("o\xffBook\xffb1\xff"), []byte("j{}")))
+	require.NoError(t, w.Put([]byte("f\xffBook\xffval.a\xffx\xffb1\xff"), []byte("b1\xff")))
+	require.NoError(t, w.Put([]byte("f\xffBook\xffval.a\xffy\xffb1\xff"), []byte("b1\xff")))
+	require.NoError(t, w.Put([]byte("f\xffBook\xffval.a\xffx\xff\xff"), []byte("b1\xff")))
+	require.NoError(t, w.Put([]byte("s\xffBook\xffval.b\xffdune\xffb1\xff"), []byte("b1\xff")))
+	require.NoError(t, w.Put([]byte("c\xffBook\xffval.a,val.b\xffx\xffdune\xffb1\xff"), []byte("b1\xff")))
+	require.NoError(t, w.Put([]byte("c\xffBook\xffval.a,val.b\xffx\xffdune\xff\xff"), []byte("b1\xff")))
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	r := k.Read()
+	for _, err := range r.Iter(ctx, []byte("f\xffBook\xff"), []byte("f\xffBook\xff\xff"), kv.KeysOnly) {
 		require.NoError(t, err)
-
-		err = w1.Commit(ctx)
-		w1commited.Store(true)
-		require.NoError(t, err, "first commit must work")
-	}()
-
-	w2, err := k.ExclusiveWrite(ctx, key)
-	require.NoError(t, err)
-	defer w2.Rollback()
-
-	if !w1commited.Load() {
-		panic("not reordered")
 	}
-
-	current, err := w2.Get(ctx, key)
+	r.Close()
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP kv_writes_total Total number of KV puts and deletes
+# TYPE kv_writes_total counter
+kv_writes_total{operation="put",prefix="c"} 1
+kv_writes_total{operation="put",prefix="c_unique"} 1
+kv_writes_total{operation="put",prefix="f"} 2
+kv_writes_total{operation="put",prefix="o"} 1
+kv_writes_total{operation="put",prefix="s"} 1
+kv_writes_total{operation="put",prefix="unique"} 1
+`), "kv_writes_total")
 	require.NoError(t, err)
-	require.Equal(t, "1", string(current))
 
+	families, err := reg.Gather()
 	require.NoError(t, err)
-	err = w2.Put(key, []byte("2"))
-	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "kv_op_keys" {
+			continue
+		}
+		require.Len(t, f.GetMetric(), 1)
+		// the unique entry is scanned too
+		require.Equal(t, 3.0, f.GetMetric()[0].GetHistogram().GetSampleSum())
+	}
+}
 
-	err = w2.Commit(ctx)
-	require.NoError(t, err, "second commit must work")
+func TestMemoryWithFaults(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.KV {
+		k, err := kv.NewMemory()
+		require.NoError(t, err)
+		return kv.WithFaults(k, 1)
+	})
+}
 
-	actual, err := k.Read().Get(ctx, key)
+func TestFaults(t *testing.T) {
+	ctx := t.Context()
+	m, err := kv.NewMemory()
 	require.NoError(t, err)
-	require.Equal(t, "2", string(actual))
+	k := kv.WithFaults(m, 1)
+	defer k.Close()
 
+	k.Set(kv.Faults{CommitConflict: 1})
+	w := k.Write()
+	require.NoError(t, w.Put([]byte("a"), []byte("1")))
+	err = w.Commit(ctx)
+	require.True(t, kv.IsErrWriteConflict(err))
+	require.ErrorIs(t, err, kv.ErrInjected)
+	w.Close()
+	_, err = m.Read().Get(ctx, []byte("a"))
+	require.True(t, kv.IsErrNotFound(err))
+
+	k.Set(kv.Faults{CommitAmbiguous: 1})
+	w = k.Write()
+	require.NoError(t, w.Put([]byte("a"), []byte("2")))
+	require.ErrorIs(t, w.Commit(ctx), kv.ErrInjected)
+	w.Close()
+	v, err := m.Read().Get(ctx, []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v))
+
+	k.Set(kv.Faults{LockWaitTimeout: 1, ReadError: 1})
+	_, err = k.ExclusiveWrite(ctx, []byte("a"))
+	require.ErrorIs(t, err, kv.ErrLockWaitTimeout)
+	_, err = k.Read().Get(ctx, []byte("a"))
+	require.ErrorIs(t, err, kv.ErrInjected)
+	require.False(t, kv.IsErrNotFound(err))
+
+	k.Set(kv.Faults{IterDelay: time.Second})
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	for _, err := range k.Read().Iter(short, []byte{}, []byte{}) {
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	}
 }
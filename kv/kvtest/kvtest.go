@@ -0,0 +1,615 @@
+// Package kvtest is a conformance suite for kv.KV implementations.
+//
+// it checks the transactional guarantees the server relies on:
+// snapshot reads, write conflicts on commit, ExclusiveWrite serializing hot keys,
+// ordered iteration with exclusive upper bounds and rollback.
+// a new backend should pass all of it before being used for apogy.
+package kvtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aep/apogy/kv"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the suite. open is called once per test and must return an empty or otherwise
+// unused keyspace. it may also return a shared database, every test uses its own key prefix.
+func Run(t *testing.T, open func(t *testing.T) kv.KV) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, k kv.KV, key keyFn)
+	}{
+		{"PreventsOutdatedWrites", testPreventsOutdatedWrites},
+		{"PreventsOutdatedDoubleDelete", testPreventsOutdatedDoubleDelete},
+		{"DeleteAndPutMustConflict1", testDeleteAndPutMustConflict1},
+		{"DeleteAndPutMustConflict2", testDeleteAndPutMustConflict2},
+		{"DoesNotPreventDup", testDoesNotPreventDup},
+		{"LockReordering", testLockReordering},
+		{"ExclusiveWriteHonorsContext", testExclusiveWriteHonorsContext},
+		{"GetNotFound", testGetNotFound},
+		{"ReadIsSnapshot", testReadIsSnapshot},
+		{"ReadAt", testReadAt},
+		{"ReadAtBeyondHistory", testReadAtBeyondHistory},
+		{"WriteSeesOwnWrites", testWriteSeesOwnWrites},
+		{"IterBounds", testIterBounds},
+		{"IterUnboundedEnd", testIterUnboundedEnd},
+		{"IterCursorResume", testIterCursorResume},
+		{"WriteIterMergesPending", testWriteIterMergesPending},
+		{"IterReverse", testIterReverse},
+		{"IterReverseCursorResume", testIterReverseCursorResume},
+		{"IterKeysOnly", testIterKeysOnly},
+		{"WriteIterReverseMergesPending", testWriteIterReverseMergesPending},
+		{"BatchGet", testBatchGet},
+		{"Rollback", testRollback},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := open(t)
+			t.Cleanup(k.Close)
+
+			// backends like tikv are shared between runs, so every run gets fresh keys
+			prefix := fmt.Sprintf("kvtest\xff%s\xff%d\xff", tt.name, time.Now().UnixNano())
+			tt.fn(t, k, func(s string) []byte {
+				return []byte(prefix + s)
+			})
+		})
+	}
+}
+
+type keyFn func(s string) []byte
+
+func put(t *testing.T, k kv.KV, kvs ...string) {
+	w := k.Write()
+	defer w.Close()
+	for i := 0; i+1 < len(kvs); i += 2 {
+		require.NoError(t, w.Put([]byte(kvs[i]), []byte(kvs[i+1])))
+	}
+	require.NoError(t, w.Commit(t.Context()))
+}
+
+func collect(t *testing.T, r kv.Read, start []byte, end []byte, limit int, opts ...kv.IterOption) []string {
+	var ret []string
+	for kv, err := range r.Iter(t.Context(), start, end, opts...) {
+		require.NoError(t, err)
+		ret = append(ret, string(kv.K)+"="+string(kv.V))
+		if len(ret) >= limit {
+			break
+		}
+	}
+	return ret
+}
+
+func testPreventsOutdatedWrites(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+
+	w1 := k.Write()
+	w2 := k.Write()
+	w3 := k.Write()
+
+	w1.Put(key("alice"), []byte("1"))
+	w2.Put(key("alice"), []byte("2"))
+	w3.Put(key("bob"), []byte("3"))
+
+	err := w1.Commit(ctx)
+	require.NoError(t, err)
+
+	err = w2.Commit(ctx)
+	require.Error(t, err, "w2 must fail because it is older than the last write")
+	require.True(t, kv.IsErrWriteConflict(err), "must be a write conflict, got %v", err)
+
+	err = w3.Commit(ctx)
+	require.NoError(t, err, "w3 must succeed because it is writing an unrelated key")
+
+	w4 := k.Write()
+	w4.Put(key("alice"), []byte("4"))
+	err = w4.Commit(ctx)
+	require.NoError(t, err, "w4 must succeed because it is fresh")
+}
+
+// this behaviour actually sucks because it means Delete in apogy must be locked
+// this test is just here in case they change their mind about it
+func testPreventsOutdatedDoubleDelete(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+	put(t, k, string(key("k")), "1")
+
+	w1 := k.Write()
+	w2 := k.Write()
+
+	w1.Del(key("k"))
+	w2.Del(key("k"))
+
+	err := w1.Commit(ctx)
+	require.NoError(t, err)
+
+	err = w2.Commit(ctx)
+	require.Error(t, err)
+}
+
+func testDeleteAndPutMustConflict1(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+	put(t, k, string(key("k")), "1")
+
+	w1 := k.Write()
+	w2 := k.Write()
+
+	w1.Put(key("k"), []byte("2"))
+	w2.Del(key("k"))
+
+	err := w1.Commit(ctx)
+	require.NoError(t, err)
+
+	err = w2.Commit(ctx)
+	require.Error(t, err)
+}
+
+func testDeleteAndPutMustConflict2(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+	put(t, k, string(key("k")), "1")
+
+	w1 := k.Write()
+	w2 := k.Write()
+
+	w1.Del(key("k"))
+	w2.Put(key("k"), []byte("2"))
+
+	err := w1.Commit(ctx)
+	require.NoError(t, err)
+
+	err = w2.Commit(ctx)
+	require.Error(t, err)
+}
+
+func testDoesNotPreventDup(t *testing.T, k kv.KV, key keyFn) {
+	w1 := k.Write()
+	w1.Put(key("alice"), []byte("1"))
+	w1.Put(key("alice"), []byte("2"))
+
+	err := w1.Commit(t.Context())
+	require.NoError(t, err, "kv must allow setting the same key twice within a tx")
+
+	v, err := k.Read().Get(t.Context(), key("alice"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v))
+}
+
+func testLockReordering(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+
+	w1, err := k.ExclusiveWrite(ctx, key("k"))
+	require.NoError(t, err)
+	defer w1.Close()
+
+	w1done := make(chan error, 1)
+	go func() {
+		time.Sleep(time.Millisecond * 101)
+
+		err := w1.Put(key("k"), []byte("1"))
+		if err == nil {
+			err = w1.Commit(ctx)
+		}
+		w1done <- err
+	}()
+
+	w2, err := k.ExclusiveWrite(ctx, key("k"))
+	require.NoError(t, err)
+	defer w2.Close()
+
+	require.NoError(t, <-w1done, "first commit must work")
+
+	// w2 only got the lock after w1 commited, so it must see its write
+	current, err := w2.Get(ctx, key("k"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(current), "not reordered")
+
+	err = w2.Put(key("k"), []byte("2"))
+	require.NoError(t, err)
+
+	err = w2.Commit(ctx)
+	require.NoError(t, err, "second commit must work")
+
+	actual, err := k.Read().Get(ctx, key("k"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(actual))
+}
+
+func testExclusiveWriteHonorsContext(t *testing.T, k kv.KV, key keyFn) {
+	w1, err := k.ExclusiveWrite(t.Context(), key("k"))
+	require.NoError(t, err)
+	defer w1.Close()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 300*time.Millisecond)
+	defer cancel()
+
+	w2, err := k.ExclusiveWrite(ctx, key("k"))
+	if err == nil {
+		w2.Close()
+	}
+	require.Error(t, err, "must give up when the context is done")
+}
+
+func testGetNotFound(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+
+	r := k.Read()
+	defer r.Close()
+
+	_, err := r.Get(ctx, key("missing"))
+	require.True(t, kv.IsErrNotFound(err), "read must return not found, got %v", err)
+
+	w := k.Write()
+	defer w.Close()
+
+	_, err = w.Get(ctx, key("missing"))
+	require.True(t, kv.IsErrNotFound(err), "write must return not found, got %v", err)
+
+	put(t, k, string(key("k")), "1")
+	w.Del(key("k"))
+	_, err = w.Get(ctx, key("k"))
+	require.True(t, kv.IsErrNotFound(err), "deleted key must not be found in the same tx, got %v", err)
+}
+
+func testReadIsSnapshot(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+	put(t, k, string(key("a")), "1")
+
+	r := k.Read()
+	defer r.Close()
+
+	put(t, k, string(key("a")), "2", string(key("b")), "2")
+
+	v, err := r.Get(ctx, key("a"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(v), "read must not see commits after it started")
+
+	_, err = r.Get(ctx, key("b"))
+	require.True(t, kv.IsErrNotFound(err))
+
+	require.Equal(t, []string{string(key("a")) + "=1"}, collect(t, r, key(""), key("\xff"), 10))
+
+	w := k.Write()
+	defer w.Close()
+	v, err = w.Get(ctx, key("a"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v), "new transactions must see the last commit")
+}
+
+func testReadAt(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+	put(t, k, string(key("a")), "1")
+
+	// leave some room for clocks that are not as fine grained as ours
+	time.Sleep(50 * time.Millisecond)
+	then := time.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	put(t, k, string(key("a")), "2", string(key("b")), "2")
+
+	r := k.ReadAt(then)
+	defer r.Close()
+
+	v, err := r.Get(ctx, key("a"))
+	if errors.Is(err, kv.ErrHistoryUnavailable) {
+		t.Skip("backend does not keep history")
+	}
+	require.NoError(t, err)
+	require.Equal(t, "1", string(v))
+
+	_, err = r.Get(ctx, key("b"))
+	require.True(t, kv.IsErrNotFound(err))
+
+	require.Equal(t, []string{string(key("a")) + "=1"}, collect(t, r, key(""), key("\xff"), 10))
+
+	// a time in the future reads the latest commit
+	r2 := k.ReadAt(time.Now().Add(time.Hour))
+	defer r2.Close()
+	v, err = r2.Get(ctx, key("a"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v))
+}
+
+func testReadAtBeyondHistory(t *testing.T, k kv.KV, key keyFn) {
+	put(t, k, string(key("a")), "1")
+
+	r := k.ReadAt(time.Now().Add(-365 * 24 * time.Hour))
+	defer r.Close()
+
+	_, err := r.Get(t.Context(), key("a"))
+	require.ErrorIs(t, err, kv.ErrHistoryUnavailable)
+
+	for _, err := range r.Iter(t.Context(), key(""), key("\xff")) {
+		require.ErrorIs(t, err, kv.ErrHistoryUnavailable)
+	}
+}
+
+func testWriteSeesOwnWrites(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+
+	w := k.Write()
+	defer w.Close()
+
+	require.NoError(t, w.Put(key("a"), []byte("1")))
+
+	v, err := w.Get(ctx, key("a"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(v))
+
+	r := k.Read()
+	defer r.Close()
+	_, err = r.Get(ctx, key("a"))
+	require.True(t, kv.IsErrNotFound(err), "uncommited writes must not be visible outside")
+}
+
+func testIterBounds(t *testing.T, k kv.KV, key keyFn) {
+	put(t, k,
+		string(key("a")), "1",
+		string(key("b")), "2",
+		string(key("b\xff1")), "3",
+		string(key("c")), "4",
+		string(key("d")), "5",
+	)
+
+	r := k.Read()
+	defer r.Close()
+
+	require.Equal(t, []string{
+		string(key("b")) + "=2",
+		string(key("b\xff1")) + "=3",
+		string(key("c")) + "=4",
+	}, collect(t, r, key("b"), key("d"), 100), "start is inclusive, end is exclusive")
+
+	require.Equal(t, []string{
+		string(key("b\xff1")) + "=3",
+	}, collect(t, r, key("b\xff"), key("b\xff\xff"), 100))
+
+	require.Empty(t, collect(t, r, key("x"), key("z"), 100))
+	require.Empty(t, collect(t, r, key("c"), key("c"), 100), "empty range")
+
+	require.Equal(t, []string{
+		string(key("a")) + "=1",
+		string(key("b")) + "=2",
+	}, collect(t, r, key(""), key("\xff"), 2), "must stop when the caller breaks")
+}
+
+func testIterUnboundedEnd(t *testing.T, k kv.KV, key keyFn) {
+	put(t, k,
+		string(key("a")), "1",
+		string(key("b")), "2",
+		string(key("c")), "3",
+	)
+
+	r := k.Read()
+	defer r.Close()
+
+	require.Equal(t, []string{
+		string(key("b")) + "=2",
+		string(key("c")) + "=3",
+	}, collect(t, r, key("b"), nil, 2), "a nil end iterates to the end of the keyspace")
+}
+
+func testIterCursorResume(t *testing.T, k kv.KV, key keyFn) {
+	var kvs []string
+	var all []string
+	for i := range 250 {
+		kk := string(key(fmt.Sprintf("%04d", i)))
+		kvs = append(kvs, kk, "v")
+		all = append(all, kk+"=v")
+	}
+	put(t, k, kvs...)
+
+	r := k.Read()
+	defer r.Close()
+
+	// same as the server does with cursors: continue right after the last key
+	var got []string
+	start := key("")
+	for {
+		page := collect(t, r, start, key("\xff"), 100)
+		got = append(got, page...)
+		if len(page) < 100 {
+			break
+		}
+		last, _, _ := bytes.Cut([]byte(page[len(page)-1]), []byte("="))
+		start = append(last, 0)
+	}
+
+	require.Equal(t, all, got)
+}
+
+func testWriteIterMergesPending(t *testing.T, k kv.KV, key keyFn) {
+	put(t, k,
+		string(key("a")), "1",
+		string(key("b")), "2",
+		string(key("c")), "3",
+	)
+
+	w := k.Write()
+	defer w.Close()
+
+	w.Put(key("aa"), []byte("new"))
+	w.Put(key("c"), []byte("changed"))
+	w.Del(key("b"))
+
+	require.Equal(t, []string{
+		string(key("a")) + "=1",
+		string(key("aa")) + "=new",
+		string(key("c")) + "=changed",
+	}, collect(t, w, key(""), key("\xff"), 100))
+}
+
+func testIterReverse(t *testing.T, k kv.KV, key keyFn) {
+	put(t, k,
+		string(key("a")), "1",
+		string(key("b")), "2",
+		string(key("b\xff1")), "3",
+		string(key("c")), "4",
+		string(key("d")), "5",
+	)
+
+	r := k.Read()
+	defer r.Close()
+
+	require.Equal(t, []string{
+		string(key("c")) + "=4",
+		string(key("b\xff1")) + "=3",
+		string(key("b")) + "=2",
+	}, collect(t, r, key("b"), key("d"), 100, kv.Reverse), "start is inclusive, end is exclusive")
+
+	require.Empty(t, collect(t, r, key("x"), key("z"), 100, kv.Reverse))
+	require.Empty(t, collect(t, r, key("c"), key("c"), 100, kv.Reverse), "empty range")
+
+	require.Equal(t, []string{
+		string(key("d")) + "=5",
+		string(key("c")) + "=4",
+	}, collect(t, r, key(""), key("\xff"), 2, kv.Reverse), "must stop when the caller breaks")
+}
+
+func testIterReverseCursorResume(t *testing.T, k kv.KV, key keyFn) {
+	var kvs []string
+	var all []string
+	for i := range 250 {
+		kk := string(key(fmt.Sprintf("%04d", i)))
+		kvs = append(kvs, kk, "v")
+		all = append([]string{kk + "=v"}, all...)
+	}
+	put(t, k, kvs...)
+
+	r := k.Read()
+	defer r.Close()
+
+	// going backwards the last key is the exclusive end of the next page
+	var got []string
+	end := key("\xff")
+	for {
+		page := collect(t, r, key(""), end, 100, kv.Reverse)
+		got = append(got, page...)
+		if len(page) < 100 {
+			break
+		}
+		end, _, _ = bytes.Cut([]byte(page[len(page)-1]), []byte("="))
+	}
+
+	require.Equal(t, all, got)
+}
+
+func testIterKeysOnly(t *testing.T, k kv.KV, key keyFn) {
+	put(t, k,
+		string(key("a")), "1",
+		string(key("b")), "2",
+	)
+
+	r := k.Read()
+	defer r.Close()
+
+	require.Equal(t, []string{
+		string(key("a")) + "=",
+		string(key("b")) + "=",
+	}, collect(t, r, key(""), key("\xff"), 100, kv.KeysOnly))
+
+	require.Equal(t, []string{
+		string(key("b")) + "=",
+		string(key("a")) + "=",
+	}, collect(t, r, key(""), key("\xff"), 100, kv.KeysOnly, kv.Reverse))
+
+	// the read is still usable for values afterwards
+	require.Equal(t, []string{
+		string(key("a")) + "=1",
+		string(key("b")) + "=2",
+	}, collect(t, r, key(""), key("\xff"), 100))
+}
+
+func testWriteIterReverseMergesPending(t *testing.T, k kv.KV, key keyFn) {
+	put(t, k,
+		string(key("a")), "1",
+		string(key("b")), "2",
+		string(key("c")), "3",
+	)
+
+	w := k.Write()
+	defer w.Close()
+
+	w.Put(key("aa"), []byte("new"))
+	w.Put(key("c"), []byte("changed"))
+	w.Put(key("d"), []byte("4"))
+	w.Del(key("b"))
+
+	require.Equal(t, []string{
+		string(key("d")) + "=4",
+		string(key("c")) + "=changed",
+		string(key("aa")) + "=new",
+		string(key("a")) + "=1",
+	}, collect(t, w, key(""), key("\xff"), 100, kv.Reverse))
+
+	require.Equal(t, []string{
+		string(key("a")) + "=",
+		string(key("aa")) + "=",
+		string(key("c")) + "=",
+		string(key("d")) + "=",
+	}, collect(t, w, key(""), key("\xff"), 100, kv.KeysOnly))
+}
+
+func testBatchGet(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+	put(t, k,
+		string(key("a")), "1",
+		string(key("b")), "2",
+	)
+
+	r := k.Read()
+	defer r.Close()
+
+	vals, err := r.BatchGet(ctx, [][]byte{key("a"), key("b"), key("missing")})
+	require.NoError(t, err)
+	require.Len(t, vals, 2, "missing keys must not be in the result")
+	require.Equal(t, "1", string(vals[string(key("a"))]))
+	require.Equal(t, "2", string(vals[string(key("b"))]))
+
+	w := k.Write()
+	defer w.Close()
+	w.Put(key("c"), []byte("3"))
+
+	vals, err = w.BatchGet(ctx, [][]byte{key("a"), key("c")})
+	require.NoError(t, err)
+	require.Equal(t, "1", string(vals[string(key("a"))]))
+	require.Equal(t, "3", string(vals[string(key("c"))]))
+}
+
+func testRollback(t *testing.T, k kv.KV, key keyFn) {
+	ctx := t.Context()
+
+	w := k.Write()
+	w.Put(key("a"), []byte("1"))
+	require.NoError(t, w.Rollback())
+	require.Error(t, w.Commit(ctx), "commit after rollback must fail")
+
+	_, err := k.Read().Get(ctx, key("a"))
+	require.True(t, kv.IsErrNotFound(err), "rolled back writes must not be visible")
+
+	w = k.Write()
+	w.Put(key("a"), []byte("2"))
+	require.NoError(t, w.Commit(ctx))
+	require.Error(t, w.Rollback(), "rollback after commit must fail")
+
+	// a rolled back ExclusiveWrite must release its lock
+	ctx2, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	w1, err := k.ExclusiveWrite(ctx2, key("a"))
+	require.NoError(t, err)
+	w1.Put(key("a"), []byte("3"))
+	require.NoError(t, w1.Rollback())
+
+	w2, err := k.ExclusiveWrite(ctx2, key("a"))
+	require.NoError(t, err)
+	defer w2.Close()
+
+	v, err := w2.Get(ctx, key("a"))
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v))
+}
@@ -0,0 +1,397 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB is a durable single node KV stored in a local directory.
+//
+// reads and transactions run on leveldb snapshots.
+// leveldb only keeps the latest version of a key, so ReadAt can not look into the past.
+// leveldb itself has no transactions, so write conflicts are detected in process:
+// every commit remembers which keys it wrote, and a later commit fails with ErrWriteConflict
+// if one of its keys was written after it started.
+// the directory is locked by leveldb, so no other process can write behind our back.
+type LevelDB struct {
+	db *leveldb.DB
+
+	lk sync.Mutex
+
+	// timestamp of the last commit
+	ts uint64
+	// commit timestamp of keys written since the oldest open transaction started
+	commits map[string]uint64
+
+	locks  lockTable
+	active snapshotSet
+}
+
+func NewLevelDB(path string) (KV, error) {
+	if path == "" {
+		path = "apogy-data"
+	}
+
+	db, err := leveldb.OpenFile(path, nil)
+	if lerrors.IsCorrupted(err) {
+		log.Warn("[leveldb] database is corrupted, trying to recover", "path", path, "err", err)
+		db, err = leveldb.RecoverFile(path, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open leveldb at %s: %w", path, err)
+	}
+
+	return &LevelDB{
+		db:      db,
+		commits: make(map[string]uint64),
+		locks:   newLockTable(),
+		active:  make(snapshotSet),
+	}, nil
+}
+
+func (l *LevelDB) Close() {
+	l.db.Close()
+}
+
+func (l *LevelDB) Ping() error {
+	_, err := l.db.GetProperty("leveldb.stats")
+	return err
+}
+
+func (l *LevelDB) Read() Read {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return &LevelDBRead{err: err}
+	}
+	l.active.add(l.ts)
+	return &LevelDBRead{l: l, snap: snap, ts: l.ts}
+}
+
+func (l *LevelDB) ReadAt(at time.Time) Read {
+	if !at.Before(time.Now()) {
+		return l.Read()
+	}
+	return &LevelDBRead{err: fmt.Errorf("%w: the leveldb backend does not keep old versions", ErrHistoryUnavailable)}
+}
+
+func (l *LevelDB) Write() Write {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	return l.begin()
+}
+
+func (l *LevelDB) ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error) {
+
+	retries := 0
+	for {
+		retries += 1
+
+		l.lk.Lock()
+
+		// the transaction starts after the lock is taken,
+		// so it always sees the commit of the previous lock holder
+		w := l.begin()
+		if w.err != nil {
+			l.lk.Unlock()
+			return nil, w.err
+		}
+		if locked, ok := l.locks.tryLock(w, keys); ok {
+			w.locked = locked
+			w.statLockRetries = retries
+			l.lk.Unlock()
+			return w, nil
+		}
+		l.finish(w)
+
+		unlocked := l.locks.unlocked
+		l.lk.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-unlocked:
+		}
+	}
+}
+
+// must be called with lk held
+func (l *LevelDB) begin() *LevelDBWrite {
+	snap, err := l.db.GetSnapshot()
+	if err != nil {
+		return &LevelDBWrite{LevelDBRead: LevelDBRead{err: err}}
+	}
+	l.active.add(l.ts)
+	return &LevelDBWrite{
+		LevelDBRead: LevelDBRead{l: l, snap: snap, ts: l.ts},
+		pending:     make(map[string]pendingWrite),
+	}
+}
+
+// must be called with lk held
+func (l *LevelDB) finish(w *LevelDBWrite) {
+	w.done = true
+	w.snap.Release()
+	l.active.release(w.ts)
+	l.locks.unlock(w.locked)
+	w.locked = nil
+
+	// nobody can conflict with a commit older than the oldest open transaction
+	horizon := l.active.horizon(l.ts)
+	for key, ts := range l.commits {
+		if ts <= horizon {
+			delete(l.commits, key)
+		}
+	}
+}
+
+type LevelDBRead struct {
+	l      *LevelDB
+	snap   *leveldb.Snapshot
+	ts     uint64
+	err    error
+	closed bool
+}
+
+func (r *LevelDBRead) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	v, err := r.snap.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+func (r *LevelDBRead) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	ret := make(map[string][]byte)
+	for _, key := range keys {
+		v, err := r.snap.Get(key, nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret[string(key)] = v
+	}
+	return ret, nil
+}
+
+func (r *LevelDBRead) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	reverse, keysOnly := iterOptions(opts)
+
+	return func(yield func(KeyAndValue, error) bool) {
+		if r.err != nil {
+			yield(KeyAndValue{}, r.err)
+			return
+		}
+
+		rng := &util.Range{Start: start}
+		if len(end) > 0 {
+			rng.Limit = end
+		}
+
+		it := r.snap.NewIterator(rng, nil)
+		defer it.Release()
+
+		step, ok := it.Next, it.First()
+		if reverse {
+			step, ok = it.Prev, it.Last()
+		}
+
+		for ; ok; ok = step() {
+			kv := KeyAndValue{K: bytes.Clone(it.Key())}
+			if !keysOnly {
+				kv.V = bytes.Clone(it.Value())
+			}
+			if !yield(kv, nil) {
+				return
+			}
+		}
+		if err := it.Error(); err != nil {
+			yield(KeyAndValue{}, err)
+		}
+	}
+}
+
+func (r *LevelDBRead) Close() {
+	if r.err != nil {
+		return
+	}
+
+	r.l.lk.Lock()
+	defer r.l.lk.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.snap.Release()
+	r.l.active.release(r.ts)
+}
+
+type LevelDBWrite struct {
+	LevelDBRead
+
+	pending map[string]pendingWrite
+	locked  []string
+
+	done     bool
+	commited bool
+
+	statLockRetries int
+}
+
+func (w *LevelDBWrite) Stat() (statLockRetries int) {
+	return w.statLockRetries
+}
+
+func (w *LevelDBWrite) Put(key []byte, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return errTxnClosed
+	}
+	w.pending[string(key)] = pendingWrite{val: bytes.Clone(value)}
+	return nil
+}
+
+func (w *LevelDBWrite) Del(key []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return errTxnClosed
+	}
+	w.pending[string(key)] = pendingWrite{del: true}
+	return nil
+}
+
+func (w *LevelDBWrite) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if p, ok := w.pending[string(key)]; ok {
+		if p.del {
+			return nil, ErrNotFound
+		}
+		return bytes.Clone(p.val), nil
+	}
+	return w.LevelDBRead.Get(ctx, key)
+}
+
+func (w *LevelDBWrite) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	ret := make(map[string][]byte)
+	for _, key := range keys {
+		v, err := w.Get(ctx, key)
+		if IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret[string(key)] = v
+	}
+	return ret, nil
+}
+
+func (w *LevelDBWrite) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	return mergePending(w.pending, start, end, w.LevelDBRead.Iter(ctx, start, end, opts...), opts...)
+}
+
+func (w *LevelDBWrite) Commit(ctx context.Context) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.commited {
+		return fmt.Errorf("already commited")
+	}
+	if w.done {
+		return errTxnClosed
+	}
+
+	l := w.l
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	batch := new(leveldb.Batch)
+	for key, p := range w.pending {
+		if l.locks.lockedByOther(w, key) {
+			w.err = fmt.Errorf("%w: key %q is locked", ErrWriteConflict, key)
+			break
+		}
+		if l.commits[key] > w.ts {
+			w.err = fmt.Errorf("%w: key %q changed after transaction start", ErrWriteConflict, key)
+			break
+		}
+		if p.del {
+			batch.Delete([]byte(key))
+		} else {
+			batch.Put([]byte(key), p.val)
+		}
+	}
+
+	if w.err == nil {
+		w.err = l.db.Write(batch, &opt.WriteOptions{Sync: true})
+	}
+
+	if w.err != nil {
+		l.finish(w)
+		return w.err
+	}
+
+	l.ts++
+	for key := range w.pending {
+		l.commits[key] = l.ts
+	}
+
+	w.commited = true
+	l.finish(w)
+
+	return nil
+}
+
+func (w *LevelDBWrite) Rollback() error {
+	if w.commited {
+		return fmt.Errorf("already commited")
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return nil
+	}
+
+	w.l.lk.Lock()
+	defer w.l.lk.Unlock()
+
+	w.pending = make(map[string]pendingWrite)
+	w.l.finish(w)
+	return nil
+}
+
+func (w *LevelDBWrite) Close() {
+	w.Rollback()
+}
@@ -0,0 +1,136 @@
+package kv
+
+import (
+	"context"
+)
+
+// TxnLimits bounds what a single transaction may write
+type TxnLimits struct {
+	// number of distinct keys put or deleted
+	MaxKeys int
+	// size of all keys and values put or deleted
+	MaxBytes int
+	// size of a single key and its value
+	MaxEntryBytes int
+}
+
+// DefaultTxnLimits leaves headroom below what tikv accepts with its default configuration,
+// which is 100MB per transaction and 6MB per entry
+var DefaultTxnLimits = TxnLimits{
+	MaxKeys:       256 * 1024,
+	MaxBytes:      64 << 20,
+	MaxEntryBytes: 6 << 20,
+}
+
+// TxnSize is implemented by writes that track their pending size
+type TxnSize interface {
+	TxnSize() (keys int, bytes int)
+}
+
+// WithTxnLimits returns a KV whose writes fail with a TxnTooLargeError
+// as soon as they grow past limits, instead of somewhere in the backend's commit
+func WithTxnLimits(k KV, limits TxnLimits) KV {
+	return &limitedKV{KV: k, limits: limits}
+}
+
+type limitedKV struct {
+	KV
+	limits TxnLimits
+}
+
+func (l *limitedKV) Write() Write {
+	return newLimitedWrite(l.KV.Write(), l.limits)
+}
+
+func (l *limitedKV) ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error) {
+	w, err := l.KV.ExclusiveWrite(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return newLimitedWrite(w, l.limits), nil
+}
+
+// DeleteRange is not a transaction, so it is not limited
+func (l *limitedKV) DeleteRange(ctx context.Context, start []byte, end []byte) error {
+	return DeleteRange(ctx, l.KV, start, end)
+}
+
+type limitedWrite struct {
+	Write
+	limits TxnLimits
+
+	// size of every pending key, so writing a key twice counts once
+	sizes map[string]int
+	bytes int
+
+	// once the limit is exceeded, the transaction can only be rolled back
+	err error
+}
+
+func newLimitedWrite(w Write, limits TxnLimits) *limitedWrite {
+	return &limitedWrite{
+		Write:  w,
+		limits: limits,
+		sizes:  make(map[string]int),
+	}
+}
+
+func (w *limitedWrite) track(key []byte, size int) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.limits.MaxEntryBytes > 0 && size > w.limits.MaxEntryBytes {
+		w.err = &TxnTooLargeError{Keys: len(w.sizes), Bytes: w.bytes, Entry: size, Limits: w.limits}
+		return w.err
+	}
+
+	keys := len(w.sizes)
+	bytes := w.bytes - w.sizes[string(key)] + size
+	if _, ok := w.sizes[string(key)]; !ok {
+		keys++
+	}
+
+	if (w.limits.MaxKeys > 0 && keys > w.limits.MaxKeys) || (w.limits.MaxBytes > 0 && bytes > w.limits.MaxBytes) {
+		w.err = &TxnTooLargeError{Keys: keys, Bytes: bytes, Limits: w.limits}
+		return w.err
+	}
+
+	w.sizes[string(key)] = size
+	w.bytes = bytes
+	return nil
+}
+
+func (w *limitedWrite) Put(key []byte, value []byte) error {
+	if err := w.track(key, len(key)+len(value)); err != nil {
+		return err
+	}
+	return w.Write.Put(key, value)
+}
+
+func (w *limitedWrite) Del(key []byte) error {
+	if err := w.track(key, len(key)); err != nil {
+		return err
+	}
+	return w.Write.Del(key)
+}
+
+// Commit refuses a transaction that went past the limits,
+// because callers do not always check the errors of Put and Del
+func (w *limitedWrite) Commit(ctx context.Context) error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.Write.Commit(ctx)
+}
+
+func (w *limitedWrite) TxnSize() (int, int) {
+	return len(w.sizes), w.bytes
+}
+
+func (w *limitedWrite) Stat() int {
+	if st, ok := w.Write.(LockStat); ok {
+		return st.Stat()
+	}
+	return 0
+}
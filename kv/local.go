@@ -0,0 +1,161 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+	"sort"
+)
+
+// bookkeeping shared by the backends that run inside the apogy process (memory and leveldb).
+// these only coordinate transactions of a single process, which is all they need,
+// because nothing else can open their storage while we hold it.
+//
+// none of the types here lock by themselves. the backend calls them with its own lock held.
+
+var errTxnClosed = errors.New("transaction is closed")
+
+type pendingWrite struct {
+	val []byte
+	del bool
+}
+
+// mergePending overlays the uncommited writes of a transaction onto an iterator over its snapshot.
+// the snapshot iterator must already walk in the order given by opts
+func mergePending(pending map[string]pendingWrite, start []byte, end []byte, snapshot iter.Seq2[KeyAndValue, error], opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	reverse, keysOnly := iterOptions(opts)
+
+	// before reports if a comes before b in iteration order
+	before := func(a, b string) bool {
+		if reverse {
+			return a > b
+		}
+		return a < b
+	}
+
+	return func(yield func(KeyAndValue, error) bool) {
+
+		var local []string
+		for key := range pending {
+			if key >= string(start) && (len(end) == 0 || key < string(end)) {
+				local = append(local, key)
+			}
+		}
+		sort.Slice(local, func(i, j int) bool {
+			return before(local[i], local[j])
+		})
+
+		next, stop := iter.Pull2(snapshot)
+		defer stop()
+
+		kv, err, ok := next()
+		for ok || len(local) > 0 {
+			if err != nil {
+				yield(KeyAndValue{}, err)
+				return
+			}
+
+			if len(local) > 0 && (!ok || !before(string(kv.K), local[0])) {
+				key := local[0]
+				local = local[1:]
+
+				// shadowed by our own write
+				if ok && key == string(kv.K) {
+					kv, err, ok = next()
+				}
+
+				p := pending[key]
+				if p.del {
+					continue
+				}
+				var val []byte
+				if !keysOnly {
+					val = bytes.Clone(p.val)
+				}
+				if !yield(KeyAndValue{K: []byte(key), V: val}, nil) {
+					return
+				}
+				continue
+			}
+
+			if !yield(kv, nil) {
+				return
+			}
+			kv, err, ok = next()
+		}
+	}
+}
+
+// lockTable holds the keys locked by ExclusiveWrite
+type lockTable struct {
+	owners map[string]any
+	// closed and replaced every time locks are released
+	unlocked chan struct{}
+}
+
+func newLockTable() lockTable {
+	return lockTable{
+		owners:   make(map[string]any),
+		unlocked: make(chan struct{}),
+	}
+}
+
+// tryLock locks all keys for owner, or none of them if any is already taken
+func (l *lockTable) tryLock(owner any, keys [][]byte) ([]string, bool) {
+	for _, key := range keys {
+		if _, ok := l.owners[string(key)]; ok {
+			return nil, false
+		}
+	}
+	var locked []string
+	for _, key := range keys {
+		if _, ok := l.owners[string(key)]; ok {
+			continue
+		}
+		l.owners[string(key)] = owner
+		locked = append(locked, string(key))
+	}
+	return locked, true
+}
+
+// lockedByOther reports if key is locked by anyone but owner
+func (l *lockTable) lockedByOther(owner any, key string) bool {
+	o, ok := l.owners[key]
+	return ok && o != owner
+}
+
+func (l *lockTable) unlock(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	for _, key := range keys {
+		delete(l.owners, key)
+	}
+	close(l.unlocked)
+	l.unlocked = make(chan struct{})
+}
+
+// snapshotSet counts the open snapshots and transactions by their start timestamp
+type snapshotSet map[uint64]int
+
+func (s snapshotSet) add(ts uint64) {
+	s[ts]++
+}
+
+func (s snapshotSet) release(ts uint64) {
+	s[ts]--
+	if s[ts] <= 0 {
+		delete(s, ts)
+	}
+}
+
+// horizon is the oldest timestamp anyone can still read at
+func (s snapshotSet) horizon(current uint64) uint64 {
+	h := current
+	for ts := range s {
+		if ts < h {
+			h = ts
+		}
+	}
+	return h
+}
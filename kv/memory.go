@@ -0,0 +1,495 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"iter"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// how many keys an iterator copies out of the tree per lock acquisition
+const memoryChunkSize = 64
+
+// how far back ReadAt can look. same as the default tikv gc life time
+const memoryHistory = 10 * time.Minute
+
+// Memory is an in-process KV for tests and local development.
+//
+// every committed version of a key is kept as long as an open snapshot can still see it,
+// or for memoryHistory after it was overwritten,
+// so reads are isolated the same way tikv snapshots are.
+// writes are optimistic: a commit fails with ErrWriteConflict if any key it writes
+// was committed by someone else after the transaction started.
+type Memory struct {
+	lk   sync.Mutex
+	tree *btree.BTreeG[*memoryItem]
+
+	// timestamp of the last commit
+	ts uint64
+	// when the commits of the last memoryHistory happened, oldest first
+	history []memoryCommit
+
+	locks  lockTable
+	active snapshotSet
+}
+
+type memoryCommit struct {
+	ts uint64
+	at time.Time
+}
+
+type memoryVersion struct {
+	ts  uint64
+	val []byte
+	del bool
+}
+
+type memoryItem struct {
+	key []byte
+	// oldest first
+	versions []memoryVersion
+}
+
+func memoryLess(a, b *memoryItem) bool {
+	return bytes.Compare(a.key, b.key) < 0
+}
+
+// at returns the value visible to a snapshot taken at ts
+func (it *memoryItem) at(ts uint64) ([]byte, bool) {
+	for i := len(it.versions) - 1; i >= 0; i-- {
+		v := it.versions[i]
+		if v.ts > ts {
+			continue
+		}
+		if v.del {
+			return nil, false
+		}
+		return v.val, true
+	}
+	return nil, false
+}
+
+func (it *memoryItem) latest() uint64 {
+	if len(it.versions) == 0 {
+		return 0
+	}
+	return it.versions[len(it.versions)-1].ts
+}
+
+func NewMemory() (KV, error) {
+	return &Memory{
+		tree:   btree.NewG(32, memoryLess),
+		locks:  newLockTable(),
+		active: make(snapshotSet),
+	}, nil
+}
+
+func (m *Memory) Close() {
+}
+
+func (m *Memory) Ping() error {
+	return nil
+}
+
+func (m *Memory) Read() Read {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.active.add(m.ts)
+	return &MemoryRead{m: m, ts: m.ts}
+}
+
+func (m *Memory) ReadAt(at time.Time) Read {
+	if time.Since(at) > memoryHistory {
+		return &MemoryRead{err: fmt.Errorf("%w: memory backend only keeps %s of history", ErrHistoryUnavailable, memoryHistory)}
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	// the snapshot right before the first commit after at
+	ts := m.ts
+	i := sort.Search(len(m.history), func(i int) bool {
+		return m.history[i].at.After(at)
+	})
+	if i < len(m.history) {
+		ts = m.history[i].ts - 1
+	}
+
+	m.active.add(ts)
+	return &MemoryRead{m: m, ts: ts}
+}
+
+func (m *Memory) Write() Write {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.begin()
+}
+
+func (m *Memory) ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error) {
+
+	retries := 0
+	for {
+		retries += 1
+
+		m.lk.Lock()
+
+		// the transaction starts after the lock is taken,
+		// so it always sees the commit of the previous lock holder
+		w := m.begin()
+		if locked, ok := m.locks.tryLock(w, keys); ok {
+			w.locked = locked
+			w.statLockRetries = retries
+			m.lk.Unlock()
+			return w, nil
+		}
+		m.active.release(w.ts)
+
+		unlocked := m.locks.unlocked
+		m.lk.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-unlocked:
+		}
+	}
+}
+
+// must be called with lk held
+func (m *Memory) begin() *MemoryWrite {
+	m.active.add(m.ts)
+	return &MemoryWrite{
+		m:       m,
+		ts:      m.ts,
+		pending: make(map[string]pendingWrite),
+	}
+}
+
+// must be called with lk held
+func (m *Memory) finish(w *MemoryWrite) {
+	m.active.release(w.ts)
+	m.locks.unlock(w.locked)
+	w.locked = nil
+
+	// forget commits that ReadAt can no longer ask for
+	cutoff := time.Now().Add(-memoryHistory)
+	forget := 0
+	for forget < len(m.history) && !m.history[forget].at.After(cutoff) {
+		forget++
+	}
+	m.history = m.history[forget:]
+
+	// drop versions of the touched keys that no open snapshot can see anymore
+	horizon := m.active.horizon(m.ts)
+	if len(m.history) > 0 && m.history[0].ts-1 < horizon {
+		horizon = m.history[0].ts - 1
+	}
+	for key := range w.pending {
+		it, ok := m.tree.Get(&memoryItem{key: []byte(key)})
+		if !ok {
+			continue
+		}
+		keep := 0
+		for i, v := range it.versions {
+			if v.ts <= horizon {
+				keep = i
+			}
+		}
+		it.versions = it.versions[keep:]
+		if len(it.versions) == 1 && it.versions[0].del && it.versions[0].ts <= horizon {
+			m.tree.Delete(it)
+		}
+	}
+}
+
+func (m *Memory) get(ts uint64, key []byte) ([]byte, bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	it, ok := m.tree.Get(&memoryItem{key: key})
+	if !ok {
+		return nil, false
+	}
+	v, ok := it.at(ts)
+	return bytes.Clone(v), ok
+}
+
+func (m *Memory) chunk(ts uint64, start []byte, end []byte, reverse bool, keysOnly bool) []KeyAndValue {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var r []KeyAndValue
+	visit := func(it *memoryItem) bool {
+		if reverse && bytes.Compare(it.key, start) < 0 {
+			return false
+		}
+		if len(end) > 0 && bytes.Compare(it.key, end) >= 0 {
+			// going backwards we start at end itself, which is not part of the range
+			return reverse
+		}
+		if v, ok := it.at(ts); ok {
+			kv := KeyAndValue{K: bytes.Clone(it.key)}
+			if !keysOnly {
+				kv.V = bytes.Clone(v)
+			}
+			r = append(r, kv)
+		}
+		return len(r) < memoryChunkSize
+	}
+
+	if !reverse {
+		m.tree.AscendGreaterOrEqual(&memoryItem{key: start}, visit)
+	} else if len(end) == 0 {
+		m.tree.Descend(visit)
+	} else {
+		m.tree.DescendLessOrEqual(&memoryItem{key: end}, visit)
+	}
+	return r
+}
+
+// scan iterates over the snapshot at ts without holding the lock while yielding,
+// so the caller may commit from inside the loop
+func (m *Memory) scan(ctx context.Context, ts uint64, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	reverse, keysOnly := iterOptions(opts)
+
+	return func(yield func(KeyAndValue, error) bool) {
+		start, end := start, end
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(KeyAndValue{}, err)
+				return
+			}
+
+			chunk := m.chunk(ts, start, end, reverse, keysOnly)
+			for _, kv := range chunk {
+				if !yield(kv, nil) {
+					return
+				}
+			}
+			if len(chunk) < memoryChunkSize {
+				return
+			}
+
+			last := chunk[len(chunk)-1].K
+			if reverse {
+				end = last
+			} else {
+				start = append(bytes.Clone(last), 0)
+			}
+		}
+	}
+}
+
+type MemoryRead struct {
+	m      *Memory
+	ts     uint64
+	err    error
+	closed bool
+}
+
+func (r *MemoryRead) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	v, ok := r.m.get(r.ts, key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (r *MemoryRead) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	ret := make(map[string][]byte)
+	for _, key := range keys {
+		if v, ok := r.m.get(r.ts, key); ok {
+			ret[string(key)] = v
+		}
+	}
+	return ret, nil
+}
+
+func (r *MemoryRead) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	if r.err != nil {
+		return func(yield func(KeyAndValue, error) bool) {
+			yield(KeyAndValue{}, r.err)
+		}
+	}
+	return r.m.scan(ctx, r.ts, start, end, opts...)
+}
+
+func (r *MemoryRead) Close() {
+	if r.err != nil {
+		return
+	}
+
+	r.m.lk.Lock()
+	defer r.m.lk.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.m.active.release(r.ts)
+}
+
+type MemoryWrite struct {
+	m       *Memory
+	ts      uint64
+	pending map[string]pendingWrite
+	locked  []string
+
+	err      error
+	done     bool
+	commited bool
+
+	statLockRetries int
+}
+
+func (w *MemoryWrite) Stat() (statLockRetries int) {
+	return w.statLockRetries
+}
+
+func (w *MemoryWrite) Put(key []byte, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return errTxnClosed
+	}
+	w.pending[string(key)] = pendingWrite{val: bytes.Clone(value)}
+	return nil
+}
+
+func (w *MemoryWrite) Del(key []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return errTxnClosed
+	}
+	w.pending[string(key)] = pendingWrite{del: true}
+	return nil
+}
+
+func (w *MemoryWrite) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if p, ok := w.pending[string(key)]; ok {
+		if p.del {
+			return nil, ErrNotFound
+		}
+		return bytes.Clone(p.val), nil
+	}
+	v, ok := w.m.get(w.ts, key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (w *MemoryWrite) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	ret := make(map[string][]byte)
+	for _, key := range keys {
+		if v, err := w.Get(ctx, key); err == nil {
+			ret[string(key)] = v
+		}
+	}
+	return ret, nil
+}
+
+func (w *MemoryWrite) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	if w.err != nil {
+		return func(yield func(KeyAndValue, error) bool) {
+			yield(KeyAndValue{}, w.err)
+		}
+	}
+	return mergePending(w.pending, start, end, w.m.scan(ctx, w.ts, start, end, opts...), opts...)
+}
+
+func (w *MemoryWrite) Commit(ctx context.Context) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.commited {
+		return fmt.Errorf("already commited")
+	}
+	if w.done {
+		return errTxnClosed
+	}
+
+	m := w.m
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for key := range w.pending {
+		if m.locks.lockedByOther(w, key) {
+			w.err = fmt.Errorf("%w: key %q is locked", ErrWriteConflict, key)
+			break
+		}
+		if it, ok := m.tree.Get(&memoryItem{key: []byte(key)}); ok && it.latest() > w.ts {
+			w.err = fmt.Errorf("%w: key %q changed after transaction start", ErrWriteConflict, key)
+			break
+		}
+	}
+
+	if w.err != nil {
+		w.done = true
+		m.finish(w)
+		return w.err
+	}
+
+	m.ts++
+	for key, p := range w.pending {
+		it, ok := m.tree.Get(&memoryItem{key: []byte(key)})
+		if !ok {
+			it = &memoryItem{key: []byte(key)}
+			m.tree.ReplaceOrInsert(it)
+		}
+		it.versions = append(it.versions, memoryVersion{ts: m.ts, val: p.val, del: p.del})
+	}
+	m.history = append(m.history, memoryCommit{ts: m.ts, at: time.Now()})
+
+	w.done = true
+	w.commited = true
+	m.finish(w)
+
+	return nil
+}
+
+func (w *MemoryWrite) Rollback() error {
+	if w.commited {
+		return fmt.Errorf("already commited")
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return nil
+	}
+
+	w.m.lk.Lock()
+	defer w.m.lk.Unlock()
+
+	w.done = true
+	w.pending = make(map[string]pendingWrite)
+	w.m.finish(w)
+	return nil
+}
+
+func (w *MemoryWrite) Close() {
+	w.Rollback()
+}
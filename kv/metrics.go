@@ -0,0 +1,243 @@
+package kv
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are the prometheus metrics recorded by WithMetrics.
+// the prefix label is the kind of key: o (documents), f (index), unique, c and c_unique (composite index),
+// s (full text), e and x (expiry) or other
+type Metrics struct {
+	opDuration *prometheus.HistogramVec
+	opKeys     *prometheus.HistogramVec
+	writes     *prometheus.CounterVec
+	txnWrites  *prometheus.HistogramVec
+	txnBytes   *prometheus.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		opDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kv_op_duration_seconds",
+				Help:    "Duration of KV reads. for iter it includes the time the caller spends on each key",
+				Buckets: []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 0.2, 0.5, 1, 1.5, 2},
+			},
+			[]string{"operation", "prefix"},
+		),
+		opKeys: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kv_op_keys",
+				Help:    "Number of keys requested by a batch get or scanned by an iteration",
+				Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+			},
+			[]string{"operation", "prefix"},
+		),
+		writes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kv_writes_total",
+				Help: "Total number of KV puts and deletes",
+			},
+			[]string{"operation", "prefix"},
+		),
+		txnWrites: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kv_txn_writes",
+				Help:    "Number of puts and deletes of a transaction, at commit",
+				Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+			},
+			[]string{"operation"},
+		),
+		txnBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kv_txn_bytes",
+				Help:    "Size of the keys and values written by a transaction, at commit",
+				Buckets: prometheus.ExponentialBuckets(64, 4, 12),
+			},
+			[]string{"status"},
+		),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.opDuration.Describe(ch)
+	m.opKeys.Describe(ch)
+	m.writes.Describe(ch)
+	m.txnWrites.Describe(ch)
+	m.txnBytes.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.opDuration.Collect(ch)
+	m.opKeys.Collect(ch)
+	m.writes.Collect(ch)
+	m.txnWrites.Collect(ch)
+	m.txnBytes.Collect(ch)
+}
+
+// keyPrefix is the prefix label of a key
+func keyPrefix(k []byte) string {
+	if len(k) < 2 || k[1] != 0xff {
+		return "other"
+	}
+	unique := len(k) > 2 && k[len(k)-1] == 0xff && k[len(k)-2] == 0xff
+	switch k[0] {
+	case 'f':
+		if unique {
+			return "unique"
+		}
+		return "f"
+	case 'c':
+		if unique {
+			return "c_unique"
+		}
+		return "c"
+	case 'o', 's', 'e', 'x':
+		return string(k[0])
+	}
+	return "other"
+}
+
+// WithMetrics returns a KV that records every operation into m
+func WithMetrics(k KV, m *Metrics) KV {
+	return &metricsKV{KV: k, m: m}
+}
+
+type metricsKV struct {
+	KV
+	m *Metrics
+}
+
+type metricsRead struct {
+	r Read
+	m *Metrics
+}
+
+type metricsWrite struct {
+	metricsRead
+	w Write
+
+	puts  int
+	dels  int
+	bytes int
+}
+
+func (k *metricsKV) Read() Read {
+	return &metricsRead{r: k.KV.Read(), m: k.m}
+}
+
+func (k *metricsKV) ReadAt(at time.Time) Read {
+	return &metricsRead{r: k.KV.ReadAt(at), m: k.m}
+}
+
+func (k *metricsKV) Write() Write {
+	w := k.KV.Write()
+	return &metricsWrite{metricsRead: metricsRead{r: w, m: k.m}, w: w}
+}
+
+func (k *metricsKV) ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error) {
+	w, err := k.KV.ExclusiveWrite(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsWrite{metricsRead: metricsRead{r: w, m: k.m}, w: w}, nil
+}
+
+func (k *metricsKV) DeleteRange(ctx context.Context, start []byte, end []byte) error {
+	return DeleteRange(ctx, k.KV, start, end)
+}
+
+func (r *metricsRead) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	prefix := "other"
+	if len(keys) > 0 {
+		prefix = keyPrefix(keys[0])
+	}
+	start := time.Now()
+	ret, err := r.r.BatchGet(ctx, keys)
+	r.m.opDuration.WithLabelValues("batch_get", prefix).Observe(time.Since(start).Seconds())
+	r.m.opKeys.WithLabelValues("batch_get", prefix).Observe(float64(len(keys)))
+	return ret, err
+}
+
+func (r *metricsRead) Get(ctx context.Context, key []byte) ([]byte, error) {
+	start := time.Now()
+	ret, err := r.r.Get(ctx, key)
+	r.m.opDuration.WithLabelValues("get", keyPrefix(key)).Observe(time.Since(start).Seconds())
+	return ret, err
+}
+
+func (r *metricsRead) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	return func(yield func(KeyAndValue, error) bool) {
+		prefix := keyPrefix(start)
+		began := time.Now()
+		n := 0
+		defer func() {
+			r.m.opDuration.WithLabelValues("iter", prefix).Observe(time.Since(began).Seconds())
+			r.m.opKeys.WithLabelValues("iter", prefix).Observe(float64(n))
+		}()
+		for kv, err := range r.r.Iter(ctx, start, end, opts...) {
+			if err == nil {
+				n++
+			}
+			if !yield(kv, err) {
+				return
+			}
+		}
+	}
+}
+
+func (r *metricsRead) Close() {
+	r.r.Close()
+}
+
+func (w *metricsWrite) Put(key []byte, value []byte) error {
+	w.puts++
+	w.bytes += len(key) + len(value)
+	w.m.writes.WithLabelValues("put", keyPrefix(key)).Inc()
+	return w.w.Put(key, value)
+}
+
+func (w *metricsWrite) Del(key []byte) error {
+	w.dels++
+	w.bytes += len(key)
+	w.m.writes.WithLabelValues("del", keyPrefix(key)).Inc()
+	return w.w.Del(key)
+}
+
+func (w *metricsWrite) Commit(ctx context.Context) error {
+	err := w.w.Commit(ctx)
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	w.m.txnWrites.WithLabelValues("put").Observe(float64(w.puts))
+	w.m.txnWrites.WithLabelValues("del").Observe(float64(w.dels))
+	w.m.txnBytes.WithLabelValues(status).Observe(float64(w.bytes))
+	return err
+}
+
+func (w *metricsWrite) Rollback() error {
+	return w.w.Rollback()
+}
+
+func (w *metricsWrite) Close() {
+	w.w.Close()
+}
+
+func (w *metricsWrite) Stat() int {
+	if st, ok := w.w.(LockStat); ok {
+		return st.Stat()
+	}
+	return 0
+}
+
+func (w *metricsWrite) TxnSize() (int, int) {
+	if st, ok := w.w.(TxnSize); ok {
+		return st.TxnSize()
+	}
+	return 0, 0
+}
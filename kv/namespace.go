@@ -0,0 +1,214 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"iter"
+	"time"
+)
+
+// namespaces keep several databases apart in one keyspace. every key of a namespace is stored as
+//
+//	n 0xff namespace 0xff key
+//
+// the database without a namespace stays at the root, as it always was.
+
+var ErrInvalidNamespace = errors.New("namespace must not be empty or contain 0xff")
+
+func namespacePrefix(namespace string) ([]byte, error) {
+	if namespace == "" || bytes.IndexByte([]byte(namespace), 0xff) >= 0 {
+		return nil, ErrInvalidNamespace
+	}
+	return []byte("n\xff" + namespace + "\xff"), nil
+}
+
+// PrefixEnd returns the first key after all keys that start with prefix
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// WithNamespace returns a KV that only sees the keys of the given namespace
+func WithNamespace(k KV, namespace string) (KV, error) {
+	prefix, err := namespacePrefix(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceKV{KV: k, prefix: prefix}, nil
+}
+
+type namespaceKV struct {
+	KV
+	prefix []byte
+}
+
+type namespaceRead struct {
+	r      Read
+	prefix []byte
+}
+
+type namespaceWrite struct {
+	namespaceRead
+	w Write
+}
+
+func (n *namespaceKV) key(k []byte) []byte {
+	return append(bytes.Clone(n.prefix), k...)
+}
+
+func (n *namespaceKV) Read() Read {
+	return &namespaceRead{r: n.KV.Read(), prefix: n.prefix}
+}
+
+func (n *namespaceKV) ReadAt(at time.Time) Read {
+	return &namespaceRead{r: n.KV.ReadAt(at), prefix: n.prefix}
+}
+
+func (n *namespaceKV) Write() Write {
+	w := n.KV.Write()
+	return &namespaceWrite{namespaceRead: namespaceRead{r: w, prefix: n.prefix}, w: w}
+}
+
+func (n *namespaceKV) ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error) {
+	prefixed := make([][]byte, len(keys))
+	for i, k := range keys {
+		prefixed[i] = n.key(k)
+	}
+	w, err := n.KV.ExclusiveWrite(ctx, prefixed...)
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceWrite{namespaceRead: namespaceRead{r: w, prefix: n.prefix}, w: w}, nil
+}
+
+// DeleteRange deletes within the namespace
+func (n *namespaceKV) DeleteRange(ctx context.Context, start []byte, end []byte) error {
+	if len(end) == 0 {
+		return DeleteRange(ctx, n.KV, n.key(start), PrefixEnd(n.prefix))
+	}
+	return DeleteRange(ctx, n.KV, n.key(start), n.key(end))
+}
+
+func (r *namespaceRead) key(k []byte) []byte {
+	return append(bytes.Clone(r.prefix), k...)
+}
+
+func (r *namespaceRead) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	prefixed := make([][]byte, len(keys))
+	for i, k := range keys {
+		prefixed[i] = r.key(k)
+	}
+	vals, err := r.r.BatchGet(ctx, prefixed)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte, len(vals))
+	for k, v := range vals {
+		ret[k[len(r.prefix):]] = v
+	}
+	return ret, nil
+}
+
+func (r *namespaceRead) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return r.r.Get(ctx, r.key(key))
+}
+
+func (r *namespaceRead) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	pend := PrefixEnd(r.prefix)
+	if len(end) > 0 {
+		pend = r.key(end)
+	}
+	return func(yield func(KeyAndValue, error) bool) {
+		for kv, err := range r.r.Iter(ctx, r.key(start), pend, opts...) {
+			if err != nil {
+				yield(kv, err)
+				return
+			}
+			kv.K = kv.K[len(r.prefix):]
+			if !yield(kv, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (r *namespaceRead) Close() {
+	r.r.Close()
+}
+
+func (w *namespaceWrite) Put(key []byte, value []byte) error {
+	return w.w.Put(w.key(key), value)
+}
+
+func (w *namespaceWrite) Del(key []byte) error {
+	return w.w.Del(w.key(key))
+}
+
+func (w *namespaceWrite) Commit(ctx context.Context) error {
+	return w.w.Commit(ctx)
+}
+
+func (w *namespaceWrite) Rollback() error {
+	return w.w.Rollback()
+}
+
+func (w *namespaceWrite) Close() {
+	w.w.Close()
+}
+
+func (w *namespaceWrite) Stat() int {
+	if st, ok := w.w.(LockStat); ok {
+		return st.Stat()
+	}
+	return 0
+}
+
+func (w *namespaceWrite) TxnSize() (int, int) {
+	if st, ok := w.w.(TxnSize); ok {
+		return st.TxnSize()
+	}
+	return 0, 0
+}
+
+// Namespaces lists the namespaces that have at least one key
+func Namespaces(ctx context.Context, k KV) ([]string, error) {
+	r := k.Read()
+	defer r.Close()
+
+	var ret []string
+	start := []byte("n\xff")
+	end := PrefixEnd(start)
+	for {
+		var found []byte
+		for kv, err := range r.Iter(ctx, start, end, KeysOnly) {
+			if err != nil {
+				return nil, err
+			}
+			found = kv.K
+			break
+		}
+		if found == nil {
+			return ret, nil
+		}
+		namespace, _, _ := bytes.Cut(found[2:], []byte{0xff})
+		ret = append(ret, string(namespace))
+		// skip the rest of this namespace
+		start = PrefixEnd([]byte("n\xff" + string(namespace) + "\xff"))
+	}
+}
+
+// DropNamespace deletes every key of a namespace
+func DropNamespace(ctx context.Context, k KV, namespace string) error {
+	prefix, err := namespacePrefix(namespace)
+	if err != nil {
+		return err
+	}
+	return DeleteRange(ctx, k, prefix, PrefixEnd(prefix))
+}
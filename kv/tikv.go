@@ -1,6 +1,7 @@
 package kv
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"github.com/lmittmann/tint"
 	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/oracle"
 	"github.com/tikv/client-go/v2/txnkv"
 	"github.com/tikv/client-go/v2/txnkv/txnsnapshot"
 
@@ -130,36 +132,22 @@ func (w *TikvWrite) Del(key []byte) error {
 	return err
 }
 
-func (r *TikvWrite) Iter(ctx context.Context, start []byte, end []byte) iter.Seq2[KeyAndValue, error] {
-	return func(yield func(KeyAndValue, error) bool) {
-
-		_, span := tracer.Start(ctx, "kv.TikvWrite.Iter")
-		defer span.End()
+func (r *TikvWrite) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	reverse, keysOnly := iterOptions(opts)
 
-		it, err := r.txn.Iter(start, end)
-		if err != nil {
-			log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "err", err)
-			yield(KeyAndValue{}, err)
-			return
+	if r.err != nil {
+		return func(yield func(KeyAndValue, error) bool) {
+			yield(KeyAndValue{}, r.err)
 		}
+	}
 
-		log.Debug("[tikv].Iter:", "start", string(start), "end", string(end))
-		for it.Valid() {
-
-			log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "at", string(it.Key()))
-			if !yield(KeyAndValue{K: it.Key(), V: it.Value()}, nil) {
-				return
-			}
-
-			err := it.Next()
-			if err != nil {
-				log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "err", err)
-				if !yield(KeyAndValue{}, err) {
-					return
-				}
-			}
+	// the transaction buffer can not skip values, so keysOnly just drops them
+	return tikvIter(ctx, "kv.TikvWrite.Iter", start, end, reverse, keysOnly, func() (tikvIterator, error) {
+		if reverse {
+			return r.txn.IterReverse(end)
 		}
-	}
+		return r.txn.Iter(start, end)
+	})
 }
 
 func (r *TikvWrite) Close() {
@@ -167,6 +155,8 @@ func (r *TikvWrite) Close() {
 }
 
 type TikvRead struct {
+	k   *txnkv.Client
+	ts  uint64
 	txn *txnsnapshot.KVSnapshot
 	err error
 }
@@ -191,37 +181,77 @@ func (r *TikvRead) Get(ctx context.Context, key []byte) ([]byte, error) {
 func (r *TikvRead) Close() {
 }
 
-func (r *TikvRead) SetKeyOnly(b bool) {
-	r.txn.SetKeyOnly(b)
+func (r *TikvRead) Iter(ctx context.Context, start []byte, end []byte, opts ...IterOption) iter.Seq2[KeyAndValue, error] {
+	reverse, keysOnly := iterOptions(opts)
+
+	if r.err != nil {
+		return func(yield func(KeyAndValue, error) bool) {
+			yield(KeyAndValue{}, r.err)
+		}
+	}
+
+	// key only is a setting of the whole snapshot, so use a separate one at the same ts
+	// instead of changing it under iterators that are still running
+	txn := r.txn
+	if keysOnly {
+		txn = r.k.GetSnapshot(r.ts)
+		txn.SetKeyOnly(true)
+	}
+
+	return tikvIter(ctx, "kv.TikvRead.Iter", start, end, reverse, keysOnly, func() (tikvIterator, error) {
+		if reverse {
+			return txn.IterReverse(end)
+		}
+		return txn.Iter(start, end)
+	})
+}
+
+// tikvIterator is what tikv snapshots and transactions return from Iter and IterReverse
+type tikvIterator interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next() error
+	Close()
 }
 
-func (r *TikvRead) Iter(ctx context.Context, start []byte, end []byte) iter.Seq2[KeyAndValue, error] {
+// tikvIter adapts a tikv iterator.
+// tikv has no lower bound for reverse iteration, so it stops at start here
+func tikvIter(ctx context.Context, name string, start []byte, end []byte, reverse bool, keysOnly bool, open func() (tikvIterator, error)) iter.Seq2[KeyAndValue, error] {
 	return func(yield func(KeyAndValue, error) bool) {
 
-		_, span := tracer.Start(ctx, "kv.TikvRead.Iter")
+		_, span := tracer.Start(ctx, name)
 		defer span.End()
 
-		it, err := r.txn.Iter(start, end)
+		it, err := open()
 		if err != nil {
 			log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "err", err)
 			yield(KeyAndValue{}, err)
 			return
 		}
+		defer it.Close()
 
-		log.Debug("[tikv].Iter:", "start", string(start), "end", string(end))
+		log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "reverse", reverse)
 		for it.Valid() {
 
+			if reverse && bytes.Compare(it.Key(), start) < 0 {
+				return
+			}
+
 			log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "at", string(it.Key()))
-			if !yield(KeyAndValue{K: it.Key(), V: it.Value()}, nil) {
+			kv := KeyAndValue{K: it.Key()}
+			if !keysOnly {
+				kv.V = it.Value()
+			}
+			if !yield(kv, nil) {
 				return
 			}
 
 			err := it.Next()
 			if err != nil {
 				log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "err", err)
-				if !yield(KeyAndValue{}, err) {
-					return
-				}
+				yield(KeyAndValue{}, err)
+				return
 			}
 		}
 	}
@@ -328,11 +358,29 @@ func (t *Tikv) ExclusiveWrite(ctx context.Context, keys ...[]byte) (Write, error
 func (t *Tikv) Read() Read {
 	ts, err := t.k.CurrentTimestamp("global")
 	if err != nil {
-		return &TikvRead{nil, err}
+		return &TikvRead{err: err}
+	}
+
+	return &TikvRead{k: t.k, ts: ts, txn: t.k.GetSnapshot(ts)}
+}
+
+func (t *Tikv) ReadAt(at time.Time) Read {
+	ts, err := t.k.CurrentTimestamp("global")
+	if err != nil {
+		return &TikvRead{err: err}
+	}
+
+	// never read at a timestamp pd has not handed out yet
+	if at.Before(oracle.GetTimeFromTS(ts)) {
+		ts = oracle.GoTimeToTS(at)
+	}
+
+	// versions older than the gc safe point may already be gone
+	if err := t.k.CheckVisibility(ts); err != nil {
+		return &TikvRead{err: fmt.Errorf("%w: %w", ErrHistoryUnavailable, err)}
 	}
 
-	txn := t.k.GetSnapshot(ts)
-	return &TikvRead{txn, nil}
+	return &TikvRead{k: t.k, ts: ts, txn: t.k.GetSnapshot(ts)}
 }
 
 func (t *Tikv) Ping() error {
@@ -340,6 +388,13 @@ func (t *Tikv) Ping() error {
 	return err
 }
 
+// DeleteRange removes the range from every region directly, including its history.
+// it does not conflict with transactions, so nothing should write to the range while it runs
+func (t *Tikv) DeleteRange(ctx context.Context, start []byte, end []byte) error {
+	_, err := t.k.DeleteRange(ctx, start, end, 4)
+	return err
+}
+
 func NewTikv() (KV, error) {
 	tikvep := os.Getenv("PD_ENDPOINT")
 	if tikvep == "" {
@@ -26,6 +26,9 @@ var mkmtlsCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(sr.CMD)
+	rootCmd.AddCommand(sr.BackupCMD)
+	rootCmd.AddCommand(sr.RestoreCMD)
+	rootCmd.AddCommand(sr.FsckCMD)
 	rootCmd.AddCommand(kv.CMD)
 	rootCmd.AddCommand(mkmtlsCmd)
 	cl.RegisterCommands(rootCmd)
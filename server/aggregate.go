@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+)
+
+// a search with aggregates returns a single group with the count of the matching documents
+// and one value for every aggregate, instead of the documents. count only needs the ids,
+// so it never loads a document, sum, min, max and avg do, in batches.
+//
+// with a groupBy, the value index of that path is scanned, which has the value of every entry in its key
+//
+//	f 0xff model 0xff val.status 0xff pending 0xff id 0xff
+//
+// so each run of entries with the same value is a group, in the order of the index. with filters,
+// the matching ids are collected first and the index scan only keeps those. a document without a value
+// is in no group, and one with an array is in the group of every element. strings of 128 bytes or more
+// have no entry in the value index, so a document with such a value is in no group either.
+//
+// the ids of filtered matches are kept in memory, to skip a document that the scan of an array finds twice,
+// and for the groups. that is limited to maxAggregateMatches, without filters nothing is kept.
+
+// how many documents are read at once while aggregating
+const aggregateBatchSize = 1000
+
+// how many documents the filters of an aggregate may match
+const maxAggregateMatches = 100000
+
+func tooManyMatches() error {
+	return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(
+		"the filters match more than %d documents, which is too many to aggregate", maxAggregateMatches))
+}
+
+type aggregator struct {
+	aggregates []openapi.Aggregate
+	count      int
+	sum        []float64
+	numbers    []int
+	best       []any
+	bestKey    [][]byte
+}
+
+func newAggregator(aggregates []openapi.Aggregate) *aggregator {
+	return &aggregator{
+		aggregates: aggregates,
+		sum:        make([]float64, len(aggregates)),
+		numbers:    make([]int, len(aggregates)),
+		best:       make([]any, len(aggregates)),
+		bestKey:    make([][]byte, len(aggregates)),
+	}
+}
+
+// needsDocuments tells if any of the aggregates looks at values, which count does not
+func (a *aggregator) needsDocuments() bool {
+	for _, ag := range a.aggregates {
+		if ag.Fn != "count" {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *aggregator) add(doc *openapi.Document) {
+	a.count++
+	for i, ag := range a.aggregates {
+		if ag.Fn == "count" {
+			continue
+		}
+		for _, vbin := range valuesAt(doc.Val, strings.Split(strings.TrimPrefix(*ag.Key, "val."), "."), sortValue) {
+			switch ag.Fn {
+			case "sum", "avg":
+				if n, ok := decodeSortValue(vbin).(json.Number); ok {
+					if f, err := n.Float64(); err == nil {
+						a.sum[i] += f
+						a.numbers[i]++
+					}
+				}
+			case "min":
+				if a.bestKey[i] == nil || bytes.Compare(vbin, a.bestKey[i]) < 0 {
+					a.bestKey[i], a.best[i] = vbin, decodeSortValue(vbin)
+				}
+			case "max":
+				if a.bestKey[i] == nil || bytes.Compare(vbin, a.bestKey[i]) > 0 {
+					a.bestKey[i], a.best[i] = vbin, decodeSortValue(vbin)
+				}
+			}
+		}
+	}
+}
+
+func (a *aggregator) group(key *interface{}) openapi.AggregateGroup {
+	values := make([]interface{}, len(a.aggregates))
+	for i, ag := range a.aggregates {
+		switch ag.Fn {
+		case "count":
+			values[i] = a.count
+		case "sum":
+			values[i] = a.sum[i]
+		case "avg":
+			if a.numbers[i] > 0 {
+				values[i] = a.sum[i] / float64(a.numbers[i])
+			}
+		case "min", "max":
+			values[i] = a.best[i]
+		}
+	}
+	return openapi.AggregateGroup{Key: key, Count: a.count, Values: values}
+}
+
+// decodeSortValue turns the encoding of sortValue back into a value
+func decodeSortValue(b []byte) any {
+	if v, ok := codec.DecodeIndexValue(b); ok {
+		return v
+	}
+	return string(b)
+}
+
+// splitIndexEntry splits what follows the path in a value index key into the value and the id.
+// the id of a unique entry is empty
+func splitIndexEntry(k []byte) ([]byte, string, bool) {
+	var value []byte
+	if len(k) > 0 && k[0] == codec.IndexTagNumber {
+		if len(k) < codec.IndexNumberLen {
+			return nil, "", false
+		}
+		value, k = k[:codec.IndexNumberLen], k[codec.IndexNumberLen:]
+	} else {
+		i := bytes.IndexByte(k, 0xff)
+		if i < 0 {
+			return nil, "", false
+		}
+		value, k = k[:i], k[i:]
+	}
+	if len(k) < 2 || k[0] != 0xff {
+		return nil, "", false
+	}
+	id, _, _ := bytes.Cut(k[1:], []byte{0xff})
+	return value, string(id), true
+}
+
+// addToAggregator adds a batch of matched documents to the aggregator, without the ones that expired
+func (s *server) addToAggregator(ctx context.Context, r kv.Read, a *aggregator, docs []openapi.Document, at time.Time) error {
+	docs, err := s.dropExpired(ctx, r, docs, at)
+	if err != nil {
+		return err
+	}
+	if a.needsDocuments() {
+		docs, err = s.resolveFullDocs(ctx, r, docs)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range docs {
+		a.add(&docs[i])
+	}
+	return nil
+}
+
+// eachMatch calls fn with every document the filters match, a batch at a time
+func (s *server) eachMatch(ctx context.Context, r kv.Read, model string, filters []openapi.Filter, fn func([]openapi.Document) error) error {
+	// a document with an array can be found again on the next page of an index scan
+	var seen map[string]bool
+	if len(filters) > 0 {
+		seen = make(map[string]bool)
+	}
+
+	var cursor *string
+	for {
+		docs, next, err := s.match(ctx, r, model, filters, aggregateBatchSize, cursor, false)
+		if err != nil {
+			return err
+		}
+		if seen != nil {
+			unseen := docs[:0]
+			for _, doc := range docs {
+				if !seen[doc.Id] {
+					seen[doc.Id] = true
+					unseen = append(unseen, doc)
+				}
+			}
+			if len(seen) > maxAggregateMatches {
+				return tooManyMatches()
+			}
+			docs = unseen
+		}
+		if err := fn(docs); err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (s *server) aggregate(ctx context.Context, r kv.Read, req openapi.SearchRequest, filters []openapi.Filter, at time.Time) (*openapi.SearchResponse, error) {
+	var aggregates []openapi.Aggregate
+	if req.Aggregates != nil {
+		aggregates = *req.Aggregates
+	}
+	for _, ag := range aggregates {
+		switch ag.Fn {
+		case "count":
+		case "sum", "min", "max", "avg":
+			if ag.Key == nil || !strings.HasPrefix(*ag.Key, "val.") {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s needs a key like val.n", ag.Fn))
+			}
+		default:
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown aggregate %q, expected count, sum, min, max or avg", ag.Fn))
+		}
+	}
+
+	if req.GroupBy == nil {
+		a := newAggregator(aggregates)
+		err := s.eachMatch(ctx, r, req.Model, filters, func(docs []openapi.Document) error {
+			return s.addToAggregator(ctx, r, a, docs, at)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &openapi.SearchResponse{Documents: []openapi.Document{}, Groups: &[]openapi.AggregateGroup{a.group(nil)}}, nil
+	}
+
+	var matched map[string]bool
+	if len(filters) > 0 {
+		matched = make(map[string]bool)
+		err := s.eachMatch(ctx, r, req.Model, filters, func(docs []openapi.Document) error {
+			for _, doc := range docs {
+				matched[doc.Id] = true
+			}
+			if len(matched) > maxAggregateMatches {
+				return tooManyMatches()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groups := []openapi.AggregateGroup{}
+	var value []byte
+	var a *aggregator
+	var batch []openapi.Document
+
+	flush := func() error {
+		if a == nil {
+			return nil
+		}
+		if err := s.addToAggregator(ctx, r, a, batch, at); err != nil {
+			return err
+		}
+		batch = nil
+		return nil
+	}
+	done := func() {
+		if a != nil && a.count > 0 {
+			key := decodeSortValue(value)
+			groups = append(groups, a.group(&key))
+		}
+	}
+
+	prefix := append(indexKey(req.Model, *req.GroupBy), 0xff)
+	for kv, err := range r.Iter(ctx, prefix, kv.PrefixEnd(prefix), kv.KeysOnly) {
+		if err != nil {
+			return nil, readError(err)
+		}
+		v, id, ok := splitIndexEntry(kv.K[len(prefix):])
+		if !ok || id == "" {
+			continue
+		}
+		if matched != nil && !matched[id] {
+			continue
+		}
+
+		if a == nil || !bytes.Equal(v, value) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			done()
+			a = newAggregator(aggregates)
+			value = bytes.Clone(v)
+		}
+
+		batch = append(batch, openapi.Document{Model: req.Model, Id: id})
+		if len(batch) >= aggregateBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	done()
+
+	return &openapi.SearchResponse{Documents: []openapi.Document{}, Groups: &groups}, nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchDocuments_Aggregate(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.Aggregate",
+		Val: map[string]interface{}{
+			"index": map[string]interface{}{"secret": "none"},
+		},
+	}))
+
+	books := map[string]map[string]interface{}{
+		"dune":       {"author": "Frank Herbert", "year": 1965, "pages": 412, "lang": "en"},
+		"messiah":    {"author": "Frank Herbert", "year": 1969, "pages": 256, "lang": "en"},
+		"children":   {"author": "Frank Herbert", "year": 1976, "pages": 444, "lang": "de"},
+		"foundation": {"author": "Isaac Asimov", "year": 1951, "pages": 255, "lang": "en"},
+		"talisman":   {"author": []interface{}{"Stephen King", "Peter Straub"}, "year": 1984, "lang": "en"},
+		"anonymous":  {"year": 2001, "pages": 10},
+	}
+	for id, val := range books {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Aggregate", Id: id, Val: val}))
+	}
+
+	aggregate := func(groupBy string, filters []openapi.Filter, aggregates ...openapi.Aggregate) ([]openapi.AggregateGroup, error) {
+		r := s.kv.Read()
+		defer r.Close()
+		req := openapi.SearchRequest{Model: "com.example.Aggregate", Aggregates: &aggregates}
+		if groupBy != "" {
+			req.GroupBy = &groupBy
+		}
+		if filters != nil {
+			req.Filters = &filters
+		}
+		res, err := s.query(context.Background(), r, req)
+		if err != nil {
+			return nil, err
+		}
+		assert.Empty(t, res.Documents)
+		require.NotNil(t, res.Groups)
+		return *res.Groups, nil
+	}
+
+	key := func(k string) *string { return &k }
+	value := func(v interface{}) *interface{} { return &v }
+	count := openapi.Aggregate{Fn: "count"}
+
+	groups, err := aggregate("", nil, count)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Nil(t, groups[0].Key)
+	assert.Equal(t, 6, groups[0].Count)
+	assert.Equal(t, []interface{}{6}, groups[0].Values)
+
+	var en interface{} = "en"
+	groups, err = aggregate("", []openapi.Filter{{Key: "val.lang", Equal: &en}}, count,
+		openapi.Aggregate{Fn: "sum", Key: key("val.pages")},
+		openapi.Aggregate{Fn: "min", Key: key("val.year")},
+		openapi.Aggregate{Fn: "max", Key: key("val.author")},
+		openapi.Aggregate{Fn: "avg", Key: key("val.pages")},
+	)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, []interface{}{4, 923.0, json.Number("1951"), "Stephen King", 923.0 / 3}, groups[0].Values)
+
+	groups, err = aggregate("val.author", nil, openapi.Aggregate{Fn: "sum", Key: key("val.pages")})
+	require.NoError(t, err)
+	assert.Equal(t, []openapi.AggregateGroup{
+		{Key: value("Frank Herbert"), Count: 3, Values: []interface{}{1112.0}},
+		{Key: value("Isaac Asimov"), Count: 1, Values: []interface{}{255.0}},
+		{Key: value("Peter Straub"), Count: 1, Values: []interface{}{0.0}},
+		{Key: value("Stephen King"), Count: 1, Values: []interface{}{0.0}},
+	}, groups)
+
+	groups, err = aggregate("val.year", []openapi.Filter{{Key: "val.lang", Equal: &en}})
+	require.NoError(t, err)
+	assert.Equal(t, []openapi.AggregateGroup{
+		{Key: value(json.Number("1951")), Count: 1, Values: []interface{}{}},
+		{Key: value(json.Number("1965")), Count: 1, Values: []interface{}{}},
+		{Key: value(json.Number("1969")), Count: 1, Values: []interface{}{}},
+		{Key: value(json.Number("1984")), Count: 1, Values: []interface{}{}},
+	}, groups)
+
+	_, err = aggregate("val.secret", nil, count)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	_, err = aggregate("", nil, openapi.Aggregate{Fn: "median", Key: key("val.pages")})
+	require.Error(t, err)
+
+	_, err = aggregate("", nil, openapi.Aggregate{Fn: "sum"})
+	require.Error(t, err)
+
+	// AQL
+	reqBytes, _ := json.Marshal(openapi.Query{Q: `com.example.Aggregate(val.lang="en") group by val.lang count`})
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(reqBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.QueryDocuments(e.NewContext(req, rec)))
+	var response openapi.SearchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	require.NotNil(t, response.Groups)
+	require.Len(t, *response.Groups, 1)
+	assert.Equal(t, "en", *(*response.Groups)[0].Key)
+	assert.Equal(t, 4, (*response.Groups)[0].Count)
+}
+
+func TestSearchDocuments_AggregateLongStrings(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "Model", Id: "com.example.AggregateLong"}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.AggregateLong", Id: "short",
+		Val: map[string]interface{}{"name": "short"}}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.AggregateLong", Id: "long",
+		Val: map[string]interface{}{"name": strings.Repeat("x", 200)}}))
+
+	r := s.kv.Read()
+	defer r.Close()
+	groupBy := "val.name"
+	res, err := s.query(context.Background(), r, openapi.SearchRequest{
+		Model:      "com.example.AggregateLong",
+		GroupBy:    &groupBy,
+		Aggregates: &[]openapi.Aggregate{{Fn: "count"}},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, res.Groups)
+	require.Len(t, *res.Groups, 1)
+	assert.Equal(t, "short", *(*res.Groups)[0].Key)
+	assert.Equal(t, 1, (*res.Groups)[0].Count)
+}
@@ -0,0 +1,458 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+)
+
+// when the index of a model changes, the documents that already exist are reindexed in the background.
+// new writes use the new index right away. the state of the job lives in the status of the Model document,
+// so it continues after a restart and can be watched with apogy get Model <id>:
+//
+//	status:
+//	  index:
+//	    state:   backfilling, ready or conflict
+//	    done:    number of documents reindexed so far
+//	    message: why the job stopped
+//
+// the progress of a running job is kept under taskKey("backfill", model), so the batches
+// do not rewrite the Model document and do not conflict with puts of it that leave the index alone.
+// reads of the Model fill it into done.
+//
+// a new unique index is not checked when the model is put, that would read the whole model in the request.
+// documents that already share a value stop the job with state conflict and a message naming them.
+
+// how many documents a backfill transaction reindexes
+const backfillBatchSize = 100
+
+// how long a backfill waits at most before it retries a batch that conflicted
+const backfillMaxBackoff = 5 * time.Second
+
+type backfillStatus struct {
+	State   string
+	Done    int
+	Message string
+}
+
+type backfillProgress struct {
+	Done   int    `json:"done"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+func getBackfillStatus(doc *openapi.Document) (backfillStatus, bool) {
+	var st backfillStatus
+	if doc == nil || doc.Status == nil {
+		return st, false
+	}
+	m, ok := (*doc.Status)["index"].(map[string]interface{})
+	if !ok {
+		return st, false
+	}
+	st.State, _ = m["state"].(string)
+	st.Message, _ = m["message"].(string)
+	switch done := m["done"].(type) {
+	case json.Number:
+		n, _ := done.Int64()
+		st.Done = int(n)
+	case float64:
+		st.Done = int(done)
+	case int:
+		st.Done = done
+	}
+	return st, true
+}
+
+func (st backfillStatus) set(doc *openapi.Document) {
+	m := map[string]interface{}{
+		"state": st.State,
+		"done":  json.Number(strconv.Itoa(st.Done)),
+	}
+	if st.Message != "" {
+		m["message"] = st.Message
+	}
+	if doc.Status == nil {
+		doc.Status = &map[string]interface{}{}
+	}
+	(*doc.Status)["index"] = m
+}
+
+// prepareModelIndex is called by PutDocument for Model documents.
+// it returns true if the index changed and a backfill has to run after the commit
+func (s *server) prepareModelIndex(ctx context.Context, w kv.Write, old *openapi.Document, doc *openapi.Document) (bool, error) {
+	oldIndex := map[string]string{}
+	if old != nil {
+		oldIndex = modelIndex(old.Val)
+	}
+	newIndex := modelIndex(doc.Val)
+
+	oldIndexing, newIndexing := "all", "all"
+	if old != nil {
+		oldIndexing, _ = modelIndexing(old.Val)
+	}
+	newIndexing, _ = modelIndexing(doc.Val)
+
+	if reflect.DeepEqual(oldIndex, newIndex) && oldIndexing == newIndexing {
+		// keep the progress of a backfill that is still running
+		if st, ok := getBackfillStatus(old); ok {
+			if _, ok := getBackfillStatus(doc); !ok {
+				st.set(doc)
+			}
+		}
+		return false, nil
+	}
+
+	// a job for the previous index starts over
+	if err := w.Del(taskKey("backfill", doc.Id)); err != nil {
+		return false, err
+	}
+	backfillStatus{State: "backfilling"}.set(doc)
+	return true, nil
+}
+
+// withBackfillProgress fills in how many documents a running backfill of a Model document reindexed so far
+func withBackfillProgress(ctx context.Context, r kv.Read, doc *openapi.Document) error {
+	st, ok := getBackfillStatus(doc)
+	if !ok || st.State != "backfilling" {
+		return nil
+	}
+	progress, err := getBackfillProgress(ctx, r, doc.Id)
+	if err != nil {
+		return err
+	}
+	st.Done = progress.Done
+	st.set(doc)
+	return nil
+}
+
+// runBackfill runs the backfill of a model unless this process is already running it
+func (s *server) runBackfill(model string) {
+	if _, running := s.backfills.LoadOrStore(model, true); running {
+		return
+	}
+	defer s.backfills.Delete(model)
+
+	ctx := context.Background()
+	backoff := 10 * time.Millisecond
+	for {
+		done, err := s.backfillBatch(ctx, model)
+		if err != nil {
+			if kv.IsErrWriteConflict(err) {
+				time.Sleep(backoff)
+				backoff = min(backoff*2, backfillMaxBackoff)
+				continue
+			}
+			slog.Error("[backfill] failed", "model", model, "err", err)
+			return
+		}
+		if done {
+			return
+		}
+		backoff = 10 * time.Millisecond
+	}
+}
+
+// backfillBatch reindexes the next batch of documents and moves the cursor in the same transaction.
+// only the last one, which finds nothing left to do, writes the Model document. it returns true then
+func (s *server) backfillBatch(ctx context.Context, modelID string) (bool, error) {
+	w := s.kv.Write()
+	defer w.Close()
+
+	modelPath, err := safeDBPath("Model", modelID)
+	if err != nil {
+		return true, err
+	}
+	b, err := w.Get(ctx, modelPath)
+	if err != nil {
+		if kv.IsErrNotFound(err) {
+			return true, nil
+		}
+		return true, err
+	}
+	if b == nil {
+		return true, nil
+	}
+	var modelDoc openapi.Document
+	if err := s.deserializeStore(modelPath, b, &modelDoc); err != nil {
+		return true, err
+	}
+
+	st, ok := getBackfillStatus(&modelDoc)
+	if !ok || st.State != "backfilling" {
+		return true, nil
+	}
+
+	progress, err := getBackfillProgress(ctx, w, modelID)
+	if err != nil {
+		return true, err
+	}
+
+	// the model as it is in this transaction, not what may be cached
+	indexing, _ := modelIndexing(modelDoc.Val)
+	model := &Model{Id: modelID, Index: modelIndex(modelDoc.Val), Indexing: indexing}
+
+	start := []byte("o\xff" + modelID + "\xff")
+	end := bytes.Clone(start)
+	end[len(end)-2] = end[len(end)-2] + 1
+	if progress.Cursor != "" {
+		start = append(start, []byte(progress.Cursor)...)
+		start = append(start, 0xff, 0x00)
+	}
+
+	var docs []*openapi.Document
+	for kv, err := range w.Iter(ctx, start, end) {
+		if err != nil {
+			return true, err
+		}
+		doc := new(openapi.Document)
+		if err := s.deserializeStore(kv.K, kv.V, doc); err != nil {
+			return true, fmt.Errorf("%s: %w", escapeNonPrintable(kv.K), err)
+		}
+		docs = append(docs, doc)
+		if len(docs) >= backfillBatchSize {
+			break
+		}
+	}
+
+	for _, doc := range docs {
+		if err := s.backfillDocument(ctx, w, model, doc); err != nil {
+			w.Rollback()
+			return true, s.stopBackfill(ctx, modelID, backfillStatus{
+				State:   "conflict",
+				Done:    progress.Done,
+				Message: err.Error(),
+			})
+		}
+		progress.Done++
+		progress.Cursor = doc.Id
+	}
+
+	if len(docs) > 0 {
+		b, err := json.Marshal(progress)
+		if err != nil {
+			return true, err
+		}
+		if err := w.Put(taskKey("backfill", modelID), b); err != nil {
+			return true, err
+		}
+		if err := w.Commit(ctx); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if err := s.sweepValueIndex(ctx, w, model); err != nil {
+		return true, err
+	}
+	if err := s.sweepFulltextIndex(ctx, w, model); err != nil {
+		return true, err
+	}
+	if err := s.sweepCompositeIndex(ctx, w, model); err != nil {
+		return true, err
+	}
+
+	backfillStatus{State: "ready", Done: progress.Done}.set(&modelDoc)
+	b, err = s.serializeStore(modelPath, &modelDoc)
+	if err != nil {
+		return true, err
+	}
+	if err := w.Put(modelPath, b); err != nil {
+		return true, err
+	}
+	if err := w.Del(taskKey("backfill", modelID)); err != nil {
+		return true, err
+	}
+	if err := w.Commit(ctx); err != nil {
+		return false, err
+	}
+
+	s.modelCache.Delete(modelID)
+	slog.Info("[backfill] done", "model", modelID, "documents", progress.Done)
+	return true, nil
+}
+
+func getBackfillProgress(ctx context.Context, r kv.Read, modelID string) (backfillProgress, error) {
+	var progress backfillProgress
+	b, err := r.Get(ctx, taskKey("backfill", modelID))
+	if err != nil {
+		if kv.IsErrNotFound(err) {
+			return progress, nil
+		}
+		return progress, err
+	}
+	if err := json.Unmarshal(b, &progress); err != nil {
+		return progress, fmt.Errorf("invalid backfill progress of %s: %w", modelID, err)
+	}
+	return progress, nil
+}
+
+// backfillDocument writes the index entries a document is missing.
+// unlike createIndex, a unique entry that already belongs to the document is fine
+func (s *server) backfillDocument(ctx context.Context, w kv.Write, model *Model, doc *openapi.Document) error {
+	expected, err := s.expectedIndex(ctx, model, doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", doc.Id, err)
+	}
+
+	keys := make([][]byte, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, []byte(k))
+	}
+	stored, err := w.BatchGet(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range expected {
+		have, ok := stored[k]
+		if ok && bytes.Equal(have, v) {
+			continue
+		}
+		if ok && isUniqueIndexKey([]byte(k)) {
+			owner, _, _ := bytes.Cut(have, []byte{0xff})
+			// like a put, the value of a document that expired is free
+			expired, err := hasExpired(ctx, w, model.Id, string(owner), time.Now())
+			if err != nil {
+				return err
+			}
+			if !expired {
+				// f or c 0xff model 0xff path 0xff ...
+				path, _, _ := strings.Cut(k[len("f\xff"+model.Id+"\xff"):], "\xff")
+				return fmt.Errorf("cannot make %s unique: documents %s and %s have the same value", path, owner, doc.Id)
+			}
+		}
+		if err := w.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepValueIndex deletes the entries of paths that are no longer indexed,
+// and the unique entries of paths that are no longer unique
+func (s *server) sweepValueIndex(ctx context.Context, w kv.Write, model *Model) error {
+	start := []byte("f\xff" + model.Id + "\xff")
+	end := bytes.Clone(start)
+	end[len(end)-2] = end[len(end)-2] + 1
+
+	var stale [][]byte
+	for kv, err := range w.Iter(ctx, start, end, kv.KeysOnly) {
+		if err != nil {
+			return err
+		}
+		path, _, _ := bytes.Cut(kv.K[len(start):], []byte{0xff})
+		if !model.indexed(string(path)) || (isUniqueIndexKey(kv.K) && model.Index[string(path)] != "unique") {
+			stale = append(stale, bytes.Clone(kv.K))
+		}
+	}
+	for _, k := range stale {
+		if err := w.Del(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepFulltextIndex deletes the words of paths that no longer have a full text index
+func (s *server) sweepFulltextIndex(ctx context.Context, w kv.Write, model *Model) error {
+	start := []byte("s\xff" + model.Id + "\xff")
+	end := bytes.Clone(start)
+	end[len(end)-2] = end[len(end)-2] + 1
+
+	var stale [][]byte
+	for kv, err := range w.Iter(ctx, start, end, kv.KeysOnly) {
+		if err != nil {
+			return err
+		}
+		path, _, _ := bytes.Cut(kv.K[len(start):], []byte{0xff})
+		if fulltext, _ := fulltextIndex(model.Index[string(path)]); !fulltext {
+			stale = append(stale, bytes.Clone(kv.K))
+		}
+	}
+	for _, k := range stale {
+		if err := w.Del(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepCompositeIndex deletes the entries of composite indexes the model no longer has,
+// and the unique entries of composite indexes that are no longer unique
+func (s *server) sweepCompositeIndex(ctx context.Context, w kv.Write, model *Model) error {
+	start := []byte("c\xff" + model.Id + "\xff")
+	end := bytes.Clone(start)
+	end[len(end)-2] = end[len(end)-2] + 1
+
+	var stale [][]byte
+	for kv, err := range w.Iter(ctx, start, end, kv.KeysOnly) {
+		if err != nil {
+			return err
+		}
+		paths, _, _ := bytes.Cut(kv.K[len(start):], []byte{0xff})
+		kind := model.Index[string(paths)]
+		if (kind != "index" && kind != "unique") || (isUniqueIndexKey(kv.K) && kind != "unique") {
+			stale = append(stale, bytes.Clone(kv.K))
+		}
+	}
+	for _, k := range stale {
+		if err := w.Del(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopBackfill records why a backfill could not finish, in its own transaction
+func (s *server) stopBackfill(ctx context.Context, modelID string, st backfillStatus) error {
+	w := s.kv.Write()
+	defer w.Close()
+
+	modelPath, err := safeDBPath("Model", modelID)
+	if err != nil {
+		return err
+	}
+	b, err := w.Get(ctx, modelPath)
+	if err != nil {
+		return err
+	}
+	var modelDoc openapi.Document
+	if err := s.deserializeStore(modelPath, b, &modelDoc); err != nil {
+		return err
+	}
+	st.set(&modelDoc)
+	b, err = s.serializeStore(modelPath, &modelDoc)
+	if err != nil {
+		return err
+	}
+	if err := w.Put(modelPath, b); err != nil {
+		return err
+	}
+	if err := w.Del(taskKey("backfill", modelID)); err != nil {
+		return err
+	}
+	if err := w.Commit(ctx); err != nil {
+		return err
+	}
+
+	slog.Warn("[backfill] stopped", "model", modelID, "state", st.State, "message", st.Message)
+	return nil
+}
+
+// resumeBackfills continues the backfills that were running when the server stopped
+func (s *server) resumeBackfills(models []openapi.Document) {
+	for _, doc := range models {
+		if st, ok := getBackfillStatus(&doc); ok && st.State == "backfilling" {
+			go s.runBackfill(doc.Id)
+		}
+	}
+}
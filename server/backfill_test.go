@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func putBackfillTestModel(e *echo.Echo, s *server, index map[string]interface{}) error {
+	val := map[string]interface{}{
+		"schema": map[string]interface{}{"name": "string"},
+	}
+	if index != nil {
+		val["index"] = index
+	}
+	return putTestDoc(e, s, openapi.Document{Model: "Model", Id: "com.example.Backfill", Val: val})
+}
+
+// writeBackfillTestModel changes the index without the checks of a put, and resumes the backfill
+func writeBackfillTestModel(t *testing.T, s *server, index map[string]interface{}, progress *backfillProgress) {
+	s.resumeBackfills([]openapi.Document{storeBackfillTestModel(t, s, index, progress)})
+}
+
+// storeBackfillTestModel stores a backfill that is running, without running it
+func storeBackfillTestModel(t *testing.T, s *server, index map[string]interface{}, progress *backfillProgress) openapi.Document {
+	ctx := context.Background()
+	path, err := safeDBPath("Model", "com.example.Backfill")
+	require.NoError(t, err)
+	var modelDoc openapi.Document
+	require.NoError(t, s.getDocument(ctx, "Model", "com.example.Backfill", &modelDoc))
+	modelDoc.Val.(map[string]interface{})["index"] = index
+	backfillStatus{State: "backfilling"}.set(&modelDoc)
+	b, err := s.serializeStore(path, &modelDoc)
+	require.NoError(t, err)
+
+	w := s.kv.Write()
+	defer w.Close()
+	require.NoError(t, w.Put(path, b))
+	if progress != nil {
+		b, err := json.Marshal(progress)
+		require.NoError(t, err)
+		require.NoError(t, w.Put(taskKey("backfill", "com.example.Backfill"), b))
+	}
+	require.NoError(t, w.Commit(ctx))
+
+	return modelDoc
+}
+
+func waitForBackfill(t *testing.T, s *server) backfillStatus {
+	return waitForModelBackfill(t, s, "com.example.Backfill")
+}
+
+func waitForModelBackfill(t *testing.T, s *server, model string) backfillStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var doc openapi.Document
+		require.NoError(t, s.getDocument(context.Background(), "Model", model, &doc))
+		st, ok := getBackfillStatus(&doc)
+		require.True(t, ok)
+		if st.State != "backfilling" || time.Now().After(deadline) {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func uniqueBackfillTestEntry(t *testing.T, s *server, value string) []byte {
+	r := s.kv.Read()
+	defer r.Close()
+	b, err := r.Get(context.Background(), []byte("f\xffcom.example.Backfill\xffval.name\xff"+value+"\xff\xff"))
+	if kv.IsErrNotFound(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	return b
+}
+
+func TestBackfill_UniqueIndex(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	for id, name := range map[string]string{"a": "x", "b": "y"} {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.Backfill",
+			Id:    id,
+			Val:   map[string]interface{}{"name": name},
+		}))
+	}
+
+	require.NoError(t, putBackfillTestModel(e, s, map[string]interface{}{"name": "unique"}))
+	st := waitForBackfill(t, s)
+	assert.Equal(t, "ready", st.State)
+	assert.Equal(t, 2, st.Done)
+
+	assert.Equal(t, []byte("a\xff"), uniqueBackfillTestEntry(t, s, "x"))
+	assert.Equal(t, []byte("b\xff"), uniqueBackfillTestEntry(t, s, "y"))
+
+	err := putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Backfill",
+		Id:    "c",
+		Val:   map[string]interface{}{"name": "x"},
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusConflict, err.(*echo.HTTPError).Code)
+	}
+
+	// dropping the unique index removes its entries
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	st = waitForBackfill(t, s)
+	assert.Equal(t, "ready", st.State)
+	assert.Nil(t, uniqueBackfillTestEntry(t, s, "x"))
+}
+
+func TestBackfill_UniqueConflicts(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.Backfill",
+			Id:    id,
+			Val:   map[string]interface{}{"name": "same"},
+		}))
+	}
+
+	// the put does not read the documents, the job finds the conflict
+	require.NoError(t, putBackfillTestModel(e, s, map[string]interface{}{"name": "unique"}))
+
+	st := waitForBackfill(t, s)
+	assert.Equal(t, "conflict", st.State)
+	assert.Contains(t, st.Message, "cannot make val.name unique: documents a and b")
+}
+
+func TestBackfill_LongConflicts(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	// too long for the regular index, but not for the unique one
+	long := strings.Repeat("x", 200)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.Backfill",
+			Id:    id,
+			Val:   map[string]interface{}{"name": long},
+		}))
+	}
+
+	require.NoError(t, putBackfillTestModel(e, s, map[string]interface{}{"name": "unique"}))
+
+	st := waitForBackfill(t, s)
+	assert.Equal(t, "conflict", st.State)
+	assert.Contains(t, st.Message, "documents a and b")
+}
+
+func TestBackfill_ExpiredOwner(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Backfill",
+		Id:    "a",
+		Val:   map[string]interface{}{"name": "same"},
+	}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Backfill",
+		Id:    "b",
+		Val:   map[string]interface{}{"name": "same"},
+	}))
+
+	// a expired but is not swept yet
+	path, err := safeDBPath("com.example.Backfill", "a")
+	require.NoError(t, err)
+	var doc openapi.Document
+	require.NoError(t, s.getDocument(context.Background(), "com.example.Backfill", "a", &doc))
+	doc.Expires = &past
+	b, err := s.serializeStore(path, &doc)
+	require.NoError(t, err)
+	w := s.kv.Write()
+	require.NoError(t, w.Put(path, b))
+	require.NoError(t, s.writeExpiry(w, nil, &doc))
+	require.NoError(t, w.Commit(context.Background()))
+	w.Close()
+
+	require.NoError(t, putBackfillTestModel(e, s, map[string]interface{}{"name": "unique"}))
+
+	st := waitForBackfill(t, s)
+	assert.Equal(t, "ready", st.State)
+	assert.Equal(t, []byte("b\xff"), uniqueBackfillTestEntry(t, s, "same"))
+}
+
+func TestBackfill_ProgressInStatus(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	storeBackfillTestModel(t, s, map[string]interface{}{"name": "unique"}, &backfillProgress{Done: 2, Cursor: "b"})
+
+	req := httptest.NewRequest(http.MethodGet, "/documents/Model/com.example.Backfill", nil)
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.GetDocument(e.NewContext(req, rec), "Model", "com.example.Backfill", openapi.GetDocumentParams{}))
+
+	var doc openapi.Document
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	st, ok := getBackfillStatus(&doc)
+	require.True(t, ok)
+	assert.Equal(t, "backfilling", st.State)
+	assert.Equal(t, 2, st.Done)
+}
+
+func TestBackfill_ConflictStopsJob(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.Backfill",
+			Id:    id,
+			Val:   map[string]interface{}{"name": "same"},
+		}))
+	}
+
+	// as if b was written by a server that did not know about the new index yet
+	writeBackfillTestModel(t, s, map[string]interface{}{"name": "unique"}, nil)
+
+	st := waitForBackfill(t, s)
+	assert.Equal(t, "conflict", st.State)
+	assert.Contains(t, st.Message, "documents a and b")
+}
+
+func TestBackfill_Resume(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.Backfill",
+			Id:    id,
+			Val:   map[string]interface{}{"name": id},
+		}))
+	}
+
+	// a job that stopped after b, as it would be found after a restart
+	writeBackfillTestModel(t, s, map[string]interface{}{"name": "unique"}, &backfillProgress{Done: 2, Cursor: "b"})
+
+	st := waitForBackfill(t, s)
+	assert.Equal(t, "ready", st.State)
+	assert.Equal(t, 4, st.Done)
+
+	assert.Nil(t, uniqueBackfillTestEntry(t, s, "a"))
+	assert.Nil(t, uniqueBackfillTestEntry(t, s, "b"))
+	assert.Equal(t, []byte("c\xff"), uniqueBackfillTestEntry(t, s, "c"))
+	assert.Equal(t, []byte("d\xff"), uniqueBackfillTestEntry(t, s, "d"))
+
+	// the progress is gone with the job
+	r := s.kv.Read()
+	defer r.Close()
+	progress, err := getBackfillProgress(context.Background(), r, "com.example.Backfill")
+	require.NoError(t, err)
+	assert.Equal(t, backfillProgress{}, progress)
+}
+
+func TestBackfill_IndexingNone(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Backfill",
+		Id:    "a",
+		Val:   map[string]interface{}{"name": "x", "blob": "y"},
+	}))
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "Model", Id: "com.example.Backfill", Val: map[string]interface{}{
+		"schema":   map[string]interface{}{"name": "string"},
+		"indexing": "none",
+		"index":    map[string]interface{}{"name": "unique"},
+	}}))
+	assert.Equal(t, "ready", waitForBackfill(t, s).State)
+
+	// the entries of blob are gone, name keeps its own and gets a unique one
+	r := s.kv.Read()
+	defer r.Close()
+	var keys []string
+	for kv, err := range r.Iter(context.Background(), []byte("f\xffcom.example.Backfill\xff"), []byte("f\xffcom.example.Backfill\xff\xff")) {
+		require.NoError(t, err)
+		keys = append(keys, string(kv.K))
+	}
+	assert.Equal(t, []string{
+		"f\xffcom.example.Backfill\xffval.name\xffx\xffa\xff",
+		"f\xffcom.example.Backfill\xffval.name\xffx\xff\xff",
+	}, keys)
+
+	report, err := s.fsck(context.Background(), false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+)
+
+// a backup is a jsonl file. the first line is a header, then one document per line,
+// and a trailer with the number of documents, so a truncated file is not mistaken for a complete one.
+// models come first, so restore can index the documents that follow them.
+//
+//	{"apogy":"backup","version":1,"created":"2024-01-01T00:00:00Z"}
+//	{"model":"Model","id":"com.example.Book",...}
+//	{"model":"com.example.Book","id":"dune",...}
+//	{"apogy":"end","documents":2}
+//
+// documents are stored as the api returns them, so a backup does not depend on
+// the storage encoding, encryption or kv backend it was taken from.
+
+const backupVersion = 1
+
+type backupHeader struct {
+	Apogy     string     `json:"apogy"`
+	Version   int        `json:"version,omitempty"`
+	Created   *time.Time `json:"created,omitempty"`
+	Documents *int       `json:"documents,omitempty"`
+}
+
+// how many documents restore writes per transaction
+const restoreBatchSize = 100
+
+// backup writes all documents from a single snapshot
+func (s *server) backup(ctx context.Context, out io.Writer) (int, error) {
+	r := s.kv.Read()
+	defer r.Close()
+
+	enc := json.NewEncoder(out)
+
+	now := time.Now().UTC()
+	if err := enc.Encode(backupHeader{Apogy: "backup", Version: backupVersion, Created: &now}); err != nil {
+		return 0, err
+	}
+
+	models := []byte("o\xffModel\xff")
+	modelsEnd := []byte("o\xffModel\xff\xff")
+
+	n := 0
+	dump := func(start, end []byte, skip func(k []byte) bool) error {
+		for kv, err := range r.Iter(ctx, start, end) {
+			if err != nil {
+				return err
+			}
+			if skip != nil && skip(kv.K) {
+				continue
+			}
+			var doc openapi.Document
+			if err := s.deserializeStore(kv.K, kv.V, &doc); err != nil {
+				return fmt.Errorf("%s: %w", escapeNonPrintable(kv.K), err)
+			}
+			if err := enc.Encode(&doc); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	}
+
+	if err := dump(models, modelsEnd, nil); err != nil {
+		return n, err
+	}
+	err := dump([]byte("o\xff"), []byte("p"), func(k []byte) bool {
+		return bytes.HasPrefix(k, models)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if err := enc.Encode(backupHeader{Apogy: "end", Documents: &n}); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// restore reads a backup and writes every document as it was, with its version and history.
+// indexes are built the same way PutDocument builds them, so they match the models in the backup
+// and not whatever the source database had. existing documents with the same id are replaced.
+func (s *server) restore(ctx context.Context, in io.Reader) (int, error) {
+	dec := json.NewDecoder(in)
+	dec.UseNumber()
+
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("not an apogy backup: %w", err)
+	}
+	if header.Apogy != "backup" {
+		return 0, errors.New("not an apogy backup")
+	}
+	if header.Version != backupVersion {
+		return 0, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+
+	var batch []*openapi.Document
+	n := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.restoreBatch(ctx, batch); err != nil {
+			return err
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		var line json.RawMessage
+		if err := dec.Decode(&line); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, errors.New("backup is truncated")
+			}
+			return n, err
+		}
+
+		var trailer backupHeader
+		if err := json.Unmarshal(line, &trailer); err == nil && trailer.Apogy == "end" {
+			if err := flush(); err != nil {
+				return n, err
+			}
+			if trailer.Documents == nil || *trailer.Documents != n {
+				return n, fmt.Errorf("backup is incomplete, restored %d documents", n)
+			}
+			return n, nil
+		}
+
+		doc := new(openapi.Document)
+		ldec := json.NewDecoder(bytes.NewReader(line))
+		ldec.UseNumber()
+		if err := ldec.Decode(doc); err != nil {
+			return n, fmt.Errorf("invalid document after %d documents: %w", n, err)
+		}
+		if err := s.validateMeta(doc); err != nil {
+			return n, fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+		}
+
+		// a model must be committed before documents of that model can be indexed
+		if len(batch) >= restoreBatchSize || (len(batch) > 0 && batch[len(batch)-1].Model != doc.Model) {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+		batch = append(batch, doc)
+	}
+}
+
+func (s *server) restoreBatch(ctx context.Context, docs []*openapi.Document) error {
+	// documents with large arrays have many index entries, so a batch may not fit into one transaction
+	w := kv.NewBulkWrite(ctx, s.kv)
+	defer w.Close()
+
+	for _, doc := range docs {
+		model, err := s.getModel(ctx, doc.Model)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+		}
+
+		path, err := safeDBPath(doc.Model, doc.Id)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+		}
+
+		b, err := w.Get(ctx, path)
+		if err != nil && !kv.IsErrNotFound(err) {
+			return err
+		}
+		var old *openapi.Document
+		if len(b) > 0 {
+			old = new(openapi.Document)
+			if err := s.deserializeStore(path, b, old); err != nil {
+				return fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+			}
+			if err := s.deleteIndex(ctx, w, model, old); err != nil {
+				return fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+			}
+		}
+
+		b, err = s.serializeStore(path, doc)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+		}
+		if err := w.Put(path, b); err != nil {
+			return err
+		}
+		if err := s.createIndex(ctx, w, model, doc); err != nil {
+			return fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+		}
+		if err := s.writeExpiry(w, old, doc); err != nil {
+			return fmt.Errorf("%s/%s: %w", doc.Model, doc.Id, err)
+		}
+	}
+
+	if err := w.Commit(ctx); err != nil {
+		return err
+	}
+
+	// the restored model may differ from the one that was cached
+	for _, doc := range docs {
+		if doc.Model == "Model" {
+			s.modelCache.Delete(doc.Id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	e, src := setupTestServer(t)
+	setupSearchTestData(t, e, src)
+
+	var buf bytes.Buffer
+	n, err := src.backup(ctx, &buf)
+	require.NoError(t, err)
+	// two models and three documents
+	assert.Equal(t, 5, n)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Contains(t, lines[0], `"apogy":"backup"`)
+	assert.Contains(t, lines[1], `"model":"Model"`)
+	assert.Contains(t, lines[2], `"model":"Model"`)
+	assert.Contains(t, lines[len(lines)-1], `"apogy":"end"`)
+
+	// into a different storage encoding
+	e2, dst := setupTestServer(t)
+	dst.encoding, err = codec.ParseEncoding("cbor+zstd")
+	require.NoError(t, err)
+
+	n, err = dst.restore(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// documents keep their version
+	req := httptest.NewRequest(http.MethodGet, "/documents/com.example.SearchTest/doc1", nil)
+	rec := httptest.NewRecorder()
+	require.NoError(t, dst.GetDocument(e2.NewContext(req, rec), "com.example.SearchTest", "doc1", openapi.GetDocumentParams{}))
+	var doc openapi.Document
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, uint64(1), *doc.Version)
+	assert.Equal(t, "Document 1", (doc.Val.(map[string]interface{}))["name"])
+
+	// indexes are rebuilt
+	var equal interface{} = "test"
+	filters := []openapi.Filter{{Key: "val.type", Equal: &equal}}
+	reqBytes, _ := json.Marshal(openapi.SearchRequest{Model: "com.example.SearchTest", Filters: &filters})
+	req = httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	rec = httptest.NewRecorder()
+	require.NoError(t, dst.SearchDocuments(e2.NewContext(req, rec)))
+	var response openapi.SearchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Len(t, response.Documents, 2)
+
+	// restoring again replaces the documents instead of duplicating index entries
+	_, err = dst.restore(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	require.NoError(t, dst.SearchDocuments(e2.NewContext(req, rec)))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Len(t, response.Documents, 2)
+}
+
+func TestBackup_RejectsIncomplete(t *testing.T) {
+	ctx := context.Background()
+
+	e, src := setupTestServer(t)
+	setupSearchTestData(t, e, src)
+
+	var buf bytes.Buffer
+	_, err := src.backup(ctx, &buf)
+	require.NoError(t, err)
+
+	_, dst := setupTestServer(t)
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	// no trailer
+	_, err = dst.restore(ctx, strings.NewReader(strings.Join(lines[:len(lines)-2], "")))
+	assert.ErrorContains(t, err, "truncated")
+
+	// a document is missing
+	missing := append(append([]string{}, lines[:3]...), lines[4:]...)
+	_, err = dst.restore(ctx, strings.NewReader(strings.Join(missing, "")))
+	assert.ErrorContains(t, err, "incomplete")
+
+	_, err = dst.restore(ctx, strings.NewReader(`{"model":"Model","id":"x"}`+"\n"))
+	assert.ErrorContains(t, err, "not an apogy backup")
+}
@@ -1,24 +1,145 @@
 package server
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
 	"github.com/spf13/cobra"
 )
 
 var (
-	caCertPath     string
-	serverCertPath string
-	serverKeyPath  string
+	kvBackend         string
+	kvNamespace       string
+	leveldbPath       string
+	storageEncoding   string
+	encryptionKeyFile string
+	caCertPath        string
+	serverCertPath    string
+	serverKeyPath     string
+	fsckRepair        bool
 )
 
 var CMD = &cobra.Command{
 	Use:   "server",
 	Short: "start a grpc server",
 	Run: func(cmd *cobra.Command, args []string) {
-		Main(caCertPath, serverCertPath, serverKeyPath)
+		Main(kvBackend, leveldbPath, kvNamespace, storageEncoding, encryptionKeyFile, caCertPath, serverCertPath, serverKeyPath)
+	},
+}
+
+var BackupCMD = &cobra.Command{
+	Use:   "backup [file]",
+	Short: "write all documents from a consistent snapshot to a file, or stdout",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := newServer(kvBackend, leveldbPath, kvNamespace, storageEncoding, encryptionKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		defer s.kv.Close()
+
+		var out io.Writer = os.Stdout
+		if len(args) > 0 && args[0] != "-" {
+			f, err := os.Create(args[0])
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			out = f
+		}
+		bw := bufio.NewWriter(out)
+
+		n, err := s.backup(cmd.Context(), bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "backed up %d documents\n", n)
+	},
+}
+
+var RestoreCMD = &cobra.Command{
+	Use:   "restore [file]",
+	Short: "write all documents from a backup file, or stdin, and rebuild their indexes",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := newServer(kvBackend, leveldbPath, kvNamespace, storageEncoding, encryptionKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		defer s.kv.Close()
+
+		var in io.Reader = os.Stdin
+		if len(args) > 0 && args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			in = f
+		}
+
+		n, err := s.restore(cmd.Context(), bufio.NewReader(in))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "restored %d documents\n", n)
+	},
+}
+
+var FsckCMD = &cobra.Command{
+	Use:   "fsck",
+	Short: "check that the index matches the documents, and optionally repair it",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := newServer(kvBackend, leveldbPath, kvNamespace, storageEncoding, encryptionKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		defer s.kv.Close()
+
+		report, err := s.fsck(cmd.Context(), fsckRepair)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		unresolved := 0
+		for _, issue := range report.Issues {
+			fmt.Println(issue)
+			if !fsckRepair || issue.Kind == "unique" || issue.Kind == "error" {
+				unresolved++
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "checked %d documents, found %d issues, repaired %d\n", report.Documents, len(report.Issues), report.Repaired)
+		if unresolved > 0 {
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
+	for _, cmd := range []*cobra.Command{BackupCMD, RestoreCMD, FsckCMD} {
+		cmd.Flags().StringVar(&kvBackend, "kv", os.Getenv("KV_BACKEND"), "Storage backend: tikv (default), leveldb or memory")
+		cmd.Flags().StringVar(&leveldbPath, "leveldb-path", os.Getenv("LEVELDB_PATH"), "Directory of the leveldb backend, same as for the server")
+		cmd.Flags().StringVar(&kvNamespace, "namespace", os.Getenv("KV_NAMESPACE"), "Database inside the kv, same as for the server")
+		cmd.Flags().StringVar(&encryptionKeyFile, "encryption-key-file", os.Getenv("ENCRYPTION_KEY_FILE"), "Keys to decrypt and encrypt documents, same as for the server")
+	}
+	FsckCMD.Flags().BoolVar(&fsckRepair, "repair", false, "Delete orphaned index entries and write missing ones")
+	RestoreCMD.Flags().StringVar(&storageEncoding, "storage-encoding", os.Getenv("STORAGE_ENCODING"), "Encoding of restored documents, same as for the server")
+
+	CMD.Flags().StringVar(&kvBackend, "kv", os.Getenv("KV_BACKEND"), "Storage backend: tikv (default), leveldb or memory")
+	CMD.Flags().StringVar(&leveldbPath, "leveldb-path", os.Getenv("LEVELDB_PATH"), "Directory of the leveldb backend, default ./apogy-data")
+	CMD.Flags().StringVar(&kvNamespace, "namespace", os.Getenv("KV_NAMESPACE"), "Keep this database apart from others in the same kv, under its own key prefix. empty is the root database")
+	CMD.Flags().StringVar(&storageEncoding, "storage-encoding", os.Getenv("STORAGE_ENCODING"), "Encoding of newly written documents: json (default) or cbor, add +zstd to compress large documents. all encodings can always be read")
+	CMD.Flags().StringVar(&encryptionKeyFile, "encryption-key-file", os.Getenv("ENCRYPTION_KEY_FILE"), "Encrypt documents at rest with the keys in this file, one '<id> <base64 key>' per line, the last one is current")
 	CMD.Flags().StringVar(&caCertPath, "ca-cert", "", "Path to CA certificate file for client verification (enables mTLS)")
 	CMD.Flags().StringVar(&serverCertPath, "server-cert", "", "Path to server certificate file")
 	CMD.Flags().StringVar(&serverKeyPath, "server-key", "", "Path to server private key file")
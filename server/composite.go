@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+	"github.com/aep/apogy/kv"
+)
+
+// a model can index several paths together, so that a search by all of them is a single range scan
+// instead of a scan of the first and a lookup of the others for every document it finds:
+//
+//	index:
+//	  author,year: index
+//	  tenant,email: unique
+//
+// every document with a value for each of the paths gets an entry, in the same transaction as the rest of the index
+//
+//	c 0xff model 0xff val.author,val.year 0xff author 0xff year 0xff id 0xff -> id 0xff
+//
+// a unique one also claims the combination of values like a unique index on a single path does,
+// unless one of them is null
+//
+//	c 0xff model 0xff val.tenant,val.email 0xff tenant 0xff email 0xff 0xff -> id 0xff
+//
+// a search uses it when it has equal filters on the first paths, optionally followed by a range on the next one.
+// arrays index every combination of their values.
+
+// how many entries a document may write into one composite index, the product of its array lengths
+const maxCompositeEntries = 100
+
+// compositeIndexes returns the paths of every composite index of the model, in a stable order
+func (m *Model) compositeIndexes() [][]string {
+	var ret [][]string
+	for key, kind := range m.Index {
+		if !strings.Contains(key, ",") || (kind != "index" && kind != "unique") {
+			continue
+		}
+		ret = append(ret, strings.Split(key, ","))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return strings.Join(ret[i], ",") < strings.Join(ret[j], ",")
+	})
+	return ret
+}
+
+func isCompositeKey(key string) bool {
+	return strings.Contains(key, ",")
+}
+
+// indexKey is the start of every entry of a path in the value index, or of a composite index
+func indexKey(model string, key string) []byte {
+	p := []byte("f\xff")
+	if isCompositeKey(key) {
+		p = []byte("c\xff")
+	}
+	p = append(p, []byte(model)...)
+	p = append(p, 0xff)
+	p = append(p, []byte(key)...)
+	return p
+}
+
+// compositeValue encodes a value like the value index does. strings the value index skips are not indexed here either
+func compositeValue(v any) ([]byte, bool) {
+	if s, ok := v.(string); ok {
+		if len(s) >= 128 || strings.IndexByte(s, 0xff) >= 0 {
+			return nil, false
+		}
+		return []byte(s), true
+	}
+	return codec.IndexValue(v)
+}
+
+// valuesAt collects the encoded values at a path like val.a.b, with arrays at any level contributing each element
+func valuesAt(obj any, path []string, encode func(any) ([]byte, bool)) [][]byte {
+	switch v := obj.(type) {
+	case []interface{}:
+		var ret [][]byte
+		for _, v := range v {
+			ret = append(ret, valuesAt(v, path, encode)...)
+		}
+		return ret
+	case *map[string]interface{}:
+		if v == nil {
+			return nil
+		}
+		return valuesAt(*v, path, encode)
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return nil
+		}
+		vv, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return valuesAt(vv, path[1:], encode)
+	}
+	if len(path) > 0 {
+		return nil
+	}
+	if vbin, ok := encode(obj); ok {
+		return [][]byte{vbin}
+	}
+	return nil
+}
+
+func (s *server) writeCompositeIndex(ctx context.Context, w kv.Write, model *Model, objectId []byte, val any, delete bool) error {
+	for _, paths := range model.compositeIndexes() {
+		key := strings.Join(paths, ",")
+		unique := model.Index[key] == "unique"
+
+		type entry struct {
+			p    []byte
+			null bool
+		}
+
+		// every combination of the values, starting with the prefix of the index
+		entries := []entry{{p: indexKey(model.Id, key)}}
+		for _, path := range paths {
+			values := valuesAt(val, strings.Split(strings.TrimPrefix(path, "val."), "."), compositeValue)
+			if len(entries)*len(values) > maxCompositeEntries {
+				return fmt.Errorf("%s has too many combinations of values for a composite index", key)
+			}
+			var next []entry
+			for _, e := range entries {
+				for _, v := range values {
+					p := append([]byte(nil), e.p...)
+					p = append(p, 0xff)
+					p = append(p, v...)
+					next = append(next, entry{p: p, null: e.null || bytes.Equal(v, []byte{codec.IndexTagNull})})
+				}
+			}
+			entries = next
+		}
+
+		for _, e := range entries {
+			p := append(e.p, 0xff)
+
+			if unique && !e.null {
+				if err := s.writeUniqueIndex(ctx, w, model, key, p, objectId, delete); err != nil {
+					return err
+				}
+			}
+
+			p = append(p, objectId...)
+			p = append(p, 0xff)
+
+			var err error
+			if delete {
+				err = w.Del(p)
+			} else {
+				err = w.Put(p, append(objectId, 0xff))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// useCompositeIndex replaces the filters that a composite index of the model covers with a single filter on it.
+// the filter is on the last covered path, its key carries the composite key and the values of the paths before it
+// as they are stored, which no key from a client can contain because they are never valid utf8.
+// the other filters stay in their order and are checked for every document it finds.
+func useCompositeIndex(model *Model, filters []openapi.Filter) []openapi.Filter {
+	var best []int
+	var bestPaths []string
+
+	for _, paths := range model.compositeIndexes() {
+		var used []int
+		for _, path := range paths {
+			i := findFilter(filters, path, used)
+			if i < 0 {
+				break
+			}
+			used = append(used, i)
+			if filters[i].Equal == nil {
+				// a range can only be the last
+				break
+			}
+		}
+		if len(used) >= 2 && len(used) > len(best) {
+			best = used
+			bestPaths = paths
+		}
+	}
+	if best == nil {
+		return filters
+	}
+
+	last := filters[best[len(best)-1]]
+	key := strings.Join(bestPaths, ",")
+	for _, i := range best[:len(best)-1] {
+		vbin, _ := compositeValue(*filters[i].Equal)
+		key += "\xff" + string(vbin)
+	}
+	last.Key = key
+
+	ret := []openapi.Filter{last}
+	for i, f := range filters {
+		used := false
+		for _, j := range best {
+			used = used || i == j
+		}
+		if !used {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// findFilter returns a filter on a path that a composite index can take over, preferring equal over a range, or -1
+func findFilter(filters []openapi.Filter, path string, used []int) int {
+	ranged := -1
+	for i, f := range filters {
+		if f.Key != path || f.Prefix != nil || f.Skip != nil || f.Contains != nil || !isPlainFilter(f) {
+			continue
+		}
+		taken := false
+		for _, j := range used {
+			taken = taken || i == j
+		}
+		if taken {
+			continue
+		}
+		if f.Equal != nil {
+			if _, ok := compositeValue(*f.Equal); ok {
+				return i
+			}
+		} else if ranged < 0 && (f.Greater != nil || f.Less != nil) {
+			ranged = i
+		}
+	}
+	return ranged
+}
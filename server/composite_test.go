@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUseCompositeIndex(t *testing.T) {
+	model := &Model{Id: "Book", Index: modelIndex(map[string]interface{}{
+		"index": map[string]interface{}{
+			"author,year":       "index",
+			"author,year,title": "index",
+			"title":             "unique",
+		},
+	})}
+
+	var herbert, year, dune, lang interface{} = "Frank Herbert", json.Number("1965"), "Dune", "en"
+
+	filters := useCompositeIndex(model, []openapi.Filter{
+		{Key: "val.lang", Equal: &lang},
+		{Key: "val.year", Equal: &year},
+		{Key: "val.author", Equal: &herbert},
+	})
+	require.Len(t, filters, 2)
+	assert.Equal(t, "val.author,val.year\xffFrank Herbert", filters[0].Key)
+	assert.Equal(t, year, *filters[0].Equal)
+	assert.Equal(t, "val.lang", filters[1].Key)
+
+	// the longest match wins
+	filters = useCompositeIndex(model, []openapi.Filter{
+		{Key: "val.author", Equal: &herbert},
+		{Key: "val.year", Equal: &year},
+		{Key: "val.title", Equal: &dune},
+	})
+	require.Len(t, filters, 1)
+	assert.Equal(t, "val.author,val.year,val.title\xffFrank Herbert\xff"+string(codec.IndexInt(1965)), filters[0].Key)
+
+	// a range ends the match
+	filters = useCompositeIndex(model, []openapi.Filter{
+		{Key: "val.author", Equal: &herbert},
+		{Key: "val.year", Greater: &year},
+		{Key: "val.title", Equal: &dune},
+	})
+	require.Len(t, filters, 2)
+	assert.Equal(t, "val.author,val.year\xffFrank Herbert", filters[0].Key)
+	assert.Equal(t, year, *filters[0].Greater)
+
+	// not the first path
+	filters = useCompositeIndex(model, []openapi.Filter{
+		{Key: "val.year", Equal: &year},
+		{Key: "val.title", Equal: &dune},
+	})
+	assert.Equal(t, "val.year", filters[0].Key)
+}
+
+func TestSearchDocuments_CompositeIndex(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.Composite",
+		Val: map[string]interface{}{
+			"index": map[string]interface{}{"author, year": "index"},
+		},
+	}))
+
+	books := map[string]map[string]interface{}{
+		"dune":       {"author": "Frank Herbert", "year": 1965, "lang": "en"},
+		"messiah":    {"author": "Frank Herbert", "year": 1969, "lang": "en"},
+		"children":   {"author": "Frank Herbert", "year": 1976, "lang": "de"},
+		"foundation": {"author": "Isaac Asimov", "year": 1951, "lang": "en"},
+		"twins":      {"author": []interface{}{"Anna", "Bob"}, "year": 2001},
+		"noyear":     {"author": "Frank Herbert"},
+	}
+	for id, val := range books {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Composite", Id: id, Val: val}))
+	}
+	assert.Equal(t, "ready", waitForModelBackfill(t, s, "com.example.Composite").State)
+
+	aql := func(q string) []string {
+		reqBytes, _ := json.Marshal(openapi.Query{Q: q})
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(reqBytes))
+		req.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+		require.NoError(t, s.QueryDocuments(e.NewContext(req, rec)))
+		var response openapi.SearchResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		ids := []string{}
+		for _, doc := range response.Documents {
+			ids = append(ids, doc.Id)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"messiah"}, aql(`com.example.Composite(val.author="Frank Herbert" val.year=1969)`))
+	assert.Equal(t, []string{"messiah"}, aql(`com.example.Composite(val.year=1969 val.author="Frank Herbert")`))
+	assert.ElementsMatch(t, []string{"messiah", "children"}, aql(`com.example.Composite(val.author="Frank Herbert" val.year>1966)`))
+	assert.ElementsMatch(t, []string{"dune", "messiah"}, aql(`com.example.Composite(val.author="Frank Herbert" val.year>1960 val.year<1970)`))
+	assert.Equal(t, []string{"children"}, aql(`com.example.Composite(val.author="Frank Herbert" val.year>1960 val.lang="de")`))
+	assert.Equal(t, []string{"twins"}, aql(`com.example.Composite(val.author="Bob" val.year=2001)`))
+	assert.Equal(t, []string{}, aql(`com.example.Composite(val.author="Isaac Asimov" val.year=1965)`))
+
+	// the old entry is removed when a document changes
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Composite", Id: "dune", Val: map[string]interface{}{
+		"author": "Frank Herbert", "year": 1966,
+	}}))
+	assert.Equal(t, []string{}, aql(`com.example.Composite(val.author="Frank Herbert" val.year=1965)`))
+	assert.Equal(t, []string{"dune"}, aql(`com.example.Composite(val.author="Frank Herbert" val.year=1966)`))
+
+	r := s.kv.Read()
+	defer r.Close()
+	_, err := r.Get(context.Background(), append(append([]byte("c\xffcom.example.Composite\xffval.author,val.year\xffFrank Herbert\xff"),
+		codec.IndexInt(1966)...), []byte("\xffdune\xff")...))
+	assert.NoError(t, err)
+
+	report, err := s.fsck(context.Background(), false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
+
+func TestBackfill_CompositeIndex(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	for id, name := range map[string]string{"a": "x", "b": "y"} {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.Backfill",
+			Id:    id,
+			Val:   map[string]interface{}{"name": name, "n": 1},
+		}))
+	}
+
+	require.NoError(t, putBackfillTestModel(e, s, map[string]interface{}{"name,n": "index"}))
+	assert.Equal(t, "ready", waitForBackfill(t, s).State)
+
+	report, err := s.fsck(context.Background(), false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+
+	r := s.kv.Read()
+	defer r.Close()
+	var y, one interface{} = "y", json.Number("1")
+	res, err := s.query(context.Background(), r, openapi.SearchRequest{
+		Model:   "com.example.Backfill",
+		Filters: &[]openapi.Filter{{Key: "val.name", Equal: &y}, {Key: "val.n", Equal: &one}},
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Documents, 1)
+	assert.Equal(t, "b", res.Documents[0].Id)
+
+	// removing it removes its entries
+	require.NoError(t, putBackfillTestModel(e, s, nil))
+	assert.Equal(t, "ready", waitForBackfill(t, s).State)
+
+	report, err = s.fsck(context.Background(), false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
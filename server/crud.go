@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -10,7 +11,6 @@ import (
 	openapi "github.com/aep/apogy/api/go"
 	"github.com/aep/apogy/kv"
 	"github.com/labstack/echo/v4"
-	tikerr "github.com/tikv/client-go/v2/error"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -65,6 +65,35 @@ func (s *server) PutDocument(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	// a re-encryption rewrites the document without changing it, which fails a put that read it before.
+	// such a put is tried again, a document that was really changed since still fails
+	for attempt := 1; ; attempt++ {
+		try := *doc
+		if doc.Version != nil {
+			version := *doc.Version
+			try.Version = &version
+		}
+		err := s.putDocument(ctx, c, &try, model, path)
+		if !errors.Is(err, errRewritten) {
+			return err
+		}
+		if attempt >= putRewriteRetries {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("preempted by a different parallel write"))
+		}
+	}
+}
+
+// how often a put is tried again after the document was only rewritten in between
+const putRewriteRetries = 3
+
+// errRewritten is a write conflict of a put with a write that did not change the document
+var errRewritten = errors.New("document was rewritten")
+
+// putDocument writes a validated document in one transaction
+func (s *server) putDocument(ctx context.Context, c echo.Context, doc *openapi.Document, model *Model, path []byte) error {
+	span := trace.SpanFromContext(ctx)
+	var err error
+
 	// for contested keys, use pessimistic locking
 	var hotKeys = [][]byte{}
 	if doc.Mut != nil {
@@ -79,12 +108,14 @@ func (s *server) PutDocument(c echo.Context) error {
 	} else {
 		w2, err = s.kv.ExclusiveWrite(ctx, hotKeys...)
 		if err != nil {
-			return err
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 		}
 
-		statLockRetries := w2.(*kv.TikvWrite).Stat()
-		span.SetAttributes(attribute.Int("lockRetries", statLockRetries))
-		kvLockRetries.WithLabelValues("hot", "true").Observe(float64(statLockRetries))
+		if st, ok := w2.(kv.LockStat); ok {
+			statLockRetries := st.Stat()
+			span.SetAttributes(attribute.Int("lockRetries", statLockRetries))
+			kvLockRetries.WithLabelValues("hot", "true").Observe(float64(statLockRetries))
+		}
 	}
 	defer w2.Close()
 
@@ -100,12 +131,12 @@ func (s *server) PutDocument(c echo.Context) error {
 
 		bytes, err := w2.Get(ctx, []byte(path))
 		if err != nil {
-			if !tikerr.IsErrNotFound(err) {
+			if !kv.IsErrNotFound(err) {
 				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 			}
 		} else if len(bytes) > 0 {
 			old = new(openapi.Document)
-			if err := DeserializeStore(bytes, old); err != nil {
+			if err := s.deserializeStore(path, bytes, old); err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("unmarshal error: %v", err))
 			}
 
@@ -134,12 +165,12 @@ func (s *server) PutDocument(c echo.Context) error {
 		bytes, err := r.Get(ctx, []byte(path))
 		r.Close()
 		if err != nil {
-			if !tikerr.IsErrNotFound(err) {
+			if !kv.IsErrNotFound(err) {
 				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 			}
 		} else if len(bytes) > 0 {
 			old = new(openapi.Document)
-			if err := DeserializeStore(bytes, old); err != nil {
+			if err := s.deserializeStore(path, bytes, old); err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("unmarshal error: %v", err))
 			}
 
@@ -155,15 +186,15 @@ func (s *server) PutDocument(c echo.Context) error {
 		}
 	}
 
-	if doc.Version == nil {
-		if old == nil {
-			version := uint64(0)
-			doc.Version = &version
-		} else {
-			doc.Version = old.Version
-		}
+	// a copy, so old keeps the version it was read with
+	version := uint64(0)
+	if doc.Version != nil {
+		version = *doc.Version
+	} else if old != nil && old.Version != nil {
+		version = *old.Version
 	}
-	*doc.Version++
+	version++
+	doc.Version = &version
 
 	var isMut = false
 	if doc.Mut != nil {
@@ -182,19 +213,42 @@ func (s *server) PutDocument(c echo.Context) error {
 		doc.Mut = nil
 	}
 
+	if doc.Expires == nil && model.TTL > 0 {
+		expires := now.Add(model.TTL)
+		doc.Expires = &expires
+	}
+
 	doc, err = s.ro.Validate(ctx, old, doc)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
 	}
 
-	bytes, err := SerializeStore(doc)
+	var backfill bool
+	if doc.Model == "Model" {
+		backfill, err = s.prepareModelIndex(ctx, w2, old, doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	bytes, err := s.serializeStore(path, doc)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("marshal error: %v", err))
 	}
 
 	w2.Put([]byte(path), bytes)
+	if err := s.writeExpiry(w2, old, doc); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
+	}
 
 	if err := s.createIndex(ctx, w2, model, doc); err != nil {
+		if errors.Is(err, errIndexRead) {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
+		}
+		var conflict *uniqueConflict
+		if errors.As(err, &conflict) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error()).SetInternal(conflict)
+		}
 		return echo.NewHTTPError(http.StatusConflict, err.Error())
 	}
 
@@ -206,19 +260,33 @@ func (s *server) PutDocument(c echo.Context) error {
 
 	if err != nil {
 		// Record failed commit metrics
-		if tikerr.IsErrWriteConflict(err) {
+		if kv.IsErrWriteConflict(err) {
 			kvCommitFailures.WithLabelValues("write_transaction", "write_conflict").Inc()
 			if !isMut {
+				if s.unchanged(ctx, path, old) {
+					return errRewritten
+				}
 				return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("preempted by a different parallel write"))
 			} else {
-				return err
+				// the lock should have prevented this
+				return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 			}
+		} else if kv.IsErrTxnTooLarge(err) {
+			kvCommitFailures.WithLabelValues("write_transaction", "txn_too_large").Inc()
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("document is too large to store with its index: %v", err))
 		} else {
 			kvCommitFailures.WithLabelValues("write_transaction", "database_error").Inc()
 			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 		}
 	}
 
+	if doc.Model == "Model" {
+		s.modelCache.Delete(doc.Id)
+		if backfill {
+			go s.runBackfill(doc.Id)
+		}
+	}
+
 	err = s.ro.Reconcile(ctx, old, doc)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
@@ -227,7 +295,26 @@ func (s *server) PutDocument(c echo.Context) error {
 	return c.JSON(http.StatusOK, doc)
 }
 
-func (s *server) GetDocument(c echo.Context, model string, id string) error {
+// unchanged tells if the document at path still has the version of old, or still does not exist if old is nil
+func (s *server) unchanged(ctx context.Context, path []byte, old *openapi.Document) bool {
+	r := s.kv.Read()
+	defer r.Close()
+
+	b, err := r.Get(ctx, path)
+	if kv.IsErrNotFound(err) {
+		return old == nil
+	}
+	if err != nil || old == nil {
+		return false
+	}
+	var cur openapi.Document
+	if err := s.deserializeStore(path, b, &cur); err != nil {
+		return false
+	}
+	return cur.Version != nil && old.Version != nil && *cur.Version == *old.Version
+}
+
+func (s *server) GetDocument(c echo.Context, model string, id string, params openapi.GetDocumentParams) error {
 	ctx, span := tracer.Start(c.Request().Context(), "GetDocument",
 		trace.WithAttributes(
 			attribute.String("model", model),
@@ -236,21 +323,50 @@ func (s *server) GetDocument(c echo.Context, model string, id string) error {
 	)
 	defer span.End()
 
+	if params.AsOf != nil {
+		span.SetAttributes(attribute.String("asOf", params.AsOf.String()))
+	}
+
+	r := s.readAt(params.AsOf)
+	defer r.Close()
+
 	var doc openapi.Document
-	err := s.getDocument(ctx, model, id, &doc)
+	err := s.readDocument(ctx, r, model, id, &doc)
 	if err != nil {
 		span.RecordError(err)
 		return err
 	}
 
+	// expired documents are gone, even if the sweeper did not get to them yet
+	at := time.Now()
+	if params.AsOf != nil {
+		at = *params.AsOf
+	}
+	if isExpired(&doc, at) {
+		return echo.NewHTTPError(http.StatusNotFound, "document not found")
+	}
+
 	if model == "Reactor" {
 		s.ro.Status(ctx, &doc)
 	}
+	if model == "Model" {
+		if err := withBackfillProgress(ctx, r, &doc); err != nil {
+			span.RecordError(err)
+			return err
+		}
+	}
 
 	return c.JSON(http.StatusOK, doc)
 }
 
 func (s *server) getDocument(ctx context.Context, model string, id string, doc *openapi.Document) error {
+	r := s.kv.Read()
+	defer r.Close()
+
+	return s.readDocument(ctx, r, model, id, doc)
+}
+
+func (s *server) readDocument(ctx context.Context, r kv.Read, model string, id string, doc *openapi.Document) error {
 
 	ctx, span := tracer.Start(ctx, "getDocument",
 		trace.WithAttributes(
@@ -266,15 +382,19 @@ func (s *server) getDocument(ctx context.Context, model string, id string, doc *
 		return err
 	}
 
-	r := s.kv.Read()
-	defer r.Close()
-
 	// Add span for database get operation
 	bytes, err := r.Get(ctx, []byte(path))
 
+	if errors.Is(err, kv.ErrHistoryUnavailable) {
+		span.RecordError(err)
+		return readError(err)
+	}
 	if err != nil {
 		span.RecordError(err)
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		if kv.IsErrNotFound(err) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 	}
 	if bytes == nil {
 		notFoundErr := echo.NewHTTPError(http.StatusNotFound, "document not found")
@@ -283,7 +403,7 @@ func (s *server) getDocument(ctx context.Context, model string, id string, doc *
 	}
 
 	// Add span for deserialization
-	err = DeserializeStore(bytes, doc)
+	err = s.deserializeStore(path, bytes, doc)
 
 	if err != nil {
 		span.RecordError(err)
@@ -294,7 +414,17 @@ func (s *server) getDocument(ctx context.Context, model string, id string, doc *
 }
 
 func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
-	ctx, span := tracer.Start(c.Request().Context(), "DeleteDocument",
+	if err := s.deleteDocument(c.Request().Context(), model, id, false); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteDocument removes a document with its index, after the reactors agreed.
+// with onlyExpired, a document that is not expired is left alone and errNotExpired is returned,
+// so the sweeper never deletes a document whose expiry was extended after it looked.
+func (s *server) deleteDocument(ctx context.Context, model string, id string, onlyExpired bool) error {
+	ctx, span := tracer.Start(ctx, "DeleteDocument",
 		trace.WithAttributes(
 			attribute.String("model", model),
 			attribute.String("id", id),
@@ -310,7 +440,7 @@ func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
 
 	w, err := s.kv.ExclusiveWrite(ctx, path)
 	if err != nil {
-		return err
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 	}
 	defer w.Close()
 
@@ -319,8 +449,11 @@ func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
 
 	if err != nil {
 		span.RecordError(err)
-		if tikerr.IsErrNotFound(err) {
-			return c.NoContent(http.StatusOK)
+		if kv.IsErrNotFound(err) {
+			if onlyExpired {
+				return errNotExpired
+			}
+			return nil
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 	}
@@ -331,7 +464,7 @@ func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
 	}
 
 	var doc = new(openapi.Document)
-	err = DeserializeStore(bytes, doc)
+	err = s.deserializeStore(path, bytes, doc)
 
 	if err != nil {
 		span.RecordError(err)
@@ -340,6 +473,10 @@ func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
 
 	span.SetAttributes(attribute.String("document.model", doc.Model))
 
+	if onlyExpired && !isExpired(doc, time.Now()) {
+		return errNotExpired
+	}
+
 	switch doc.Model {
 	case "Model":
 		err := s.checkNothingNeedsModel(ctx, doc.Id)
@@ -378,6 +515,10 @@ func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
 
 	// Delete the document
 	w.Del([]byte(path))
+	if err := s.writeExpiry(w, doc, nil); err != nil {
+		span.RecordError(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("index error: %v", err))
+	}
 
 	// TODO: this should eventually run async with a "about to be deleted" state
 	err = s.ro.Reconcile(ctx, doc, nil)
@@ -397,7 +538,7 @@ func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
 	if err != nil {
 		span.RecordError(err)
 		// Record failed commit
-		if tikerr.IsErrWriteConflict(err) {
+		if kv.IsErrWriteConflict(err) {
 			kvCommitFailures.WithLabelValues("delete_document", "write_conflict").Inc()
 		} else {
 			kvCommitFailures.WithLabelValues("delete_document", "database_error").Inc()
@@ -405,5 +546,5 @@ func (s *server) DeleteDocument(c echo.Context, model string, id string) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("database error: %v", err))
 	}
 
-	return c.NoContent(http.StatusOK)
+	return nil
 }
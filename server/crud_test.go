@@ -2,9 +2,11 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -12,6 +14,7 @@ import (
 	"encoding/json"
 	openapi "github.com/aep/apogy/api/go"
 	"github.com/aep/apogy/bus"
+	"github.com/aep/apogy/codec"
 	"github.com/aep/apogy/kv"
 	"github.com/aep/apogy/reactor"
 	"github.com/labstack/echo/v4"
@@ -20,10 +23,39 @@ import (
 )
 
 func setupTestServer(t *testing.T) (*echo.Echo, *server) {
-	kv, err := kv.NewTikv()
+	backend := os.Getenv("KV_BACKEND")
+	if backend == "" {
+		backend = "memory"
+	}
+	db, err := kv.New(backend, t.TempDir())
 	if err != nil {
 		t.Fatalf("Failed to create test database: %v", err)
 	}
+	t.Cleanup(db.Close)
+	if namespace := os.Getenv("KV_NAMESPACE"); namespace != "" {
+		db, err = kv.WithNamespace(db, namespace)
+		if err != nil {
+			t.Fatalf("Invalid namespace: %v", err)
+		}
+	}
+	// every test gets a database of its own, also on a shared backend
+	db, err = kv.WithNamespace(db, fmt.Sprintf("test-%s-%d", t.Name(), time.Now().UnixNano()))
+	if err != nil {
+		t.Fatalf("Invalid namespace: %v", err)
+	}
+
+	encoding, err := codec.ParseEncoding(os.Getenv("STORAGE_ENCODING"))
+	if err != nil {
+		t.Fatalf("Invalid storage encoding: %v", err)
+	}
+
+	var keys KeyProvider
+	if path := os.Getenv("ENCRYPTION_KEY_FILE"); path != "" {
+		keys, err = NewFileKeyProvider(path)
+		if err != nil {
+			t.Fatalf("Invalid encryption keys: %v", err)
+		}
+	}
 
 	bs, err := bus.NewSolo()
 	if err != nil {
@@ -39,10 +71,12 @@ func setupTestServer(t *testing.T) (*echo.Echo, *server) {
 	}
 
 	s := &server{
-		kv:         kv,
+		kv:         db,
 		bs:         bs,
 		modelCache: cache,
 		ro:         reactor.NewReactor("", "", ""),
+		encoding:   encoding,
+		keys:       keys,
 	}
 	e := echo.New()
 	e.Binder = &Binder{
@@ -60,6 +94,7 @@ func setupTestServer(t *testing.T) (*echo.Echo, *server) {
 		{"Test.com.example", "version-test"},
 		{"Test.com.example", "parallel-test"},
 		{"Test.com.example", "update-test"},
+		{"Test.com.example", "asof-test"},
 	}
 
 	for _, doc := range testDocuments {
@@ -95,6 +130,14 @@ func setupTestServer(t *testing.T) (*echo.Echo, *server) {
 	return e, s
 }
 
+// putTestDoc puts a document like a client would
+func putTestDoc(e *echo.Echo, s *server, doc openapi.Document) error {
+	docBytes, _ := json.Marshal(doc)
+	req := httptest.NewRequest(http.MethodPut, "/documents/"+doc.Model+"/"+doc.Id, bytes.NewReader(docBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	return s.PutDocument(e.NewContext(req, httptest.NewRecorder()))
+}
+
 func TestPutDocument_Model(t *testing.T) {
 	e, s := setupTestServer(t)
 
@@ -129,7 +172,7 @@ func TestPutDocument_Model(t *testing.T) {
 		getContext := e.NewContext(getReq, getRec)
 
 		// Test the GET handler
-		err = s.GetDocument(getContext, "Model", "bob.example.com")
+		err = s.GetDocument(getContext, "Model", "bob.example.com", openapi.GetDocumentParams{})
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, getRec.Code)
 
@@ -193,6 +236,31 @@ func TestPutDocument_InvalidFormat(t *testing.T) {
 	}
 }
 
+func TestPutDocument_TxnTooLarge(t *testing.T) {
+	e, s := setupTestServer(t)
+	s.kv = kv.WithTxnLimits(s.kv, kv.TxnLimits{MaxKeys: 50})
+
+	// every element of the array gets its own index entry
+	tags := make([]interface{}, 100)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%d", i)
+	}
+	docBytes, _ := json.Marshal(openapi.Document{
+		Model: "Test.com.example",
+		Id:    "too-large",
+		Val:   map[string]interface{}{"tags": tags},
+	})
+	req := httptest.NewRequest(http.MethodPut, "/documents/Test.com.example/too-large", bytes.NewReader(docBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+
+	err := s.PutDocument(e.NewContext(req, httptest.NewRecorder()))
+	if assert.Error(t, err) {
+		he, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, he.Code)
+	}
+}
+
 func TestPutDocument_VersionConflict(t *testing.T) {
 	e, s := setupTestServer(t)
 
@@ -257,7 +325,7 @@ func TestPutDocument_ParallelVersionConflict(t *testing.T) {
 	getRec := httptest.NewRecorder()
 	getContext := e.NewContext(getReq, getRec)
 
-	err := s.GetDocument(getContext, "Test.com.example", "parallel-test")
+	err := s.GetDocument(getContext, "Test.com.example", "parallel-test", openapi.GetDocumentParams{})
 	assert.NoError(t, err)
 
 	var storedDoc openapi.Document
@@ -306,7 +374,7 @@ func TestPutDocument_ParallelVersionConflict(t *testing.T) {
 	getRec = httptest.NewRecorder()
 	getContext = e.NewContext(getReq, getRec)
 
-	err = s.GetDocument(getContext, "Test.com.example", "parallel-test")
+	err = s.GetDocument(getContext, "Test.com.example", "parallel-test", openapi.GetDocumentParams{})
 	assert.NoError(t, err)
 
 	var finalDoc openapi.Document
@@ -322,7 +390,7 @@ func TestGetDocument_NotFound(t *testing.T) {
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
 
-	err := s.GetDocument(c, "NonExistent", "id")
+	err := s.GetDocument(c, "NonExistent", "id", openapi.GetDocumentParams{})
 	if assert.Error(t, err) {
 		he, ok := err.(*echo.HTTPError)
 		assert.True(t, ok)
@@ -367,7 +435,7 @@ func TestPutDocument_Update(t *testing.T) {
 	getRec := httptest.NewRecorder()
 	getContext := e.NewContext(getReq, getRec)
 
-	err := s.GetDocument(getContext, "Test.com.example", "update-test")
+	err := s.GetDocument(getContext, "Test.com.example", "update-test", openapi.GetDocumentParams{})
 	assert.NoError(t, err)
 
 	var storedDoc openapi.Document
@@ -388,6 +456,70 @@ func TestPutDocument_Update(t *testing.T) {
 	assert.Equal(t, uint64(2), *storedDoc.Version)
 }
 
+func TestGetDocument_AsOf(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	put := func(data string) {
+		assert.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "Test.com.example",
+			Id:    "asof-test",
+			Val:   &map[string]interface{}{"data": data},
+		}))
+	}
+
+	put("initial")
+	time.Sleep(50 * time.Millisecond)
+	then := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	put("updated")
+
+	getReq := httptest.NewRequest(http.MethodGet, "/documents/Test.com.example/asof-test", nil)
+	getRec := httptest.NewRecorder()
+	err := s.GetDocument(e.NewContext(getReq, getRec), "Test.com.example", "asof-test", openapi.GetDocumentParams{AsOf: &then})
+	if errors.Is(err, kv.ErrHistoryUnavailable) {
+		t.Skip("kv backend does not keep history")
+	}
+	assert.NoError(t, err)
+
+	var storedDoc openapi.Document
+	assert.NoError(t, json.Unmarshal(getRec.Body.Bytes(), &storedDoc))
+	assert.Equal(t, map[string]interface{}{"data": "initial"}, storedDoc.Val)
+	assert.Equal(t, uint64(1), *storedDoc.Version)
+
+	// before history, the request is rejected instead of pretending the document did not exist
+	longAgo := time.Now().Add(-365 * 24 * time.Hour)
+	getRec = httptest.NewRecorder()
+	err = s.GetDocument(e.NewContext(getReq, getRec), "Test.com.example", "asof-test", openapi.GetDocumentParams{AsOf: &longAgo})
+	if assert.Error(t, err) {
+		he, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusBadRequest, he.Code)
+	}
+}
+
+func TestGetDocument_AsOfLevelDB(t *testing.T) {
+	t.Setenv("KV_BACKEND", "leveldb")
+	e, s := setupTestServer(t)
+
+	assert.NoError(t, putTestDoc(e, s, openapi.Document{Model: "Test.com.example", Id: "asof-test"}))
+
+	// leveldb keeps no history, so any time in the past is rejected like one before the history of tikv
+	then := time.Now().Add(-time.Second)
+	getReq := httptest.NewRequest(http.MethodGet, "/documents/Test.com.example/asof-test", nil)
+	err := s.GetDocument(e.NewContext(getReq, httptest.NewRecorder()), "Test.com.example", "asof-test", openapi.GetDocumentParams{AsOf: &then})
+	if assert.Error(t, err) {
+		he, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusBadRequest, he.Code)
+		assert.ErrorIs(t, err, kv.ErrHistoryUnavailable)
+	}
+
+	// a time in the future reads the latest commit
+	later := time.Now().Add(time.Hour)
+	err = s.GetDocument(e.NewContext(getReq, httptest.NewRecorder()), "Test.com.example", "asof-test", openapi.GetDocumentParams{AsOf: &later})
+	assert.NoError(t, err)
+}
+
 func TestConcurrentMutations_NeverFail(t *testing.T) {
 	e, s := setupTestServer(t)
 
@@ -451,7 +583,7 @@ func TestConcurrentMutations_NeverFail(t *testing.T) {
 	getRec := httptest.NewRecorder()
 	getContext := e.NewContext(getReq, getRec)
 
-	err := s.GetDocument(getContext, "Test.com.example", docId)
+	err := s.GetDocument(getContext, "Test.com.example", docId, openapi.GetDocumentParams{})
 	assert.NoError(t, err)
 
 	var finalDoc openapi.Document
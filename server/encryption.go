@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aep/apogy/codec"
+	"github.com/aep/apogy/kv"
+)
+
+// documents can be encrypted at rest with envelope encryption.
+// every record gets its own random data key, which encrypts the serialized document.
+// the data key itself is encrypted with a key from the KeyProvider and stored next to it:
+//
+//	'e' | len(key id) | key id | nonce + encrypted data key | nonce + encrypted document
+//
+// the document is bound to its database path, so records can not be swapped between documents.
+// the encrypted document is a complete record with its own encoding byte.
+
+// KeyProvider supplies the keys that encrypt the data keys of stored documents
+type KeyProvider interface {
+	// CurrentKey returns the key new records are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id, to read records written before a rotation
+	Key(id string) ([]byte, error)
+}
+
+// FileKeyProvider reads keys from a file with one key per line:
+//
+//	<id> <base64 encoded 32 byte key>
+//
+// the last key in the file is the current one. to rotate, append a new key.
+// older keys must stay in the file until the re-encryption pass moved all records off them.
+type FileKeyProvider struct {
+	path string
+
+	lk      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the key file again, to pick up a rotation without a restart
+func (p *FileKeyProvider) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("cannot read encryption keys: %w", err)
+	}
+	defer f.Close()
+
+	keys := make(map[string][]byte)
+	var current string
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, b64, ok := strings.Cut(line, " ")
+		if !ok || len(id) > 255 {
+			return fmt.Errorf("%s:%d: expected '<id> <base64 key>'", p.path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("%s:%d: key must be 32 bytes of base64", p.path, n)
+		}
+		keys[id] = key
+		current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read encryption keys: %w", err)
+	}
+	if current == "" {
+		return fmt.Errorf("%s: no encryption keys", p.path)
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.keys = keys
+	p.current = current
+	return nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is not available", id)
+	}
+	return key, nil
+}
+
+func gcmSeal(key []byte, plain []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plain)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, aad), nil
+}
+
+func gcmOpen(key []byte, sealed []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted record too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// nonce, 32 byte data key and gcm tag
+const sealedDataKeySize = 12 + 32 + 16
+
+func sealStore(keys KeyProvider, path []byte, record []byte) ([]byte, error) {
+	id, kek, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+
+	sealedDek, err := gcmSeal(kek, dek, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	body, err := gcmSeal(dek, record, path)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 2+len(id)+len(sealedDek)+len(body))
+	out = append(out, 'e', byte(len(id)))
+	out = append(out, id...)
+	out = append(out, sealedDek...)
+	out = append(out, body...)
+	return out, nil
+}
+
+// sealedKeyID returns the id of the key an encrypted record was written with
+func sealedKeyID(b []byte) (string, bool) {
+	if len(b) < 2 || b[0] != 'e' || len(b) < 2+int(b[1]) {
+		return "", false
+	}
+	return string(b[2 : 2+int(b[1])]), true
+}
+
+func openStore(keys KeyProvider, path []byte, b []byte) ([]byte, error) {
+	id, ok := sealedKeyID(b)
+	if !ok || len(b) < 2+len(id)+sealedDataKeySize {
+		return nil, errors.New("invalid encrypted record in database")
+	}
+	if keys == nil {
+		return nil, codec.ErrEncrypted
+	}
+
+	kek, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	b = b[2+len(id):]
+	dek, err := gcmOpen(kek, b[:sealedDataKeySize], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt data key: %w", err)
+	}
+	record, err := gcmOpen(dek, b[sealedDataKeySize:], path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt document: %w", err)
+	}
+	return record, nil
+}
+
+// how many documents the re-encryption pass reads before it saves its progress
+const reencryptBatchSize = 100
+
+// the progress of the re-encryption pass, stored under taskKey("reencrypt").
+// a pass is done when every document was encrypted with Key and Cursor is empty
+type reencryptState struct {
+	Key    string `json:"key"`
+	Cursor []byte `json:"cursor,omitempty"`
+}
+
+// reencrypt rewrites every document that is not encrypted with the current key,
+// so old keys can be removed after a rotation, and existing plain documents get encrypted.
+// a pass only runs after the current key changed, after a start, or after a plain document was read,
+// and continues from where the previous one stopped.
+// every document is rewritten under the lock a mut put takes. a plain put that read the document before
+// fails to commit, and is tried again by PutDocument, because the version did not change.
+func (s *server) reencrypt(ctx context.Context) (int, error) {
+	if s.keys == nil {
+		return 0, nil
+	}
+	current, _, err := s.keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	state, err := s.reencryptState(ctx)
+	if err != nil {
+		return 0, err
+	}
+	plain := s.plainSeen.Swap(false)
+	if state.Key != current {
+		state = reencryptState{Key: current}
+	} else if state.Cursor == nil && !plain {
+		return 0, nil
+	}
+
+	stale := func(b []byte) bool {
+		id, ok := sealedKeyID(b)
+		return !ok || id != current
+	}
+
+	total := 0
+	start := []byte{'o', 0xff}
+	if state.Cursor != nil {
+		start = state.Cursor
+	}
+	end := []byte{'p'}
+
+	for {
+		// find the next batch in a read, so nothing is locked while scanning
+		var paths [][]byte
+		var next []byte
+		r := s.kv.Read()
+		for kv, err := range r.Iter(ctx, start, end) {
+			if err != nil {
+				r.Close()
+				return total, err
+			}
+			next = append(bytes.Clone(kv.K), 0)
+			if stale(kv.V) {
+				paths = append(paths, bytes.Clone(kv.K))
+			}
+			if len(paths) >= reencryptBatchSize {
+				break
+			}
+		}
+		r.Close()
+
+		for _, path := range paths {
+			ok, err := s.reencryptDocument(ctx, path, stale)
+			if err != nil {
+				return total, err
+			}
+			if ok {
+				total++
+			}
+		}
+
+		if next == nil || len(paths) < reencryptBatchSize {
+			state.Cursor = nil
+		} else {
+			state.Cursor = next
+		}
+		if err := s.saveReencryptState(ctx, state); err != nil {
+			return total, err
+		}
+		if state.Cursor == nil {
+			return total, nil
+		}
+		start = next
+	}
+}
+
+func (s *server) reencryptState(ctx context.Context) (reencryptState, error) {
+	var state reencryptState
+	r := s.kv.Read()
+	defer r.Close()
+
+	b, err := r.Get(ctx, taskKey("reencrypt"))
+	if err != nil {
+		if kv.IsErrNotFound(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("invalid re-encryption state: %w", err)
+	}
+	return state, nil
+}
+
+func (s *server) saveReencryptState(ctx context.Context, state reencryptState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	w := s.kv.Write()
+	defer w.Close()
+	if err := w.Put(taskKey("reencrypt"), b); err != nil {
+		return err
+	}
+	return w.Commit(ctx)
+}
+
+// reencryptDocument rewrites a single document with the current key, unless it was written with it since
+func (s *server) reencryptDocument(ctx context.Context, path []byte, stale func([]byte) bool) (bool, error) {
+	w, err := s.kv.ExclusiveWrite(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer w.Close()
+
+	b, err := w.Get(ctx, path)
+	if err != nil {
+		if kv.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !stale(b) {
+		return false, nil
+	}
+
+	record := b
+	if b[0] == 'e' {
+		record, err = openStore(s.keys, path, b)
+		if err != nil {
+			return false, err
+		}
+	}
+	sealed, err := sealStore(s.keys, path, record)
+	if err != nil {
+		return false, err
+	}
+	if err := w.Put(path, sealed); err != nil {
+		return false, err
+	}
+	if err := w.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reencryptLoop picks up key rotations and re-encrypts in the background.
+// after an error it waits twice as long before the next attempt, up to an hour
+func (s *server) reencryptLoop(interval time.Duration) {
+	wait := interval
+	for {
+		if r, ok := s.keys.(interface{ Reload() error }); ok {
+			if err := r.Reload(); err != nil {
+				slog.Error("[encryption] cannot reload keys", "err", err)
+			}
+		}
+
+		n, err := s.reencrypt(context.Background())
+		if err != nil {
+			slog.Error("[encryption] re-encryption failed", "err", err, "retry", wait*2)
+			wait = min(wait*2, time.Hour)
+		} else {
+			wait = interval
+			if n > 0 {
+				slog.Info("[encryption] re-encrypted documents", "count", n)
+			}
+		}
+
+		time.Sleep(wait)
+	}
+}
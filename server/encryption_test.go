@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestKey(t *testing.T, path string, id string) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(id + " " + base64.StdEncoding.EncodeToString(key) + "\n")
+	require.NoError(t, err)
+}
+
+func putEncryptionTestDoc(t *testing.T, e *echo.Echo, s *server, id string, secret string) {
+	doc := openapi.Document{
+		Model: "Test.com.example",
+		Id:    id,
+		Val:   &map[string]interface{}{"secret": secret},
+	}
+	docBytes, _ := json.Marshal(doc)
+	req := httptest.NewRequest(http.MethodPut, "/documents/Test.com.example/"+id, bytes.NewReader(docBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	require.NoError(t, s.PutDocument(e.NewContext(req, httptest.NewRecorder())))
+}
+
+func getEncryptionTestDoc(t *testing.T, e *echo.Echo, s *server, id string) (openapi.Document, error) {
+	req := httptest.NewRequest(http.MethodGet, "/documents/Test.com.example/"+id, nil)
+	rec := httptest.NewRecorder()
+	err := s.GetDocument(e.NewContext(req, rec), "Test.com.example", id, openapi.GetDocumentParams{})
+	var doc openapi.Document
+	if err == nil {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	}
+	return doc, err
+}
+
+// the tests bring their own keys, instead of the ones in ENCRYPTION_KEY_FILE
+func setupEncryptionTestServer(t *testing.T) (*echo.Echo, *server) {
+	t.Setenv("ENCRYPTION_KEY_FILE", "")
+	return setupTestServer(t)
+}
+
+func rawEncryptionTestDoc(t *testing.T, s *server, id string) []byte {
+	path, err := safeDBPath("Test.com.example", id)
+	require.NoError(t, err)
+	r := s.kv.Read()
+	defer r.Close()
+	b, err := r.Get(context.Background(), path)
+	require.NoError(t, err)
+	return b
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	e, s := setupEncryptionTestServer(t)
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeTestKey(t, keyFile, "k1")
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+	s.keys = keys
+
+	putEncryptionTestDoc(t, e, s, "enc-test", "hunter2")
+
+	raw := rawEncryptionTestDoc(t, s, "enc-test")
+	assert.Equal(t, byte('e'), raw[0])
+	assert.NotContains(t, string(raw), "hunter2")
+
+	doc, err := getEncryptionTestDoc(t, e, s, "enc-test")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"secret": "hunter2"}, doc.Val)
+
+	// updates decrypt the old version to diff the index
+	putEncryptionTestDoc(t, e, s, "enc-test", "hunter3")
+	doc, err = getEncryptionTestDoc(t, e, s, "enc-test")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"secret": "hunter3"}, doc.Val)
+
+	// without the key, the document can not be read
+	s.keys = nil
+	_, err = getEncryptionTestDoc(t, e, s, "enc-test")
+	assert.Error(t, err)
+}
+
+func TestEncryption_Rotation(t *testing.T) {
+	e, s := setupEncryptionTestServer(t)
+	ctx := context.Background()
+
+	// written before encryption was enabled
+	putEncryptionTestDoc(t, e, s, "enc-plain", "plain")
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeTestKey(t, keyFile, "k1")
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+	s.keys = keys
+
+	putEncryptionTestDoc(t, e, s, "enc-old", "old")
+
+	_, err = s.reencrypt(ctx)
+	require.NoError(t, err)
+	id, ok := sealedKeyID(rawEncryptionTestDoc(t, s, "enc-plain"))
+	assert.True(t, ok)
+	assert.Equal(t, "k1", id)
+
+	// rotate
+	writeTestKey(t, keyFile, "k2")
+	require.NoError(t, keys.Reload())
+
+	n, err := s.reencrypt(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, n, 2)
+
+	for _, docID := range []string{"enc-plain", "enc-old"} {
+		id, ok := sealedKeyID(rawEncryptionTestDoc(t, s, docID))
+		assert.True(t, ok)
+		assert.Equal(t, "k2", id)
+	}
+
+	// nothing left to do
+	n, err = s.reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// the old key is no longer needed
+	b, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	require.NoError(t, os.WriteFile(keyFile, lines[1], 0600))
+	require.NoError(t, keys.Reload())
+
+	doc, err := getEncryptionTestDoc(t, e, s, "enc-old")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"secret": "old"}, doc.Val)
+}
+
+func TestEncryption_OnlyAfterRotation(t *testing.T) {
+	e, s := setupEncryptionTestServer(t)
+	ctx := context.Background()
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeTestKey(t, keyFile, "k1")
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+	s.keys = keys
+
+	putEncryptionTestDoc(t, e, s, "enc-a", "a")
+	_, err = s.reencrypt(ctx)
+	require.NoError(t, err)
+
+	// written by a server without keys, the pass does not know about it yet
+	s.keys = nil
+	putEncryptionTestDoc(t, e, s, "enc-b", "b")
+	s.keys = keys
+
+	n, err := s.reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, ok := sealedKeyID(rawEncryptionTestDoc(t, s, "enc-b"))
+	assert.False(t, ok)
+
+	// reading it does
+	_, err = getEncryptionTestDoc(t, e, s, "enc-b")
+	require.NoError(t, err)
+
+	n, err = s.reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	id, ok := sealedKeyID(rawEncryptionTestDoc(t, s, "enc-b"))
+	assert.True(t, ok)
+	assert.Equal(t, "k1", id)
+}
+
+func TestEncryption_BoundToPath(t *testing.T) {
+	e, s := setupEncryptionTestServer(t)
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeTestKey(t, keyFile, "k1")
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+	s.keys = keys
+
+	putEncryptionTestDoc(t, e, s, "enc-a", "a")
+	putEncryptionTestDoc(t, e, s, "enc-b", "b")
+
+	// copying the record of one document over another must not decrypt
+	pathB, err := safeDBPath("Test.com.example", "enc-b")
+	require.NoError(t, err)
+	w := s.kv.Write()
+	require.NoError(t, w.Put(pathB, rawEncryptionTestDoc(t, s, "enc-a")))
+	require.NoError(t, w.Commit(context.Background()))
+	w.Close()
+
+	_, err = getEncryptionTestDoc(t, e, s, "enc-b")
+	assert.Error(t, err)
+}
+
+func TestEncryption_KeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+
+	_, err := NewFileKeyProvider(keyFile)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("# comment\n\nk1 c2hvcnQ=\n"), 0600))
+	_, err = NewFileKeyProvider(keyFile)
+	assert.Error(t, err, "short keys are rejected")
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("# comment\n"), 0600))
+	writeTestKey(t, keyFile, "k1")
+	writeTestKey(t, keyFile, "k2")
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+
+	id, _, err := keys.CurrentKey()
+	require.NoError(t, err)
+	assert.Equal(t, "k2", id)
+	_, err = keys.Key("k1")
+	assert.NoError(t, err)
+	_, err = keys.Key("k3")
+	assert.Error(t, err)
+}
+
+func TestEncryption_PlainAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeTestKey(t, keyFile, "k1")
+
+	s, err := newServer("leveldb", dir, "", "", keyFile)
+	require.NoError(t, err)
+	_, err = s.reencrypt(ctx)
+	require.NoError(t, err)
+
+	// written past this server, like by one without keys
+	path, err := safeDBPath("Test.com.example", "enc-plain")
+	require.NoError(t, err)
+	b, err := codec.SerializeStore(&openapi.Document{Model: "Test.com.example", Id: "enc-plain"}, codec.Encoding{})
+	require.NoError(t, err)
+	w := s.kv.Write()
+	require.NoError(t, w.Put(path, b))
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	n, err := s.reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	s.kv.Close()
+
+	// the next start finds it
+	s, err = newServer("leveldb", dir, "", "", keyFile)
+	require.NoError(t, err)
+	defer s.kv.Close()
+	n, err = s.reencrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	r := s.kv.Read()
+	defer r.Close()
+	b, err = r.Get(ctx, path)
+	require.NoError(t, err)
+	id, ok := sealedKeyID(b)
+	assert.True(t, ok)
+	assert.Equal(t, "k1", id)
+}
+
+// hookKV runs hook before the next commit of a Write, once
+type hookKV struct {
+	kv.KV
+	hook func()
+}
+
+type hookWrite struct {
+	kv.Write
+	k *hookKV
+}
+
+func (k *hookKV) Write() kv.Write {
+	return &hookWrite{Write: k.KV.Write(), k: k}
+}
+
+func (w *hookWrite) Commit(ctx context.Context) error {
+	if hook := w.k.hook; hook != nil {
+		w.k.hook = nil
+		hook()
+	}
+	return w.Write.Commit(ctx)
+}
+
+func TestEncryption_PutDuringReencrypt(t *testing.T) {
+	e, s := setupEncryptionTestServer(t)
+	ctx := context.Background()
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeTestKey(t, keyFile, "k1")
+	keys, err := NewFileKeyProvider(keyFile)
+	require.NoError(t, err)
+	s.keys = keys
+
+	putEncryptionTestDoc(t, e, s, "enc-a", "a")
+	writeTestKey(t, keyFile, "k2")
+	require.NoError(t, keys.Reload())
+
+	hooked := &hookKV{KV: s.kv}
+	s.kv = hooked
+	path, err := safeDBPath("Test.com.example", "enc-a")
+	require.NoError(t, err)
+
+	// re-encrypted between the read and the commit of a plain put, which is tried again
+	hooked.hook = func() {
+		ok, err := s.reencryptDocument(ctx, path, func([]byte) bool { return true })
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	putEncryptionTestDoc(t, e, s, "enc-a", "b")
+	doc, err := getEncryptionTestDoc(t, e, s, "enc-a")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"secret": "b"}, doc.Val)
+	assert.Equal(t, uint64(2), *doc.Version)
+
+	// changed in between, which still fails
+	hooked.hook = func() {
+		putEncryptionTestDoc(t, e, s, "enc-a", "c")
+	}
+	docBytes, _ := json.Marshal(openapi.Document{Model: "Test.com.example", Id: "enc-a", Val: &map[string]interface{}{"secret": "d"}})
+	req := httptest.NewRequest(http.MethodPut, "/documents/Test.com.example/enc-a", bytes.NewReader(docBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	err = s.PutDocument(e.NewContext(req, httptest.NewRecorder()))
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusConflict, err.(*echo.HTTPError).Code)
+	}
+}
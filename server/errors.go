@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/labstack/echo/v4"
+)
+
+// httpErrorHandler is the default of echo, except that a unique conflict also names the document that has the value
+func httpErrorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		var he *echo.HTTPError
+		var conflict *uniqueConflict
+		if c.Response().Committed || !errors.As(err, &he) || !errors.As(he.Internal, &conflict) {
+			e.DefaultHTTPErrorHandler(err, c)
+			return
+		}
+
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(he.Code)
+		} else {
+			message := fmt.Sprint(he.Message)
+			err = c.JSON(he.Code, openapi.ErrorResponse{
+				Message: &message,
+				Conflict: &openapi.UniqueConflict{
+					Model: conflict.Model,
+					Id:    conflict.Id,
+					Index: conflict.Index,
+				},
+			})
+		}
+		if err != nil {
+			e.Logger.Error(err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+)
+
+// documents with an expiry get two extra keys, written in the same transaction as the document:
+//
+//	e 0xff model 0xff id 0xff               -> expiry, so search can hide expired documents without loading them
+//	x 0xff expiry model 0xff id 0xff        -> in order of expiry, for the sweeper
+//
+// expiry is the unix time in nanoseconds as 8 bytes big endian, so it sorts by time.
+
+// how many expired documents the sweeper collects per read
+const sweepBatchSize = 100
+
+var errNotExpired = errors.New("document is not expired")
+
+func isExpired(doc *openapi.Document, at time.Time) bool {
+	return doc != nil && doc.Expires != nil && !at.Before(*doc.Expires)
+}
+
+func expiryBytes(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func expiryKey(model string, id string) []byte {
+	return []byte("e\xff" + model + "\xff" + id + "\xff")
+}
+
+func expirySweepKey(t time.Time, model string, id string) []byte {
+	k := []byte("x\xff")
+	k = append(k, expiryBytes(t)...)
+	k = append(k, []byte(model+"\xff"+id+"\xff")...)
+	return k
+}
+
+// writeExpiry replaces the expiry keys of old with the ones of doc. either may be nil
+func (s *server) writeExpiry(w kv.Write, old *openapi.Document, doc *openapi.Document) error {
+	if old != nil && old.Expires != nil {
+		if err := w.Del(expiryKey(old.Model, old.Id)); err != nil {
+			return err
+		}
+		if err := w.Del(expirySweepKey(*old.Expires, old.Model, old.Id)); err != nil {
+			return err
+		}
+	}
+	if doc != nil && doc.Expires != nil {
+		if err := w.Put(expiryKey(doc.Model, doc.Id), expiryBytes(*doc.Expires)); err != nil {
+			return err
+		}
+		if err := w.Put(expirySweepKey(*doc.Expires, doc.Model, doc.Id), []byte(doc.Id+"\xff")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasExpired tells if the document with the id is past its expiry at the given time, also when it is not swept yet
+func hasExpired(ctx context.Context, r kv.Read, model string, id string, at time.Time) (bool, error) {
+	v, err := r.Get(ctx, expiryKey(model, id))
+	if kv.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Compare(v, expiryBytes(at)) <= 0, nil
+}
+
+// dropExpired removes documents that expired at the given time from a search result
+func (s *server) dropExpired(ctx context.Context, r kv.Read, docs []openapi.Document, at time.Time) ([]openapi.Document, error) {
+	if len(docs) == 0 {
+		return docs, nil
+	}
+
+	keys := make([][]byte, len(docs))
+	for i, doc := range docs {
+		keys[i] = expiryKey(doc.Model, doc.Id)
+	}
+	vals, err := r.BatchGet(ctx, keys)
+	if err != nil {
+		return nil, readError(err)
+	}
+	if len(vals) == 0 {
+		return docs, nil
+	}
+
+	now := expiryBytes(at)
+	ret := docs[:0]
+	for i, doc := range docs {
+		if v, ok := vals[string(keys[i])]; ok && bytes.Compare(v, now) <= 0 {
+			continue
+		}
+		ret = append(ret, doc)
+	}
+	return ret, nil
+}
+
+// sweepExpired deletes documents that are past their expiry through deleteDocument,
+// so reactors see the delete like any other. it returns how many were deleted
+func (s *server) sweepExpired(ctx context.Context) (int, error) {
+	total := 0
+	start := []byte("x\xff")
+	end := append([]byte("x\xff"), expiryBytes(time.Now())...)
+
+	for {
+		var due [][]byte
+		r := s.kv.Read()
+		for kv, err := range r.Iter(ctx, start, end, kv.KeysOnly) {
+			if err != nil {
+				r.Close()
+				return total, err
+			}
+			due = append(due, bytes.Clone(kv.K))
+			if len(due) >= sweepBatchSize {
+				break
+			}
+		}
+		r.Close()
+
+		if len(due) == 0 {
+			return total, nil
+		}
+		// keys that could not be deleted are skipped until the next pass
+		start = append(bytes.Clone(due[len(due)-1]), 0)
+
+		for _, k := range due {
+			parts := bytes.Split(k[2+8:], []byte{0xff})
+			if len(parts) < 2 {
+				continue
+			}
+			model, id := string(parts[0]), string(parts[1])
+
+			err := s.deleteDocument(ctx, model, id, true)
+			if err == nil {
+				total++
+				continue
+			}
+			if !errors.Is(err, errNotExpired) {
+				// a reactor may refuse the delete. it is tried again on the next pass
+				slog.Warn("[expiry] cannot delete expired document", "model", model, "id", id, "err", err)
+				continue
+			}
+
+			// the document was written again with a later expiry, or is gone.
+			// either way this key is not its current one
+			w := s.kv.Write()
+			w.Del(k)
+			err = w.Commit(ctx)
+			w.Close()
+			if err != nil && !kv.IsErrWriteConflict(err) {
+				return total, err
+			}
+		}
+	}
+}
+
+// sweepExpiredLoop deletes expired documents in the background
+func (s *server) sweepExpiredLoop(interval time.Duration) {
+	for {
+		n, err := s.sweepExpired(context.Background())
+		if err != nil {
+			slog.Error("[expiry] sweep failed", "err", err)
+		} else if n > 0 {
+			slog.Info("[expiry] deleted expired documents", "count", n)
+		}
+		time.Sleep(interval)
+	}
+}
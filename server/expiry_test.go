@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func searchExpiryTestDocs(t *testing.T, e *echo.Echo, s *server) []string {
+	reqBytes, _ := json.Marshal(openapi.SearchRequest{Model: "Test.com.example"})
+	req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.SearchDocuments(e.NewContext(req, rec)))
+	var response openapi.SearchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	var ids []string
+	for _, doc := range response.Documents {
+		ids = append(ids, doc.Id)
+	}
+	return ids
+}
+
+func TestExpiry_HiddenAndSwept(t *testing.T) {
+	e, s := setupTestServer(t)
+	ctx := context.Background()
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Test.com.example", Id: "expiry-gone", Expires: &past,
+		Val: map[string]interface{}{"data": "gone"},
+	}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Test.com.example", Id: "expiry-kept", Expires: &future,
+		Val: map[string]interface{}{"data": "kept"},
+	}))
+	t.Cleanup(func() {
+		s.deleteDocument(ctx, "Test.com.example", "expiry-kept", false)
+	})
+
+	// hidden before the sweeper runs
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	err := s.GetDocument(e.NewContext(req, httptest.NewRecorder()), "Test.com.example", "expiry-gone", openapi.GetDocumentParams{})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+	assert.NoError(t, s.GetDocument(e.NewContext(req, httptest.NewRecorder()), "Test.com.example", "expiry-kept", openapi.GetDocumentParams{}))
+
+	ids := searchExpiryTestDocs(t, e, s)
+	assert.NotContains(t, ids, "expiry-gone")
+	assert.Contains(t, ids, "expiry-kept")
+
+	n, err := s.sweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	r := s.kv.Read()
+	defer r.Close()
+	path, _ := safeDBPath("Test.com.example", "expiry-gone")
+	_, err = r.Get(ctx, path)
+	assert.True(t, kv.IsErrNotFound(err))
+	_, err = r.Get(ctx, expiryKey("Test.com.example", "expiry-gone"))
+	assert.True(t, kv.IsErrNotFound(err))
+	_, err = r.Get(ctx, expirySweepKey(past, "Test.com.example", "expiry-gone"))
+	assert.True(t, kv.IsErrNotFound(err))
+}
+
+func TestExpiry_ExtendedBeforeSweep(t *testing.T) {
+	e, s := setupTestServer(t)
+	ctx := context.Background()
+
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Test.com.example", Id: "expiry-extended", Expires: &future,
+		Val: map[string]interface{}{"data": "extended"},
+	}))
+	t.Cleanup(func() {
+		s.deleteDocument(ctx, "Test.com.example", "expiry-extended", false)
+	})
+
+	// as if the sweeper saw an older expiry just before the document was written again
+	past := time.Now().Add(-time.Minute)
+	stale := expirySweepKey(past, "Test.com.example", "expiry-extended")
+	w := s.kv.Write()
+	require.NoError(t, w.Put(stale, []byte("expiry-extended\xff")))
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	n, err := s.sweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	r := s.kv.Read()
+	defer r.Close()
+	path, _ := safeDBPath("Test.com.example", "expiry-extended")
+	_, err = r.Get(ctx, path)
+	assert.NoError(t, err)
+	_, err = r.Get(ctx, stale)
+	assert.True(t, kv.IsErrNotFound(err))
+}
+
+func TestExpiry_ModelTTL(t *testing.T) {
+	e, s := setupTestServer(t)
+	ctx := context.Background()
+
+	assert.Error(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model", Id: "com.example.Session",
+		Val: map[string]interface{}{"ttl": "forever"},
+	}))
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model", Id: "com.example.Session",
+		Val: map[string]interface{}{"ttl": "1h"},
+	}))
+	t.Cleanup(func() {
+		s.deleteDocument(context.Background(), "Model", "com.example.Session", false)
+	})
+
+	before := time.Now()
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Session", Id: "s1",
+		Val: map[string]interface{}{"user": "bob"},
+	}))
+	t.Cleanup(func() {
+		s.deleteDocument(context.Background(), "com.example.Session", "s1", false)
+	})
+	var doc openapi.Document
+	require.NoError(t, s.getDocument(ctx, "com.example.Session", "s1", &doc))
+	require.NotNil(t, doc.Expires)
+	assert.WithinDuration(t, before.Add(time.Hour), *doc.Expires, time.Minute)
+
+	// an explicit expiry wins over the model
+	soon := time.Now().Add(time.Minute)
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Session", Id: "s1", Expires: &soon,
+		Val: map[string]interface{}{"user": "alice"},
+	}))
+	require.NoError(t, s.getDocument(ctx, "com.example.Session", "s1", &doc))
+	assert.WithinDuration(t, soon, *doc.Expires, time.Second)
+}
+
+func TestExpiry_UniqueClaim(t *testing.T) {
+	e, s := setupTestServer(t)
+	ctx := context.Background()
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model", Id: "com.example.Coupon",
+		Val: map[string]interface{}{
+			"ttl":   "1h",
+			"index": map[string]interface{}{"code": "unique", "shop,sku": "unique"},
+		},
+	}))
+
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Coupon", Id: "old", Expires: &past,
+		Val: map[string]interface{}{"code": "SAVE10", "shop": "acme", "sku": "x1"},
+	}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Coupon", Id: "live",
+		Val: map[string]interface{}{"code": "SAVE20"},
+	}))
+
+	// the expired document no longer holds its values, even before the sweeper ran
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Coupon", Id: "new",
+		Val: map[string]interface{}{"code": "SAVE10", "shop": "acme", "sku": "x1"},
+	}))
+	err := putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Coupon", Id: "other",
+		Val: map[string]interface{}{"code": "SAVE20"},
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusConflict, err.(*echo.HTTPError).Code)
+	}
+
+	report, err := s.fsck(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+
+	// sweeping the expired document leaves the values to the new one
+	n, err := s.sweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	err = putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Coupon", Id: "other",
+		Val: map[string]interface{}{"code": "SAVE10"},
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusConflict, err.(*echo.HTTPError).Code)
+	}
+
+	report, err = s.fsck(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withFaults injects faults into the database of a test server
+func withFaults(t *testing.T, e *echo.Echo, s *server) *kv.FaultKV {
+	faults := kv.WithFaults(s.kv, 1)
+	s.kv = faults
+
+	// every path is unique, so a half written index shows up in fsck
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.Fault",
+		Val: map[string]interface{}{
+			"schema": map[string]interface{}{"name?": "string", "n?": "uint64"},
+			"index":  map[string]interface{}{"name": "unique"},
+		},
+	}))
+	return faults
+}
+
+func faultStatus(t *testing.T, err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	he, ok := err.(*echo.HTTPError)
+	require.True(t, ok, "not an http error: %v", err)
+	return he.Code
+}
+
+func assertIndexConsistent(t *testing.T, s *server, faults *kv.FaultKV) *FsckReport {
+	faults.Set(kv.Faults{})
+	report, err := s.fsck(context.Background(), false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+	return report
+}
+
+func TestFaults_CommitConflict(t *testing.T) {
+	e, s := setupTestServer(t)
+	faults := withFaults(t, e, s)
+	before := assertIndexConsistent(t, s, faults)
+
+	faults.Set(kv.Faults{CommitConflict: 1})
+	err := putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Fault", Id: "a",
+		Val: map[string]interface{}{"name": "a"},
+	})
+	assert.Equal(t, http.StatusConflict, faultStatus(t, err))
+
+	report := assertIndexConsistent(t, s, faults)
+	assert.Equal(t, before.Documents, report.Documents)
+}
+
+func TestFaults_CommitAmbiguous(t *testing.T) {
+	e, s := setupTestServer(t)
+	faults := withFaults(t, e, s)
+	before := assertIndexConsistent(t, s, faults)
+
+	faults.Set(kv.Faults{CommitAmbiguous: 1})
+	err := putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Fault", Id: "a",
+		Val: map[string]interface{}{"name": "a"},
+	})
+	assert.Equal(t, http.StatusInternalServerError, faultStatus(t, err))
+
+	// the write went through after all, with its index
+	report := assertIndexConsistent(t, s, faults)
+	assert.Equal(t, before.Documents+1, report.Documents)
+}
+
+func TestFaults_ReadError(t *testing.T) {
+	e, s := setupTestServer(t)
+	faults := withFaults(t, e, s)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Fault", Id: "a",
+		Val: map[string]interface{}{"name": "a"},
+	}))
+
+	faults.Set(kv.Faults{ReadError: 1})
+
+	// a failed read is not a missing document
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	err := s.GetDocument(e.NewContext(req, httptest.NewRecorder()), "com.example.Fault", "a", openapi.GetDocumentParams{})
+	assert.Equal(t, http.StatusInternalServerError, faultStatus(t, err))
+
+	err = putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Fault", Id: "b",
+		Val: map[string]interface{}{"name": "b"},
+	})
+	assert.Equal(t, http.StatusInternalServerError, faultStatus(t, err))
+
+	// nor is a model that could not be read, which would skip the checks of a search
+	s.modelCache.Delete("com.example.Fault")
+	var name interface{} = "a"
+	r := s.kv.Read()
+	defer r.Close()
+	_, err = s.query(context.Background(), r, openapi.SearchRequest{
+		Model:   "com.example.Fault",
+		Filters: &[]openapi.Filter{{Key: "val.name", Equal: &name}},
+	})
+	var he *echo.HTTPError
+	if assert.ErrorAs(t, err, &he) {
+		assert.Equal(t, http.StatusInternalServerError, he.Code)
+	}
+
+	assertIndexConsistent(t, s, faults)
+}
+
+func TestFaults_LockWaitTimeout(t *testing.T) {
+	e, s := setupTestServer(t)
+	faults := withFaults(t, e, s)
+
+	faults.Set(kv.Faults{LockWaitTimeout: 1})
+	one := interface{}(json.Number("1"))
+	err := putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Fault", Id: "a",
+		Mut: &openapi.Mutations{"n": {Add: &one}},
+	})
+	assert.Equal(t, http.StatusInternalServerError, faultStatus(t, err))
+
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	err = s.DeleteDocument(e.NewContext(req, httptest.NewRecorder()), "com.example.Fault", "a")
+	assert.Equal(t, http.StatusInternalServerError, faultStatus(t, err))
+}
+
+func TestFaults_SlowIter(t *testing.T) {
+	e, s := setupTestServer(t)
+	faults := withFaults(t, e, s)
+
+	for i := range 5 {
+		id := fmt.Sprintf("d%d", i)
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.Fault", Id: id,
+			Val: map[string]interface{}{"name": id},
+		}))
+	}
+
+	faults.Set(kv.Faults{IterDelay: 50 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	reqBytes, _ := json.Marshal(openapi.SearchRequest{Model: "com.example.Fault"})
+	req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes)).WithContext(ctx)
+	req.Header.Set(echo.HeaderContentType, "application/json")
+
+	start := time.Now()
+	err := s.SearchDocuments(e.NewContext(req, httptest.NewRecorder()))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// random failures everywhere must never leave the index out of sync with the documents
+func TestFaults_NeverHalfWritten(t *testing.T) {
+	e, s := setupTestServer(t)
+	faults := withFaults(t, e, s)
+
+	faults.Set(kv.Faults{
+		CommitConflict:  0.1,
+		CommitAmbiguous: 0.1,
+		LockWaitTimeout: 0.1,
+		ReadError:       0.1,
+	})
+
+	one := interface{}(json.Number("1"))
+	for i := range 200 {
+		id := fmt.Sprintf("d%d", i%10)
+		var err error
+		switch i % 4 {
+		case 0, 1:
+			// names move between documents, so the unique index is busy
+			err = putTestDoc(e, s, openapi.Document{
+				Model: "com.example.Fault", Id: id,
+				Val: map[string]interface{}{"name": fmt.Sprintf("name%d", i%7)},
+			})
+		case 2:
+			err = putTestDoc(e, s, openapi.Document{
+				Model: "com.example.Fault", Id: id,
+				Mut: &openapi.Mutations{"n": {Add: &one}},
+			})
+		case 3:
+			req := httptest.NewRequest(http.MethodDelete, "/", nil)
+			err = s.DeleteDocument(e.NewContext(req, httptest.NewRecorder()), "com.example.Fault", id)
+		}
+		assert.Contains(t, []int{http.StatusOK, http.StatusConflict, http.StatusInternalServerError}, faultStatus(t, err), "%v", err)
+	}
+
+	assertIndexConsistent(t, s, faults)
+}
@@ -0,0 +1,473 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"iter"
+	"time"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+)
+
+// fsck compares the index entries every document should have, according to writeIndexI,
+// with the f\xff, s\xff and c\xff entries that are actually stored. it makes two passes, a batch at a time,
+// so it never holds more than a batch of documents in memory:
+//
+//	documents      the expected entries of each document are looked up, to find the missing ones
+//	index entries  the document each entry points to is loaded, to find the orphans
+//
+// only the keys it repaired or found claimed twice are remembered between batches,
+// so the second pass does not undo what the first one wrote.
+
+// FsckIssue is one inconsistency found by fsck
+type FsckIssue struct {
+	// orphan, missing, unique or error
+	Kind    string
+	Key     []byte
+	Message string
+}
+
+func (i FsckIssue) String() string {
+	if i.Key == nil {
+		return fmt.Sprintf("%s: %s", i.Kind, i.Message)
+	}
+	if i.Message == "" {
+		return fmt.Sprintf("%s: %s", i.Kind, escapeNonPrintable(i.Key))
+	}
+	return fmt.Sprintf("%s: %s %s", i.Kind, escapeNonPrintable(i.Key), i.Message)
+}
+
+type FsckReport struct {
+	Documents int
+	Issues    []FsckIssue
+	// number of orphans deleted and missing entries written
+	Repaired int
+}
+
+// the first byte of the keys of the value index, the full text index and the composite indexes
+var indexTables = []byte{'f', 's', 'c'}
+
+// how many documents or index entries fsck reads at once, and how many entries a repair transaction changes at most
+const fsckBatchSize = 1000
+
+// indexRecorder is a kv.Write that only remembers what writeIndexI puts,
+// so the expected index of a document can be computed with the same code that writes it
+type indexRecorder struct {
+	keys map[string][]byte
+}
+
+func (w *indexRecorder) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+	for _, k := range keys {
+		if v, ok := w.keys[string(k)]; ok {
+			ret[string(k)] = v
+		}
+	}
+	return ret, nil
+}
+
+func (w *indexRecorder) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if v, ok := w.keys[string(key)]; ok {
+		return v, nil
+	}
+	return nil, kv.ErrNotFound
+}
+
+func (w *indexRecorder) Iter(ctx context.Context, start []byte, end []byte, opts ...kv.IterOption) iter.Seq2[kv.KeyAndValue, error] {
+	return func(yield func(kv.KeyAndValue, error) bool) {
+		yield(kv.KeyAndValue{}, fmt.Errorf("indexRecorder does not iterate"))
+	}
+}
+
+func (w *indexRecorder) Put(key []byte, value []byte) error {
+	w.keys[string(key)] = bytes.Clone(value)
+	return nil
+}
+
+func (w *indexRecorder) Del(key []byte) error {
+	delete(w.keys, string(key))
+	return nil
+}
+
+func (w *indexRecorder) Commit(ctx context.Context) error { return nil }
+func (w *indexRecorder) Rollback() error                  { return nil }
+func (w *indexRecorder) Close()                           {}
+
+// expectedIndex returns the index entries createIndex writes for a document
+func (s *server) expectedIndex(ctx context.Context, model *Model, doc *openapi.Document) (map[string][]byte, error) {
+	w := &indexRecorder{keys: make(map[string][]byte)}
+	err := s.createIndex(ctx, w, model, doc)
+	return w.keys, err
+}
+
+// unique entries end in two 0xff, the value is the id of the document that owns it
+func isUniqueIndexKey(k []byte) bool {
+	return bytes.HasSuffix(k, []byte{0xff, 0xff})
+}
+
+// fsckClaim is who a key that fsck repaired or found claimed twice belongs to
+type fsckClaim struct {
+	id      string
+	expired bool
+}
+
+type fsckRun struct {
+	s      *server
+	r      kv.Read
+	repair bool
+	report *FsckReport
+	now    time.Time
+
+	models    map[string]*Model
+	modelErrs map[string]error
+
+	// keys of the first pass that the second one leaves alone
+	fixed map[string]fsckClaim
+
+	// pending repairs, nil value means delete
+	ops []kv.KeyAndValue
+}
+
+// fsck checks the index of every document in one snapshot. if repair is set,
+// orphans are deleted and missing entries are written. unique violations are only reported,
+// because only a human can decide which document keeps the value.
+// repairs are written in separate transactions after the snapshot was taken,
+// so run it while nothing else writes, or run it again afterwards to confirm.
+func (s *server) fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	r := s.kv.Read()
+	defer r.Close()
+
+	run := &fsckRun{
+		s:         s,
+		r:         r,
+		repair:    repair,
+		report:    &FsckReport{},
+		now:       time.Now(),
+		models:    make(map[string]*Model),
+		modelErrs: make(map[string]error),
+		fixed:     make(map[string]fsckClaim),
+	}
+
+	var docs []*openapi.Document
+	for kv, err := range r.Iter(ctx, []byte("o\xff"), []byte("p")) {
+		if err != nil {
+			return nil, err
+		}
+
+		doc := new(openapi.Document)
+		if err := s.deserializeStore(kv.K, kv.V, doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", escapeNonPrintable(kv.K), err)
+		}
+		run.report.Documents++
+
+		docs = append(docs, doc)
+		if len(docs) >= fsckBatchSize {
+			if err := run.checkDocuments(ctx, docs); err != nil {
+				return nil, err
+			}
+			docs = nil
+		}
+	}
+	if err := run.checkDocuments(ctx, docs); err != nil {
+		return nil, err
+	}
+
+	for _, t := range indexTables {
+		var entries []kv.KeyAndValue
+		for kv, err := range r.Iter(ctx, []byte{t, 0xff}, []byte{t, 0xff, 0xff}) {
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := run.fixed[string(kv.K)]; ok {
+				continue
+			}
+			entries = append(entries, kv)
+			if len(entries) >= fsckBatchSize {
+				if err := run.checkEntries(ctx, entries); err != nil {
+					return nil, err
+				}
+				entries = nil
+			}
+		}
+		if err := run.checkEntries(ctx, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := run.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return run.report, nil
+}
+
+// model returns the model with the id, or nil if it can not be read.
+// that is reported once, and the index of its documents is left alone
+func (run *fsckRun) model(ctx context.Context, id string) *Model {
+	if m, ok := run.models[id]; ok {
+		return m
+	}
+	if _, ok := run.modelErrs[id]; ok {
+		return nil
+	}
+	m, err := run.s.getModel(ctx, id)
+	if err != nil {
+		run.modelErrs[id] = err
+		run.report.Issues = append(run.report.Issues, FsckIssue{
+			Kind:    "error",
+			Message: fmt.Sprintf("documents of %s: %v", id, err),
+		})
+		return nil
+	}
+	run.models[id] = m
+	return m
+}
+
+// expected returns the index entries of a document, or nil if its model can not be read.
+// an error is only reported for the documents of the first pass, the second one sees the same documents again
+func (run *fsckRun) expected(ctx context.Context, doc *openapi.Document, report bool) map[string][]byte {
+	model := run.model(ctx, doc.Model)
+	if model == nil {
+		return nil
+	}
+	keys, err := run.s.expectedIndex(ctx, model, doc)
+	if err != nil && report {
+		run.report.Issues = append(run.report.Issues, FsckIssue{
+			Kind:    "error",
+			Message: fmt.Sprintf("%s/%s: %v", doc.Model, doc.Id, err),
+		})
+	}
+	return keys
+}
+
+// loadDocuments reads the documents with the ids from the snapshot, the ones that do not exist are left out
+func (run *fsckRun) loadDocuments(ctx context.Context, ids map[[2]string]bool) (map[[2]string]*openapi.Document, error) {
+	var keys [][]byte
+	for id := range ids {
+		path, err := safeDBPath(id[0], id[1])
+		if err != nil {
+			continue
+		}
+		keys = append(keys, path)
+	}
+	vals, err := run.r.BatchGet(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make(map[[2]string]*openapi.Document)
+	for k, v := range vals {
+		doc := new(openapi.Document)
+		if err := run.s.deserializeStore([]byte(k), v, doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", escapeNonPrintable([]byte(k)), err)
+		}
+		docs[[2]string{doc.Model, doc.Id}] = doc
+	}
+	return docs, nil
+}
+
+// checkDocuments looks up the entries a batch of documents should have
+func (run *fsckRun) checkDocuments(ctx context.Context, docs []*openapi.Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	expected := make([]map[string][]byte, len(docs))
+	var keys [][]byte
+	for i, doc := range docs {
+		expected[i] = run.expected(ctx, doc, true)
+		for k := range expected[i] {
+			keys = append(keys, []byte(k))
+		}
+	}
+	stored, err := run.r.BatchGet(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	// the documents that own the unique entries the batch wants, to tell if they still claim them
+	owners := make(map[[2]string]bool)
+	for i, doc := range docs {
+		for k := range expected[i] {
+			if v, ok := stored[k]; ok && isUniqueIndexKey([]byte(k)) {
+				if owner, _, _ := bytes.Cut(v, []byte{0xff}); string(owner) != doc.Id {
+					owners[[2]string{doc.Model, string(owner)}] = true
+				}
+			}
+		}
+	}
+	ownerDocs, err := run.loadDocuments(ctx, owners)
+	if err != nil {
+		return err
+	}
+	ownerKeys := make(map[[2]string]map[string][]byte)
+	for id, doc := range ownerDocs {
+		ownerKeys[id] = run.expected(ctx, doc, false)
+	}
+
+	for i, doc := range docs {
+		for k, want := range expected[i] {
+			v, ok := stored[k]
+			var err error
+			switch {
+			case isUniqueIndexKey([]byte(k)):
+				err = run.checkUnique(ctx, k, want, v, ok, doc, ownerDocs, ownerKeys)
+			case !ok:
+				err = run.missing(ctx, []byte(k), want, "")
+			case !bytes.Equal(v, want):
+				run.fixed[k] = fsckClaim{id: doc.Id}
+				err = run.missing(ctx, []byte(k), want, "points to the wrong document")
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkUnique compares a unique entry a document wants with the document that owns it
+func (run *fsckRun) checkUnique(ctx context.Context, k string, want []byte, v []byte, ok bool, doc *openapi.Document,
+	ownerDocs map[[2]string]*openapi.Document, ownerKeys map[[2]string]map[string][]byte) error {
+
+	claim := fsckClaim{id: doc.Id, expired: isExpired(doc, run.now)}
+
+	owner, fixed := run.fixed[k]
+	if !fixed {
+		if !ok {
+			run.fixed[k] = claim
+			return run.missing(ctx, []byte(k), want, "")
+		}
+		id, _, _ := bytes.Cut(v, []byte{0xff})
+		if string(id) == doc.Id {
+			return nil
+		}
+		od, claimed := ownerDocs[[2]string{doc.Model, string(id)}], false
+		if od != nil {
+			_, claimed = ownerKeys[[2]string{doc.Model, string(id)}][k]
+		}
+		if !claimed {
+			run.fixed[k] = claim
+			return run.missing(ctx, []byte(k), want, "points to the wrong document")
+		}
+		owner = fsckClaim{id: string(id), expired: isExpired(od, run.now)}
+	}
+	if owner.id == doc.Id {
+		return nil
+	}
+
+	// an expired document that is not swept yet gives its values up to any other document
+	switch {
+	case claim.expired:
+		return nil
+	case owner.expired:
+		run.fixed[k] = claim
+		return run.missing(ctx, []byte(k), want, "points to an expired document")
+	}
+
+	run.fixed[k] = owner
+	run.report.Issues = append(run.report.Issues, FsckIssue{
+		Kind:    "unique",
+		Key:     []byte(k),
+		Message: fmt.Sprintf("claimed by %v", []string{owner.id, doc.Id}),
+	})
+	return nil
+}
+
+// checkEntries loads the documents a batch of index entries point to, and deletes the entries they do not have
+func (run *fsckRun) checkEntries(ctx context.Context, entries []kv.KeyAndValue) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ids := make(map[[2]string]bool)
+	for _, e := range entries {
+		model, _, _ := bytes.Cut(e.K[2:], []byte{0xff})
+		if id, ok := bytes.CutSuffix(e.V, []byte{0xff}); ok {
+			ids[[2]string{string(model), string(id)}] = true
+		}
+	}
+	docs, err := run.loadDocuments(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	expected := make(map[[2]string]map[string][]byte)
+	for _, e := range entries {
+		model, _, _ := bytes.Cut(e.K[2:], []byte{0xff})
+		id, _ := bytes.CutSuffix(e.V, []byte{0xff})
+		key := [2]string{string(model), string(id)}
+
+		doc := docs[key]
+		if doc == nil {
+			if err := run.orphan(ctx, e.K); err != nil {
+				return err
+			}
+			continue
+		}
+		if run.model(ctx, doc.Model) == nil {
+			continue
+		}
+		keys, ok := expected[key]
+		if !ok {
+			keys = run.expected(ctx, doc, false)
+			expected[key] = keys
+		}
+		if _, ok := keys[string(e.K)]; !ok {
+			if err := run.orphan(ctx, e.K); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (run *fsckRun) orphan(ctx context.Context, k []byte) error {
+	run.report.Issues = append(run.report.Issues, FsckIssue{Kind: "orphan", Key: bytes.Clone(k)})
+	return run.queue(ctx, kv.KeyAndValue{K: bytes.Clone(k)})
+}
+
+func (run *fsckRun) missing(ctx context.Context, k []byte, v []byte, message string) error {
+	run.report.Issues = append(run.report.Issues, FsckIssue{Kind: "missing", Key: bytes.Clone(k), Message: message})
+	return run.queue(ctx, kv.KeyAndValue{K: bytes.Clone(k), V: v})
+}
+func (run *fsckRun) queue(ctx context.Context, op kv.KeyAndValue) error {
+	if !run.repair {
+		return nil
+	}
+	run.ops = append(run.ops, op)
+	if len(run.ops) >= fsckBatchSize {
+		return run.flush(ctx)
+	}
+	return nil
+}
+
+func (run *fsckRun) flush(ctx context.Context) error {
+	if len(run.ops) == 0 {
+		return nil
+	}
+
+	w := run.s.kv.Write()
+	defer w.Close()
+
+	for _, op := range run.ops {
+		var err error
+		if op.V == nil {
+			err = w.Del(op.K)
+		} else {
+			err = w.Put(op.K, op.V)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Commit(ctx); err != nil {
+		return fmt.Errorf("repair failed: %w", err)
+	}
+
+	run.report.Repaired += len(run.ops)
+	run.ops = nil
+	return nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fsckKinds(report *FsckReport) map[string]int {
+	kinds := make(map[string]int)
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	return kinds
+}
+
+func TestFsck_Repair(t *testing.T) {
+	ctx := context.Background()
+	e, s := setupTestServer(t)
+	setupSearchTestData(t, e, s)
+
+	report, err := s.fsck(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+	assert.Equal(t, 5, report.Documents)
+
+	w := s.kv.Write()
+	// points to a document that does not exist
+	w.Put([]byte("f\xffcom.example.SearchTest\xffval.name\xffGhost\xffghost\xff"), []byte("ghost\xff"))
+	// belongs to a model without documents
+	w.Put([]byte("f\xffcom.example.Gone\xffval.x\xffy\xffz\xff"), []byte("z\xff"))
+	// doc1 is no longer found by name
+	w.Del([]byte("f\xffcom.example.SearchTest\xffval.name\xffDocument 1\xffdoc1\xff"))
+	// doc2 is found by name, but the entry names another document
+	w.Put([]byte("f\xffcom.example.SearchTest\xffval.name\xffDocument 2\xffdoc2\xff"), []byte("doc3\xff"))
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	report, err = s.fsck(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"orphan": 2, "missing": 2}, fsckKinds(report))
+	assert.Equal(t, 0, report.Repaired)
+
+	report, err = s.fsck(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Repaired)
+
+	report, err = s.fsck(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
+
+func TestFsck_UniqueViolation(t *testing.T) {
+	ctx := context.Background()
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.FsckUnique",
+		Val: map[string]interface{}{
+			"schema": map[string]interface{}{"name": "string"},
+			"index":  map[string]interface{}{"name": "unique"},
+		},
+	}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.FsckUnique",
+		Id:    "a",
+		Val:   map[string]interface{}{"name": "same"},
+	}))
+
+	// a second document with the same name, written past the index
+	path, err := safeDBPath("com.example.FsckUnique", "b")
+	require.NoError(t, err)
+	b, err := s.serializeStore(path, &openapi.Document{
+		Model: "com.example.FsckUnique",
+		Id:    "b",
+		Val:   map[string]interface{}{"name": "same"},
+	})
+	require.NoError(t, err)
+	w := s.kv.Write()
+	w.Put(path, b)
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	report, err := s.fsck(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"unique": 1, "missing": 1}, fsckKinds(report))
+
+	// the unique entry is left alone, it still belongs to a
+	r := s.kv.Read()
+	defer r.Close()
+	owner, err := r.Get(ctx, []byte("f\xffcom.example.FsckUnique\xffval.name\xffsame\xff\xff"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a\xff"), owner)
+}
+
+// numbers used to be indexed as 8 bytes little endian, which fsck --repair replaces
+func TestFsck_OldNumberEncoding(t *testing.T) {
+	ctx := context.Background()
+	e, s := setupTestServer(t)
+	setupSearchTestData(t, e, s)
+
+	newKey := append([]byte("f\xffcom.example.SearchTest\xffval.count\xff"), codec.IndexInt(20)...)
+	newKey = append(newKey, []byte("\xffdoc2\xff")...)
+
+	w := s.kv.Write()
+	w.Del(newKey)
+	w.Put([]byte("f\xffcom.example.SearchTest\xffval.count\xff\x14\x00\x00\x00\x00\x00\x00\x00\xffdoc2\xff"), []byte("doc2\xff"))
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	report, err := s.fsck(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"orphan": 1, "missing": 1}, fsckKinds(report))
+
+	r := s.kv.Read()
+	defer r.Close()
+	_, err = r.Get(ctx, newKey)
+	assert.NoError(t, err)
+
+	var twenty interface{} = 20
+	res, err := s.query(ctx, r, openapi.SearchRequest{
+		Model:   "com.example.SearchTest",
+		Filters: &[]openapi.Filter{{Key: "val.count", Equal: &twenty}},
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Documents, 1)
+	assert.Equal(t, "doc2", res.Documents[0].Id)
+}
+
+// more documents and entries than fit in one batch
+func TestFsck_Batches(t *testing.T) {
+	ctx := context.Background()
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.FsckBatches",
+		Val:   map[string]interface{}{"index": map[string]interface{}{"n": "unique"}},
+	}))
+	for i := range fsckBatchSize + 10 {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{
+			Model: "com.example.FsckBatches",
+			Id:    fmt.Sprintf("doc%04d", i),
+			Val:   map[string]interface{}{"n": i},
+		}))
+	}
+
+	report, err := s.fsck(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+	assert.Greater(t, report.Documents, fsckBatchSize+10)
+
+	// the last document loses its unique entry, which the repair gives back
+	k := append([]byte("f\xffcom.example.FsckBatches\xffval.n\xff"), codec.IndexInt(fsckBatchSize+9)...)
+	k = append(k, 0xff, 0xff)
+	w := s.kv.Write()
+	require.NoError(t, w.Del(k))
+	require.NoError(t, w.Commit(ctx))
+	w.Close()
+
+	report, err = s.fsck(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"missing": 1}, fsckKinds(report))
+
+	report, err = s.fsck(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
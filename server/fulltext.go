@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/unicode/norm"
+)
+
+// a model opts into full text search per field, next to unique:
+//
+//	index:
+//	  description: fulltext
+//	  comment:     fulltext+stem
+//
+// every word of the field gets an entry, in the same transaction as the rest of the index
+//
+//	s 0xff model 0xff path 0xff word 0xff id 0xff -> id 0xff
+//
+// words are lowercased and have their accents removed, so Café finds cafe.
+// with +stem, english plurals and -ed and -ing forms are reduced to their stem, so robots finds robot.
+
+// words longer than this are not indexed
+const maxFulltextWord = 64
+
+// fulltextIndex tells if an index kind from the model is a full text index, and if it stems
+func fulltextIndex(kind string) (fulltext bool, stem bool) {
+	switch kind {
+	case "fulltext":
+		return true, false
+	case "fulltext+stem":
+		return true, true
+	}
+	return false, false
+}
+
+// fulltextWords splits a string into the words that are indexed or searched for, without duplicates
+func fulltextWords(s string, stem bool) []string {
+	var words []string
+	seen := make(map[string]bool)
+
+	var word strings.Builder
+	flush := func() {
+		w := word.String()
+		word.Reset()
+		if w == "" || len(w) > maxFulltextWord {
+			return
+		}
+		if stem {
+			w = stemWord(w)
+		}
+		if !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+
+	for _, r := range norm.NFKD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			// the accent of a decomposed letter
+			continue
+		}
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			word.WriteRune(unicode.ToLower(r))
+		} else {
+			flush()
+		}
+	}
+	flush()
+
+	return words
+}
+
+func fulltextKey(model string, path string, word string) []byte {
+	p := []byte("s\xff")
+	p = append(p, []byte(model)...)
+	p = append(p, 0xff)
+	p = append(p, []byte(path)...)
+	p = append(p, 0xff)
+	p = append(p, []byte(word)...)
+	p = append(p, 0xff)
+	return p
+}
+
+func (s *server) writeFulltextIndex(w kv.Write, model *Model, objectId []byte, path string, v string, stem bool, delete bool) error {
+	for _, word := range fulltextWords(v, stem) {
+		p := fulltextKey(model.Id, path, word)
+		p = append(p, objectId...)
+		p = append(p, 0xff)
+
+		var err error
+		if delete {
+			err = w.Del(p)
+		} else {
+			err = w.Put(p, append(objectId, 0xff))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsWords returns the words a contains filter searches for, all of which have to match
+func (s *server) containsWords(ctx context.Context, model string, path string, contains string) ([]string, error) {
+	m, err := s.getModel(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+	fulltext, stem := fulltextIndex(m.Index[path])
+	if !fulltext {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s has no fulltext index", path))
+	}
+
+	words := fulltextWords(contains, stem)
+	if len(words) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%q contains no words to search for", contains))
+	}
+	return words, nil
+}
+
+// hasWords checks if a document has an entry for every word
+func hasWords(ctx context.Context, r kv.Read, model string, path string, id string, words []string) (bool, error) {
+	if len(words) == 0 {
+		return true, nil
+	}
+	keys := make([][]byte, 0, len(words))
+	for _, word := range words {
+		keys = append(keys, append(fulltextKey(model, path, word), []byte(id+"\xff")...))
+	}
+	found, err := r.BatchGet(ctx, keys)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range keys {
+		if found[string(k)] == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// stemWord is step 1 of the porter stemmer, which removes plurals and -ed or -ing.
+// the later steps also fold derived words like relational into relate,
+// which finds more than people expect from a search box. words with letters other than a-z are left alone
+func stemWord(w string) string {
+	for i := 0; i < len(w); i++ {
+		if w[i] < 'a' || w[i] > 'z' {
+			return w
+		}
+	}
+	if len(w) <= 2 {
+		return w
+	}
+	b := []byte(w)
+
+	// 1a
+	switch {
+	case hasSuffix(b, "sses"):
+		b = b[:len(b)-2]
+	case hasSuffix(b, "ies"):
+		b = b[:len(b)-2]
+	case hasSuffix(b, "ss"):
+	case hasSuffix(b, "s"):
+		b = b[:len(b)-1]
+	}
+
+	// 1b
+	again := false
+	switch {
+	case hasSuffix(b, "eed"):
+		if measure(b[:len(b)-3]) > 0 {
+			b = b[:len(b)-1]
+		}
+	case hasSuffix(b, "ed") && hasVowel(b[:len(b)-2]):
+		b = b[:len(b)-2]
+		again = true
+	case hasSuffix(b, "ing") && hasVowel(b[:len(b)-3]):
+		b = b[:len(b)-3]
+		again = true
+	}
+	if again {
+		switch {
+		case hasSuffix(b, "at"), hasSuffix(b, "bl"), hasSuffix(b, "iz"):
+			b = append(b, 'e')
+		case endsDoubleConsonant(b) && !hasSuffix(b, "l") && !hasSuffix(b, "s") && !hasSuffix(b, "z"):
+			b = b[:len(b)-1]
+		case measure(b) == 1 && endsCVC(b):
+			b = append(b, 'e')
+		}
+	}
+
+	// 1c
+	if hasSuffix(b, "y") && hasVowel(b[:len(b)-1]) {
+		b[len(b)-1] = 'i'
+	}
+
+	return string(b)
+}
+
+func hasSuffix(b []byte, suffix string) bool {
+	return strings.HasSuffix(string(b), suffix)
+}
+
+// y is a consonant at the start and after a vowel
+func isConsonant(b []byte, i int) bool {
+	switch b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(b, i-1)
+	}
+	return true
+}
+
+// measure counts the vowel consonant sequences, m in [C](VC)^m[V]
+func measure(b []byte) int {
+	m := 0
+	i := 0
+	for i < len(b) && isConsonant(b, i) {
+		i++
+	}
+	for i < len(b) {
+		for i < len(b) && !isConsonant(b, i) {
+			i++
+		}
+		if i >= len(b) {
+			break
+		}
+		for i < len(b) && isConsonant(b, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+func hasVowel(b []byte) bool {
+	for i := range b {
+		if !isConsonant(b, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsDoubleConsonant(b []byte) bool {
+	n := len(b)
+	return n >= 2 && b[n-1] == b[n-2] && isConsonant(b, n-1)
+}
+
+// consonant vowel consonant, where the last one is not w, x or y, like hop but not hoop
+func endsCVC(b []byte) bool {
+	n := len(b)
+	if n < 3 || !isConsonant(b, n-3) || isConsonant(b, n-2) || !isConsonant(b, n-1) {
+		return false
+	}
+	switch b[n-1] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFulltextWords(t *testing.T) {
+	assert.Equal(t, []string{"the", "cafe", "is", "open"}, fulltextWords("The Café is open, the CAFÉ!", false))
+	assert.Equal(t, []string{"robot", "dream", "of", "electric", "sheep", "2049"}, fulltextWords("Robots dreaming of electric sheep (2049)", true))
+	assert.Equal(t, []string{"東京", "tower"}, fulltextWords("東京 Tower", false))
+	assert.Empty(t, fulltextWords(" -- ", true))
+}
+
+func TestStemWord(t *testing.T) {
+	for word, stem := range map[string]string{
+		"caresses":  "caress",
+		"ponies":    "poni",
+		"cats":      "cat",
+		"feed":      "feed",
+		"agreed":    "agree",
+		"plastered": "plaster",
+		"motoring":  "motor",
+		"sing":      "sing",
+		"conflated": "conflate",
+		"hopping":   "hop",
+		"falling":   "fall",
+		"filing":    "file",
+		"happy":     "happi",
+		"is":        "is",
+		"naïve":     "naïve",
+	} {
+		assert.Equal(t, stem, stemWord(word), word)
+	}
+}
+
+func TestSearchDocuments_Contains(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.Blurb",
+		Val: map[string]interface{}{
+			"index": map[string]interface{}{"blurb": "fulltext+stem", "tags": "fulltext"},
+		},
+	}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Blurb", Id: "dune", Val: map[string]interface{}{
+		"kind":  "novel",
+		"blurb": "A desert planet, giant sand worms and the spice that everyone wants.",
+		"tags":  []interface{}{"Science Fiction", "Classic"},
+	}}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Blurb", Id: "sheep", Val: map[string]interface{}{
+		"kind":  "novel",
+		"blurb": "Do androids dream of electric sheep? A bounty hunter wanted by nobody.",
+		"tags":  []interface{}{"science fiction"},
+	}}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Blurb", Id: "cookbook", Val: map[string]interface{}{
+		"kind":  "cookbook",
+		"blurb": "Spiced desserts from the desert.",
+	}}))
+
+	search := func(filters ...openapi.Filter) ([]string, error) {
+		reqBytes, _ := json.Marshal(openapi.SearchRequest{Model: "com.example.Blurb", Filters: &filters})
+		req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes))
+		req.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+		if err := s.SearchDocuments(e.NewContext(req, rec)); err != nil {
+			return nil, err
+		}
+		var response openapi.SearchResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		ret := []string{}
+		for _, doc := range response.Documents {
+			ret = append(ret, doc.Id)
+		}
+		return ret, nil
+	}
+
+	contains := func(key string, words string) []string {
+		ids, err := search(openapi.Filter{Key: key, Contains: &words})
+		require.NoError(t, err)
+		return ids
+	}
+
+	assert.Equal(t, []string{"dune"}, contains("val.blurb", "worm"))
+	assert.ElementsMatch(t, []string{"dune", "sheep"}, contains("val.blurb", "WANTS"))
+	assert.ElementsMatch(t, []string{"dune", "cookbook"}, contains("val.blurb", "desert"))
+	assert.Equal(t, []string{"cookbook"}, contains("val.blurb", "spiced desserts"))
+	assert.Equal(t, []string{"dune"}, contains("val.blurb", "sand, spice"))
+	assert.Equal(t, []string{}, contains("val.blurb", "sand sheep"))
+	assert.ElementsMatch(t, []string{"dune", "sheep"}, contains("val.tags", "science fiction"))
+
+	// without stemming only the exact word matches
+	assert.Equal(t, []string{}, contains("val.tags", "classics"))
+
+	novel := interface{}("novel")
+	words := "wanted"
+	ids, err := search(openapi.Filter{Key: "val.kind", Equal: &novel}, openapi.Filter{Key: "val.blurb", Contains: &words})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dune", "sheep"}, ids)
+
+	_, err = search(openapi.Filter{Key: "val.kind", Contains: &words})
+	he, ok := err.(*echo.HTTPError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, http.StatusBadRequest, he.Code)
+
+	reqBytes, _ := json.Marshal(openapi.Query{Q: `com.example.Blurb(val.blurb~"bounty hunters")`})
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(reqBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.QueryDocuments(e.NewContext(req, rec)))
+	var response openapi.SearchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	require.Len(t, response.Documents, 1)
+	assert.Equal(t, "sheep", response.Documents[0].Id)
+
+	// the words of the old text are gone after an update
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Blurb", Id: "dune", Val: map[string]interface{}{
+		"blurb": "Politics on Arrakis.",
+	}}))
+	assert.Equal(t, []string{}, contains("val.blurb", "worms"))
+	assert.Equal(t, []string{"dune"}, contains("val.blurb", "arrakis"))
+
+	report, err := s.fsck(context.Background(), false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/aep/apogy/kv"
 	"github.com/labstack/echo/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -51,6 +52,9 @@ var (
 		[]string{"operation", "status"},
 	)
 
+	// every operation of the kv, see kv.WithMetrics
+	kvMetrics = kv.NewMetrics()
+
 	kvCommitFailures = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "kv_commit_failures_total",
@@ -77,6 +81,7 @@ func init() {
 	promRegistry.MustRegister(kvCommitDuration)
 	promRegistry.MustRegister(kvLockRetries)
 	promRegistry.MustRegister(kvCommitFailures)
+	promRegistry.MustRegister(kvMetrics)
 }
 
 func (s *server) statsd() {
@@ -3,22 +3,45 @@ package server
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math"
+	"time"
 
 	"encoding/json"
 	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
 	"github.com/aep/apogy/kv"
 )
 
+// errIndexRead is a failure to check the index, as opposed to a violation of it
+var errIndexRead = errors.New("cannot read unique index")
+
+// uniqueConflict is a write that would give a unique index a value that another document already has
+type uniqueConflict struct {
+	Model string
+	// the path, or the comma separated paths of a composite index
+	Index string
+	// the document that has the value
+	Id string
+}
+
+func (e *uniqueConflict) Error() string {
+	return fmt.Sprintf("unique index in key %s is already set by document id %s", e.Index, e.Id)
+}
+
 func (s *server) deleteIndex(ctx context.Context, w kv.Write, model *Model, object *openapi.Document) error {
-	return s.writeIndexI(ctx, w, model, []byte(object.Id), "val", object.Val, true)
+	if err := s.writeIndexI(ctx, w, model, []byte(object.Id), "val", object.Val, true); err != nil {
+		return err
+	}
+	return s.writeCompositeIndex(ctx, w, model, []byte(object.Id), object.Val, true)
 }
 
 func (s *server) createIndex(ctx context.Context, w kv.Write, model *Model, object *openapi.Document) error {
-	return s.writeIndexI(ctx, w, model, []byte(object.Id), "val", object.Val, false)
+	if err := s.writeIndexI(ctx, w, model, []byte(object.Id), "val", object.Val, false); err != nil {
+		return err
+	}
+	return s.writeCompositeIndex(ctx, w, model, []byte(object.Id), object.Val, false)
 }
 
 func (s *server) writeIndexI(ctx context.Context, w kv.Write, model *Model, objectId []byte, path string, obj any, delete bool) error {
@@ -85,6 +108,16 @@ func (s *server) writeIndexI(ctx context.Context, w kv.Write, model *Model, obje
 		}
 	case string:
 
+		if !model.indexed(path) {
+			return nil
+		}
+
+		if fulltext, stem := fulltextIndex(model.Index[path]); fulltext {
+			if err := s.writeFulltextIndex(w, model, objectId, path, v, stem, delete); err != nil {
+				return err
+			}
+		}
+
 		unique := model.Index[path] == "unique"
 
 		if len(v) > 1024 {
@@ -119,17 +152,8 @@ func (s *server) writeIndexI(ctx context.Context, w kv.Write, model *Model, obje
 		p = append(p, 0xff)
 
 		if unique {
-
-			p := append(p, 0xff)
-			if delete {
-				w.Del(p)
-			} else {
-				ev, err := w.Get(ctx, p)
-				if err == nil {
-					evv := bytes.Split(ev, []byte{0xff})
-					return fmt.Errorf("unique index in key %s is already set by document id %s", path, string(evv[0]))
-				}
-				w.Put(p, append(objectId, 0xff))
+			if err := s.writeUniqueIndex(ctx, w, model, path, p, objectId, delete); err != nil {
+				return err
 			}
 		}
 
@@ -144,15 +168,18 @@ func (s *server) writeIndexI(ctx context.Context, w kv.Write, model *Model, obje
 			}
 		}
 
-	case json.Number:
+	case json.Number, bool, nil:
 
-		vbin := make([]byte, 8)
-		if i64, err := v.Int64(); err == nil {
-			binary.LittleEndian.PutUint64(vbin, uint64(i64))
-		} else if f64, err := v.Float64(); err == nil {
-			bits := math.Float64bits(f64)
-			binary.LittleEndian.PutUint64(vbin, bits)
-		} else {
+		if obj == nil && path == "val" {
+			// a document without val, not a null
+			return nil
+		}
+		if !model.indexed(path) {
+			return nil
+		}
+
+		vbin, ok := codec.IndexValue(v)
+		if !ok {
 			return nil
 		}
 
@@ -166,12 +193,10 @@ func (s *server) writeIndexI(ctx context.Context, w kv.Write, model *Model, obje
 		p = append(p, vbin...)
 		p = append(p, 0xff)
 
-		if unique {
-			p := append(p, 0xff)
-			ev, err := w.Get(ctx, p)
-			if err == nil {
-				evv := bytes.Split(ev, []byte{0xff})
-				return fmt.Errorf("unique index in key %s is already set by document id %s", path, string(evv[0]))
+		// like in sql, any number of documents can be null
+		if unique && obj != nil {
+			if err := s.writeUniqueIndex(ctx, w, model, path, p, objectId, delete); err != nil {
+				return err
 			}
 		}
 
@@ -191,3 +216,43 @@ func (s *server) writeIndexI(ctx context.Context, w kv.Write, model *Model, obje
 
 	return nil
 }
+
+// writeUniqueIndex claims the value of a unique index for a document, or gives it up.
+// p is the entry of the value without the id, the unique entry is p 0xff -> id 0xff.
+// a document that has the value already, like from an array with the same value twice, can claim it again.
+// so can any document when the owner expired, even before the sweeper deleted it.
+// the owner then only gives the value up if it still has it
+func (s *server) writeUniqueIndex(ctx context.Context, w kv.Write, model *Model, index string, p []byte, objectId []byte, delete bool) error {
+	p = append(bytes.Clone(p), 0xff)
+
+	ev, err := w.Get(ctx, p)
+	if kv.IsErrNotFound(err) {
+		if delete {
+			return nil
+		}
+		return w.Put(p, append(bytes.Clone(objectId), 0xff))
+	}
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", errIndexRead, index, err)
+	}
+
+	owner, _, _ := bytes.Cut(ev, []byte{0xff})
+	if bytes.Equal(owner, objectId) {
+		if delete {
+			return w.Del(p)
+		}
+		return nil
+	}
+	if delete {
+		return nil
+	}
+
+	expired, err := hasExpired(ctx, w, model.Id, string(owner), time.Now())
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", errIndexRead, index, err)
+	}
+	if !expired {
+		return &uniqueConflict{Model: model.Id, Index: index, Id: string(owner)}
+	}
+	return w.Put(p, append(bytes.Clone(objectId), 0xff))
+}
@@ -500,3 +500,152 @@ func TestUniqueIndexConstraintRaceCondition(t *testing.T) {
 	json.Unmarshal(rec.Body.Bytes(), &response)
 	assert.Len(t, response.Documents, 1, "There should be exactly one document with the unique code")
 }
+
+func TestModelIndexed(t *testing.T) {
+	model := &Model{Index: modelIndex(map[string]interface{}{
+		"index": map[string]interface{}{
+			"meta":      "index",
+			"meta.blob": "none",
+			"code":      "unique",
+		},
+	})}
+	model.Indexing = "none"
+
+	assert.True(t, model.indexed("val.meta"))
+	assert.True(t, model.indexed("val.meta.author.name"))
+	assert.False(t, model.indexed("val.meta.blob"))
+	assert.False(t, model.indexed("val.meta.blob.x"))
+	assert.True(t, model.indexed("val.code"))
+	assert.False(t, model.indexed("val.name"))
+
+	model.Indexing = "all"
+	assert.True(t, model.indexed("val.name"))
+	assert.False(t, model.indexed("val.meta.blob"))
+}
+
+func TestIndexingNone(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	err := putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.Sparse",
+		Val:   map[string]interface{}{"indexing": "some"},
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.Sparse",
+		Val: map[string]interface{}{
+			"indexing": "none",
+			"index":    map[string]interface{}{"name": "index"},
+		},
+	}))
+	assert.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "com.example.Sparse",
+		Id:    "doc1",
+		Val: map[string]interface{}{
+			"name":    "Sparse",
+			"payload": map[string]interface{}{"a": "b", "n": 1, "list": []interface{}{"x", "y"}},
+		},
+	}))
+
+	r := s.kv.Read()
+	defer r.Close()
+	var keys []string
+	for kv, err := range r.Iter(context.Background(), []byte("f\xffcom.example.Sparse\xff"), []byte("f\xffcom.example.Sparse\xff\xff")) {
+		assert.NoError(t, err)
+		keys = append(keys, string(kv.K))
+	}
+	assert.Equal(t, []string{"f\xffcom.example.Sparse\xffval.name\xffSparse\xffdoc1\xff"}, keys)
+
+	var name, a interface{} = "Sparse", "b"
+	res, err := s.query(context.Background(), r, openapi.SearchRequest{
+		Model:   "com.example.Sparse",
+		Filters: &[]openapi.Filter{{Key: "val.name", Equal: &name}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, res.Documents, 1)
+
+	_, err = s.query(context.Background(), r, openapi.SearchRequest{
+		Model:   "com.example.Sparse",
+		Filters: &[]openapi.Filter{{Key: "val.name", Equal: &name}, {Key: "val.payload.a", Equal: &a}},
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+		assert.Contains(t, err.Error(), "val.payload.a is not indexed")
+	}
+}
+
+func TestUniqueIndexAllTypes(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	put := func(id string, val map[string]interface{}) error {
+		return putTestDoc(e, s, openapi.Document{Model: "com.example.UniqueTypes", Id: id, Val: val})
+	}
+	conflict := func(err error) *uniqueConflict {
+		he, ok := err.(*echo.HTTPError)
+		if !assert.True(t, ok, "%v", err) {
+			return nil
+		}
+		assert.Equal(t, http.StatusConflict, he.Code)
+		var c *uniqueConflict
+		assert.ErrorAs(t, he.Internal, &c)
+		return c
+	}
+
+	docBytes, _ := json.Marshal(openapi.Document{Model: "Model", Id: "com.example.UniqueTypes", Val: map[string]interface{}{
+		"index": map[string]interface{}{
+			"number":       "unique",
+			"flag":         "unique",
+			"tenant,email": "unique",
+		},
+	}})
+	req := httptest.NewRequest(http.MethodPut, "/v1", bytes.NewReader(docBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	assert.NoError(t, s.PutDocument(e.NewContext(req, httptest.NewRecorder())))
+
+	assert.NoError(t, put("a", map[string]interface{}{"number": 7, "tenant": "acme", "email": "bob@example.com"}))
+
+	c := conflict(put("b", map[string]interface{}{"number": 7.0}))
+	assert.Equal(t, &uniqueConflict{Model: "com.example.UniqueTypes", Index: "val.number", Id: "a"}, c)
+
+	// writing the same document again keeps its values
+	assert.NoError(t, put("a", map[string]interface{}{"number": 7, "tenant": "acme", "email": "bob@example.com", "x": 1}))
+
+	c = conflict(put("b", map[string]interface{}{"tenant": "acme", "email": "bob@example.com"}))
+	assert.Equal(t, &uniqueConflict{Model: "com.example.UniqueTypes", Index: "val.tenant,val.email", Id: "a"}, c)
+	assert.NoError(t, put("b", map[string]interface{}{"tenant": "globex", "email": "bob@example.com"}))
+
+	assert.NoError(t, put("c", map[string]interface{}{"flag": true}))
+	conflict(put("d", map[string]interface{}{"flag": true}))
+
+	// any number of documents can be null
+	assert.NoError(t, put("d", map[string]interface{}{"number": nil, "tenant": nil, "email": "bob@example.com"}))
+	assert.NoError(t, put("e", map[string]interface{}{"number": nil, "tenant": nil, "email": "bob@example.com"}))
+
+	// a changed value is free for others
+	assert.NoError(t, put("a", map[string]interface{}{"number": 8}))
+	assert.NoError(t, put("f", map[string]interface{}{"number": 7, "tenant": "acme", "email": "bob@example.com"}))
+
+	// and so is the value of a deleted document
+	req = httptest.NewRequest(http.MethodDelete, "/v1/com.example.UniqueTypes/a", nil)
+	assert.NoError(t, s.DeleteDocument(e.NewContext(req, httptest.NewRecorder()), "com.example.UniqueTypes", "a"))
+	assert.NoError(t, put("g", map[string]interface{}{"number": 8}))
+
+	report, err := s.fsck(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Issues)
+
+	// the response names the document
+	err = put("h", map[string]interface{}{"number": 8})
+	rec := httptest.NewRecorder()
+	httpErrorHandler(e)(err, e.NewContext(httptest.NewRequest(http.MethodPut, "/v1", nil), rec))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.JSONEq(t, `{
+		"message": "unique index in key val.number is already set by document id g",
+		"conflict": {"model": "com.example.UniqueTypes", "index": "val.number", "id": "g"}
+	}`, rec.Body.String())
+}
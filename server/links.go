@@ -13,7 +13,7 @@ func (s *server) checkNothingNeedsModel(ctx context.Context, model string) error
 	r := s.kv.Read()
 	defer r.Close()
 
-	res, _ := s.scan(ctx, r, model, "", nil, 1, nil)
+	res, _ := s.scan(ctx, r, model, "", nil, 1, nil, false)
 
 	if len(res.documents) > 0 {
 		return echo.NewHTTPError(http.StatusConflict, fmt.Sprint("model is in use"))
@@ -79,3 +79,15 @@ func escapeNonPrintable(b []byte) string {
 	}
 	return result.String()
 }
+
+// taskKey is where a background task keeps its progress, next to the documents but not in them
+//
+//	t 0xff task 0xff ...
+func taskKey(parts ...string) []byte {
+	k := []byte("t\xff")
+	for _, p := range parts {
+		k = append(k, p...)
+		k = append(k, 0xff)
+	}
+	return k
+}
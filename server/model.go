@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"fmt"
 	openapi "github.com/aep/apogy/api/go"
@@ -13,6 +15,12 @@ type Model struct {
 	Id     string
 	Schema *yema.Type
 	Index  map[string]string
+	// documents expire this long after they were written, unless they set their own expiry
+	TTL time.Duration
+	// the index changed and the existing documents are not reindexed yet
+	Backfilling bool
+	// all or none, the paths that are indexed unless the index says otherwise. empty is all
+	Indexing string
 }
 
 var MODEL_MODEL = &Model{
@@ -68,16 +76,87 @@ func (s *server) getModel(ctx context.Context, id string) (*Model, error) {
 			model.Schema = yy
 		}
 
-		ix, _ := val["index"].(map[string]interface{})
-		for k, v := range ix {
-			if v, ok := v.(string); ok {
-				model.Index["val."+k] = v
-			}
+		model.Index = modelIndex(val)
+
+		model.TTL, err = modelTTL(val)
+		if err != nil {
+			return nil, err
+		}
+
+		model.Indexing, err = modelIndexing(val)
+		if err != nil {
+			return nil, err
 		}
+	}
 
+	if st, ok := getBackfillStatus(&doc); ok && st.State != "ready" {
+		model.Backfilling = true
 	}
 
 	s.modelCache.Set(id, model)
 
 	return model, nil
 }
+
+// modelIndex reads val.index of a Model document, with the paths as they appear in index keys.
+// composite indexes are several paths separated by a comma, like val.author,val.year
+func modelIndex(val interface{}) map[string]string {
+	index := make(map[string]string)
+	v, _ := val.(map[string]interface{})
+	ix, _ := v["index"].(map[string]interface{})
+	for k, v := range ix {
+		if v, ok := v.(string); ok {
+			paths := strings.Split(k, ",")
+			for i := range paths {
+				paths[i] = "val." + strings.TrimSpace(paths[i])
+			}
+			index[strings.Join(paths, ",")] = v
+		}
+	}
+	return index
+}
+
+// indexed tells if a path gets index entries. the deepest rule for the path or one of its parents decides,
+// a kind of none excludes it and every other kind includes it. without a rule it depends on the indexing of the model
+func (m *Model) indexed(path string) bool {
+	p := path
+	for {
+		if kind, ok := m.Index[p]; ok {
+			return kind != "none"
+		}
+		i := strings.LastIndexByte(p, '.')
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return m.Indexing != "none"
+}
+
+// modelIndexing reads val.indexing of a Model document, all or none
+func modelIndexing(val interface{}) (string, error) {
+	v, _ := val.(map[string]interface{})
+	indexing, ok := v["indexing"]
+	if !ok {
+		return "all", nil
+	}
+	switch indexing {
+	case "all", "none":
+		return indexing.(string), nil
+	}
+	return "", fmt.Errorf("invalid model indexing %v, expected all or none", indexing)
+}
+
+// modelTTL reads val.ttl of a Model document, a duration like 30m or 24h
+func modelTTL(val interface{}) (time.Duration, error) {
+	v, _ := val.(map[string]interface{})
+	ttl, ok := v["ttl"].(string)
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid model ttl %q, expected a positive duration like 24h", ttl)
+	}
+	return d, nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+)
+
+// a search can be ordered by an indexed path or by the id.
+// every match is collected and sorted in memory, up to maxSortDocuments of them,
+// and the cursor is the sort key of the last document of the page:
+//
+//	value 0x00 0x01 id 0xff
+//
+// values are encoded like the value index does. every 0x00 in the value is followed by 0xff,
+// so the end of a value sorts before any byte that could continue it, and app sorts before apple.
+// documents with the same value sort by their id like in the index, which ends it with 0xff, so ab before a.
+// a document without a value sorts after all others, an array sorts by its smallest value, or its largest descending.
+//
+// the keys of a scan end a value with 0xff, so there apple comes before app. only when the first filter
+// leaves no strings of different lengths, a single value or a range of numbers, does its scan return
+// the same order, and then it is used instead, which pages like any other scan.
+
+// how many documents a search may match to be sorted in memory
+const maxSortDocuments = 10000
+
+// orderedByScan tells if the scan of the first filter already returns the documents in the order of sortKey
+func orderedByScan(order *openapi.Order, filters []openapi.Filter) bool {
+	if len(filters) == 0 {
+		return false
+	}
+	f := filters[0]
+	if f.Key != order.Key || !isPlainFilter(f) || f.Contains != nil || f.Prefix != nil || f.Skip != nil {
+		return false
+	}
+	if f.Equal != nil {
+		return true
+	}
+	if f.Greater == nil && f.Less == nil {
+		return false
+	}
+	return (f.Greater == nil || codec.IsIndexNumber(*f.Greater)) && (f.Less == nil || codec.IsIndexNumber(*f.Less))
+}
+
+// sortValue encodes a value like the value index does, but also long strings, which it skips
+func sortValue(v any) ([]byte, bool) {
+	if s, ok := v.(string); ok {
+		return []byte(s), true
+	}
+	return codec.IndexValue(v)
+}
+
+func sortKey(doc *openapi.Document, order *openapi.Order, desc bool) []byte {
+	var value []byte
+	if order.Key == "id" {
+		value = []byte(doc.Id)
+	} else {
+		values := valuesAt(doc.Val, strings.Split(strings.TrimPrefix(order.Key, "val."), "."), sortValue)
+		for _, v := range values {
+			if c := bytes.Compare(v, value); value == nil || (!desc && c < 0) || (desc && c > 0) {
+				value = v
+			}
+		}
+		if value == nil {
+			value = []byte{0xff}
+		}
+	}
+
+	k := make([]byte, 0, len(value)+3+len(doc.Id))
+	for _, b := range value {
+		k = append(k, b)
+		if b == 0 {
+			k = append(k, 0xff)
+		}
+	}
+	k = append(k, 0x00, 0x01)
+	k = append(k, doc.Id...)
+	return append(k, 0xff)
+}
+
+// sortDocuments sorts every matched document and returns the page after the cursor
+func (s *server) sortDocuments(ctx context.Context, r kv.Read, docs []openapi.Document, order *openapi.Order, cursor *string, limit int) ([]openapi.Document, *string, error) {
+	desc := order.Desc != nil && *order.Desc
+
+	var after []byte
+	if cursor != nil {
+		var err error
+		after, err = base64.StdEncoding.DecodeString(*cursor)
+		if err != nil || len(after) == 0 {
+			return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+	}
+
+	full := docs
+	if order.Key != "id" {
+		var err error
+		full, err = s.resolveFullDocs(ctx, r, docs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	type sorted struct {
+		key []byte
+		doc openapi.Document
+	}
+	var all []sorted
+	for _, doc := range full {
+		k := sortKey(&doc, order, desc)
+		if after != nil {
+			if c := bytes.Compare(k, after); (!desc && c <= 0) || (desc && c >= 0) {
+				continue
+			}
+		}
+		all = append(all, sorted{key: k, doc: openapi.Document{Model: doc.Model, Id: doc.Id}})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if desc {
+			return bytes.Compare(all[i].key, all[j].key) > 0
+		}
+		return bytes.Compare(all[i].key, all[j].key) < 0
+	})
+
+	var nextCursor *string
+	if limit > 0 && len(all) > limit {
+		all = all[:limit]
+		c := base64.StdEncoding.EncodeToString(all[limit-1].key)
+		nextCursor = &c
+	}
+
+	ret := make([]openapi.Document, 0, len(all))
+	for _, e := range all {
+		ret = append(ret, e.doc)
+	}
+	return ret, nextCursor, nil
+}
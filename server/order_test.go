@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchDocuments_Order(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{
+		Model: "Model",
+		Id:    "com.example.Order",
+		Val: map[string]interface{}{
+			"index": map[string]interface{}{"secret": "none"},
+		},
+	}))
+
+	books := map[string]map[string]interface{}{
+		"dune":       {"year": 1965, "lang": "en", "secret": 1},
+		"messiah":    {"year": 1969, "lang": "en"},
+		"children":   {"year": 1976, "lang": "de"},
+		"foundation": {"year": 1951, "lang": "en"},
+		"reprints":   {"year": []interface{}{1990, 1940}, "lang": "en"},
+		"noyear":     {"lang": "en"},
+	}
+	for id, val := range books {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Order", Id: id, Val: val}))
+	}
+	assert.Equal(t, "ready", waitForModelBackfill(t, s, "com.example.Order").State)
+
+	search := func(req openapi.SearchRequest) ([]string, *string, error) {
+		r := s.kv.Read()
+		defer r.Close()
+		req.Model = "com.example.Order"
+		res, err := s.query(context.Background(), r, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids := []string{}
+		for _, doc := range res.Documents {
+			ids = append(ids, doc.Id)
+		}
+		return ids, res.Cursor, nil
+	}
+
+	var en, y1950 interface{} = "en", json.Number("1950")
+	desc := true
+	byLang := &[]openapi.Filter{{Key: "val.lang", Equal: &en}}
+
+	// by the scan of the first filter
+	ids, _, err := search(openapi.SearchRequest{
+		Filters: &[]openapi.Filter{{Key: "val.year", Greater: &y1950}},
+		Order:   &openapi.Order{Key: "val.year", Desc: &desc},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reprints", "children", "messiah", "dune", "foundation"}, ids)
+
+	ids, _, err = search(openapi.SearchRequest{Order: &openapi.Order{Key: "id", Desc: &desc}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reprints", "noyear", "messiah", "foundation", "dune", "children"}, ids)
+
+	// in memory, an array by its smallest value and a missing value last
+	ids, _, err = search(openapi.SearchRequest{Filters: byLang, Order: &openapi.Order{Key: "val.year"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reprints", "foundation", "dune", "messiah", "noyear"}, ids)
+
+	// and descending by its largest value and a missing value first
+	ids, _, err = search(openapi.SearchRequest{Filters: byLang, Order: &openapi.Order{Key: "val.year", Desc: &desc}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"noyear", "reprints", "messiah", "dune", "foundation"}, ids)
+
+	// pages continue where the last one ended
+	limit := 2
+	var pages []string
+	var cursor *string
+	for range 5 {
+		ids, cursor, err = search(openapi.SearchRequest{Filters: byLang, Order: &openapi.Order{Key: "val.year"}, Limit: &limit, Cursor: cursor})
+		require.NoError(t, err)
+		pages = append(pages, ids...)
+		if cursor == nil {
+			break
+		}
+	}
+	assert.Equal(t, []string{"reprints", "foundation", "dune", "messiah", "noyear"}, pages)
+
+	_, _, err = search(openapi.SearchRequest{Order: &openapi.Order{Key: "val.secret"}})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	_, _, err = search(openapi.SearchRequest{Order: &openapi.Order{Key: "history.created"}})
+	require.Error(t, err)
+
+	_, _, err = search(openapi.SearchRequest{Order: &openapi.Order{Key: "id"}, Reverse: &desc})
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	// AQL
+	reqBytes, _ := json.Marshal(openapi.Query{Q: `com.example.Order(val.lang="en") order by val.year desc`})
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(reqBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.QueryDocuments(e.NewContext(req, rec)))
+	var response openapi.SearchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	ids = []string{}
+	for _, doc := range response.Documents {
+		ids = append(ids, doc.Id)
+		assert.NotNil(t, doc.Val)
+	}
+	assert.Equal(t, []string{"noyear", "reprints", "messiah", "dune", "foundation"}, ids)
+}
+
+func TestSearchDocuments_OrderPrefixes(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "Model", Id: "com.example.Prefix"}))
+	// each id is a prefix of the other, and so is each name, the other way around. kind and n are the same
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Prefix", Id: "a", Val: map[string]interface{}{"name": "apple", "kind": "fruit", "n": 1}}))
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Prefix", Id: "ab", Val: map[string]interface{}{"name": "app", "kind": "fruit", "n": 1}}))
+
+	search := func(filters []openapi.Filter, key string, desc bool) []string {
+		r := s.kv.Read()
+		defer r.Close()
+		res, err := s.query(context.Background(), r, openapi.SearchRequest{
+			Model:   "com.example.Prefix",
+			Filters: &filters,
+			Order:   &openapi.Order{Key: key, Desc: &desc},
+		})
+		require.NoError(t, err)
+		ids := []string{}
+		for _, doc := range res.Documents {
+			ids = append(ids, doc.Id)
+		}
+		return ids
+	}
+
+	var fruit, app, zero interface{} = "fruit", "app", json.Number("0")
+	byKind := openapi.Filter{Key: "val.kind", Equal: &fruit}
+	byName := openapi.Filter{Key: "val.name", Prefix: &app}
+	byN := openapi.Filter{Key: "val.n", Greater: &zero}
+
+	for _, desc := range []bool{false, true} {
+		reverse := func(ids []string) []string {
+			if desc {
+				return []string{ids[1], ids[0]}
+			}
+			return ids
+		}
+
+		// the same order, whether the first filter is on the ordered path or not
+		assert.Equal(t, reverse([]string{"a", "ab"}), search(nil, "id", desc))
+		assert.Equal(t, reverse([]string{"a", "ab"}), search([]openapi.Filter{byKind}, "id", desc))
+
+		assert.Equal(t, reverse([]string{"ab", "a"}), search([]openapi.Filter{byName}, "val.name", desc))
+		assert.Equal(t, reverse([]string{"ab", "a"}), search([]openapi.Filter{byKind}, "val.name", desc))
+
+		// a single value and a range of numbers are scanned, the same values sort by id
+		assert.Equal(t, reverse([]string{"ab", "a"}), search([]openapi.Filter{byKind}, "val.kind", desc))
+		assert.Equal(t, reverse([]string{"ab", "a"}), search([]openapi.Filter{byName}, "val.kind", desc))
+
+		assert.Equal(t, reverse([]string{"ab", "a"}), search([]openapi.Filter{byN}, "val.n", desc))
+		assert.Equal(t, reverse([]string{"ab", "a"}), search([]openapi.Filter{byKind}, "val.n", desc))
+	}
+
+	// and a page ends between them
+	limit := 1
+	r := s.kv.Read()
+	defer r.Close()
+	res, err := s.query(context.Background(), r, openapi.SearchRequest{Model: "com.example.Prefix", Order: &openapi.Order{Key: "val.name"}, Limit: &limit})
+	require.NoError(t, err)
+	require.NotNil(t, res.Cursor)
+	assert.Equal(t, "ab", res.Documents[0].Id)
+	res, err = s.query(context.Background(), r, openapi.SearchRequest{Model: "com.example.Prefix", Order: &openapi.Order{Key: "val.name"}, Limit: &limit, Cursor: res.Cursor})
+	require.NoError(t, err)
+	require.Len(t, res.Documents, 1)
+	assert.Equal(t, "a", res.Documents[0].Id)
+}
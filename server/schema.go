@@ -42,6 +42,16 @@ func (s *server) validateSchemaSchema(ctx context.Context, doc *openapi.Document
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("validation error (val.schema): %s", err))
 	}
 
+	_, err = modelTTL(val)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("validation error (val.ttl): %s", err))
+	}
+
+	_, err = modelIndexing(val)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("validation error (val.indexing): %s", err))
+	}
+
 	return nil
 }
 
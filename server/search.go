@@ -4,15 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	openapi "github.com/aep/apogy/api/go"
 	"github.com/aep/apogy/aql"
+	"github.com/aep/apogy/codec"
 	"github.com/aep/apogy/kv"
 	"github.com/labstack/echo/v4"
 	"go.opentelemetry.io/otel/attribute"
@@ -37,10 +39,7 @@ func makeKey(model string, filter *openapi.Filter) ([]byte, error) {
 		key = []byte{'o', 0xff}
 		key = append(key, []byte(model)...)
 	} else {
-		key = []byte{'f', 0xff}
-		key = append(key, []byte(model)...)
-		key = append(key, 0xff)
-		key = append(key, []byte(filter.Key)...)
+		key = indexKey(model, filter.Key)
 	}
 
 	if filter.Equal != nil {
@@ -49,15 +48,9 @@ func makeKey(model string, filter *openapi.Filter) ([]byte, error) {
 			key = append(key, []byte(strVal)...)
 			key = append(key, 0xff)
 
-		} else if num, ok := (*filter.Equal).(json.Number); ok {
-			vbin := make([]byte, 8)
-			if i64, err := num.Int64(); err == nil {
-				binary.LittleEndian.PutUint64(vbin, uint64(i64))
-			} else {
-				return nil, fmt.Errorf("%s can't be used as equal val", num)
-			}
+		} else if vbin, ok := codec.IndexValue(*filter.Equal); ok {
 			key = append(key, 0xff)
-			key = append(key, []byte(vbin)...)
+			key = append(key, vbin...)
 			key = append(key, 0xff)
 		} else {
 			return nil, fmt.Errorf("%T can't be used as euqal val", *filter.Equal)
@@ -66,6 +59,11 @@ func makeKey(model string, filter *openapi.Filter) ([]byte, error) {
 		if strVal, ok := (*filter.Greater).(string); ok {
 			key = append(key, 0xff)
 			key = append(key, []byte(strVal)...)
+		} else if vbin, ok := codec.IndexNumber(*filter.Greater); ok {
+			// after every entry of the number itself
+			key = append(key, 0xff)
+			key = append(key, vbin...)
+			key = kv.PrefixEnd(key)
 		} else {
 			return nil, fmt.Errorf("%T can't be used as search val for greater than", *filter.Greater)
 		}
@@ -80,6 +78,10 @@ func makeKey(model string, filter *openapi.Filter) ([]byte, error) {
 	} else if filter.Less != nil {
 		// exact key but any value
 		key = append(key, 0xff)
+		if codec.IsIndexNumber(*filter.Less) {
+			// of the same type
+			key = append(key, codec.IndexTagNumber)
+		}
 	} else {
 		// any key including sub
 		key = append(key, 0x00)
@@ -87,7 +89,7 @@ func makeKey(model string, filter *openapi.Filter) ([]byte, error) {
 	return key, nil
 }
 
-func (s *server) scan(ctx context.Context, r kv.Read, model string, id string, filter *openapi.Filter, limit int, cursor *string) (findResult, error) {
+func (s *server) scan(ctx context.Context, r kv.Read, model string, id string, filter *openapi.Filter, limit int, cursor *string, reverse bool) (findResult, error) {
 
 	fasj, _ := json.Marshal(filter)
 	ctx, span := tracer.Start(ctx, "scan", trace.WithAttributes(
@@ -95,6 +97,7 @@ func (s *server) scan(ctx context.Context, r kv.Read, model string, id string, f
 		attribute.String("subid", id),
 		attribute.String("filter", string(fasj)),
 		attribute.Int("limit", limit),
+		attribute.Bool("reverse", reverse),
 	))
 	if cursor != nil {
 		span.SetAttributes(attribute.String("cursor", *cursor))
@@ -107,24 +110,52 @@ func (s *server) scan(ctx context.Context, r kv.Read, model string, id string, f
 	if filter != nil && filter.Key == "id" && filter.Equal != nil {
 		if id, ok := (*filter.Equal).(string); ok {
 			var doc openapi.Document
-			err := s.getDocument(ctx, model, id, &doc)
+			err := s.readDocument(ctx, r, model, id, &doc)
 			if err == nil {
 				return findResult{documents: []openapi.Document{doc}}, nil
+			} else if errors.Is(err, kv.ErrHistoryUnavailable) {
+				return findResult{}, err
 			} else {
 				return findResult{documents: []openapi.Document{}}, nil
 			}
 		}
 	}
 
-	start, err := makeKey(model, filter)
-	if err != nil {
-		return findResult{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	// a full text search is driven by its first word, the others are looked up for every document it finds
+	var words []string
+	if filter != nil && filter.Contains != nil {
+		var err error
+		words, err = s.containsWords(ctx, model, filter.Key, *filter.Contains)
+		if err != nil {
+			return findResult{}, err
+		}
+		if id != "" {
+			found, err := hasWords(ctx, r, model, filter.Key, id, words)
+			if err != nil {
+				return findResult{}, readError(err)
+			}
+			if found {
+				return findResult{documents: []openapi.Document{{Model: model, Id: id}}}, nil
+			}
+			return findResult{documents: []openapi.Document{}}, nil
+		}
+	}
+
+	var start []byte
+	if words != nil {
+		start = fulltextKey(model, filter.Key, words[0])
+	} else {
+		var err error
+		start, err = makeKey(model, filter)
+		if err != nil {
+			return findResult{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
 	}
 
 	// we're in a sub filter
 	if id != "" {
-		if filter.Equal == nil || *filter.Equal == nil {
-			return findResult{}, echo.NewHTTPError(http.StatusBadRequest, "second filter currently can only be a k=v")
+		if filter.Equal == nil {
+			return findResult{}, echo.NewHTTPError(http.StatusBadRequest, "second filter currently can only be a k=v, in or contains")
 		}
 		start = append(start, []byte(id)...)
 
@@ -135,17 +166,35 @@ func (s *server) scan(ctx context.Context, r kv.Read, model string, id string, f
 
 	end := bytes.Clone(start)
 
-	if filter != nil && filter.Less != nil {
+	if id != "" || words != nil {
+		// the entries of this one document, or of this one word
+		end = kv.PrefixEnd(start)
+	} else if filter != nil && filter.Less != nil {
 		if strVal, ok := (*filter.Less).(string); ok {
 			// For Less filter, explicitly set the end key to the specified value
-			end = []byte{'f', 0xff}
-			end = append(end, []byte(model)...)
-			end = append(end, 0xff)
-			end = append(end, []byte(filter.Key)...)
+			end = indexKey(model, filter.Key)
 			end = append(end, 0xff)
 			end = append(end, []byte(strVal)...)
 			end = append(end, 0xff)
+		} else if vbin, ok := codec.IndexNumber(*filter.Less); ok {
+			// before every entry of the number itself
+			end = indexKey(model, filter.Key)
+			end = append(end, 0xff)
+			end = append(end, vbin...)
+		}
+	} else if filter != nil && filter.Greater != nil && filter.Key != "id" {
+		end = indexKey(model, filter.Key)
+		end = append(end, 0xff)
+		if codec.IsIndexNumber(*filter.Greater) {
+			// up to the last number
+			end = append(end, codec.IndexTagNumber+1)
+		} else {
+			// strings end where the tagged values begin
+			end = append(end, codec.IndexTagNull)
 		}
+	} else if filter != nil && filter.Equal != nil {
+		// a number may end in 0xff and a string may be empty, which the increment below would overflow
+		end = kv.PrefixEnd(start)
 	} else {
 		end[len(end)-2] = end[len(end)-2] + 1
 	}
@@ -155,7 +204,10 @@ func (s *server) scan(ctx context.Context, r kv.Read, model string, id string, f
 
 	if cursor != nil {
 		if cursorBytes, err := base64.StdEncoding.DecodeString(*cursor); err == nil && len(cursorBytes) > 0 {
-			if bytes.Compare(cursorBytes, start) >= 0 && bytes.Compare(cursorBytes, end) < 0 {
+			if reverse && bytes.Compare(cursorBytes, start) > 0 && bytes.Compare(cursorBytes, end) <= 0 {
+				// going backwards the cursor is the exclusive end of the next page
+				end = cursorBytes
+			} else if !reverse && bytes.Compare(cursorBytes, start) >= 0 && bytes.Compare(cursorBytes, end) < 0 {
 				start = cursorBytes
 			} else {
 				span.RecordError(fmt.Errorf("invalid cursor"))
@@ -180,11 +232,20 @@ func (s *server) scan(ctx context.Context, r kv.Read, model string, id string, f
 
 	var lastKey []byte
 
+	// documents are only listed by id here, so there is no need to fetch them
+	var opts []kv.IterOption
+	if filter == nil || filter.Key == "id" {
+		opts = append(opts, kv.KeysOnly)
+	}
+	if reverse {
+		opts = append(opts, kv.Reverse)
+	}
+
 restartAfterSkip:
 
-	for kv, err := range r.Iter(ctx, start, end) {
+	for kv, err := range r.Iter(ctx, start, end, opts...) {
 		if err != nil {
-			return findResult{}, err
+			return findResult{}, readError(err)
 		}
 
 		var id string
@@ -205,11 +266,6 @@ restartAfterSkip:
 			doc.Model = model
 			doc.Id = id
 
-			// TODO its actually refetched anyway :(
-			//if err := DeserializeStore(kv.V, &doc); err != nil {
-			//	return findResult{}, echo.NewHTTPError(http.StatusInternalServerError, "unmarshal error")
-			//}
-
 			lastKey = kv.K
 
 		} else {
@@ -221,6 +277,17 @@ restartAfterSkip:
 			}
 
 			seen[id] = true
+
+			if len(words) > 1 {
+				found, err := hasWords(ctx, r, model, filter.Key, id, words[1:])
+				if err != nil {
+					return findResult{}, readError(err)
+				}
+				if !found {
+					continue
+				}
+			}
+
 			doc.Model = model
 			doc.Id = id
 			lastKey = kv.K
@@ -248,6 +315,12 @@ restartAfterSkip:
 					nextKey := make([]byte, skipIndex) // Only copy up to the skip position
 					copy(nextKey, kv.K[:skipIndex])
 
+					if reverse {
+						// every key sharing the prefix sorts after it, so ending there skips them
+						end = nextKey
+						goto restartAfterSkip
+					}
+
 					// Increment the last byte
 					nextKey[len(nextKey)-1] = nextKey[len(nextKey)-1] + 1
 
@@ -261,9 +334,12 @@ restartAfterSkip:
 	}
 
 	var nextCursor *string
-	if len(documents) >= limit && lastKey != nil {
-		nextKey := bytes.Clone(lastKey)
-		nextKey[len(nextKey)-2] = nextKey[len(nextKey)-2] + 2
+	if len(documents) >= limit && lastKey != nil && reverse {
+		cursor := base64.StdEncoding.EncodeToString(lastKey)
+		nextCursor = &cursor
+	} else if len(documents) >= limit && lastKey != nil {
+		// the first key after the last one
+		nextKey := append(bytes.Clone(lastKey), 0x00)
 		cursor := base64.StdEncoding.EncodeToString(nextKey)
 		nextCursor = &cursor
 	}
@@ -275,6 +351,28 @@ restartAfterSkip:
 	return findResult{documents: documents, cursor: nextCursor}, nil
 }
 
+// readAt opens a read at asOf, or at the latest commit if there is none
+func (s *server) readAt(asOf *time.Time) kv.Read {
+	if asOf == nil {
+		return s.kv.Read()
+	}
+	return s.kv.ReadAt(*asOf)
+}
+
+// isNotFound tells if err is, or wraps, a 404 from reading a document
+func isNotFound(err error) bool {
+	var he *echo.HTTPError
+	return errors.As(err, &he) && he.Code == http.StatusNotFound
+}
+
+// readError reports a read from before the history the kv still has as a client error
+func readError(err error) error {
+	if errors.Is(err, kv.ErrHistoryUnavailable) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+	}
+	return err
+}
+
 func (s *server) SearchDocuments(c echo.Context) error {
 
 	ctx, span := tracer.Start(c.Request().Context(), "Search")
@@ -286,7 +384,7 @@ func (s *server) SearchDocuments(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
 	}
 
-	r := s.kv.Read()
+	r := s.readAt(req.AsOf)
 	defer r.Close()
 
 	rsp, err := s.query(ctx, r, req)
@@ -327,8 +425,9 @@ func (s *server) QueryDocuments(c echo.Context) error {
 	srq := *qa.ToSearchRequest()
 	srq.Cursor = req.Cursor
 	srq.Limit = req.Limit
+	srq.AsOf = req.AsOf
 
-	r := s.kv.Read()
+	r := s.readAt(req.AsOf)
 	defer r.Close()
 
 	if strings.Contains(c.Request().Header.Get("Accept"), "application/jsonl") {
@@ -402,23 +501,26 @@ func (s *server) resolveFullDocs(ctx context.Context, r kv.Read, fr []openapi.Do
 
 	vals, err := r.BatchGet(ctx, keys)
 	if err != nil {
-		return nil, err
+		return nil, readError(err)
 	}
 
 	var ret []openapi.Document
 
-	for key, val := range vals {
+	// in the order of the search, not of the map
+	for _, k := range keys {
+		key := string(k)
+		val := vals[key]
 
 		if val == nil {
 			continue
 		}
-		if !keysExtraCheck[string(key)] {
+		if !keysExtraCheck[key] {
 			// unlikely bug in tikv, but lets make extra sure
 			continue
 		}
 
 		var doc openapi.Document
-		if err := DeserializeStore(val, &doc); err != nil {
+		if err := s.deserializeStore([]byte(key), val, &doc); err != nil {
 			return nil, echo.NewHTTPError(http.StatusInternalServerError, "unmarshal error")
 		}
 
@@ -428,6 +530,88 @@ func (s *server) resolveFullDocs(ctx context.Context, r kv.Read, fr []openapi.Do
 	return ret, nil
 }
 
+// mergeRangeFilters turns a greater and a less filter on the same key into one filter,
+// so that a between is a single scan. AQL writes it as val.n>1 val.n<5
+func mergeRangeFilters(filters []openapi.Filter) []openapi.Filter {
+	isRange := func(f openapi.Filter) bool {
+		return isPlainFilter(f) && f.Equal == nil && f.Prefix == nil && f.Skip == nil && f.Contains == nil && (f.Greater == nil) != (f.Less == nil)
+	}
+
+	var ret []openapi.Filter
+	for _, f := range filters {
+		merged := false
+		if isRange(f) {
+			for i := range ret {
+				if ret[i].Key != f.Key || !isRange(ret[i]) {
+					continue
+				}
+				if ret[i].Greater == nil && f.Greater != nil {
+					ret[i].Greater = f.Greater
+					merged = true
+				} else if ret[i].Less == nil && f.Less != nil {
+					ret[i].Less = f.Less
+					merged = true
+				}
+				if merged {
+					break
+				}
+			}
+		}
+		if !merged {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// match runs the first filter as a scan and checks the others for every document it finds
+func (s *server) match(ctx context.Context, r kv.Read, model string, filters []openapi.Filter, limit int, cursor *string, reverse bool) ([]openapi.Document, *string, error) {
+
+	if len(filters) == 0 {
+		result, err := s.scan(ctx, r, model, "", nil, limit, cursor, reverse)
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.documents, result.cursor, nil
+	}
+
+	var result findResult
+	var err error
+	checks := filters[1:]
+	if isPlainFilter(filters[0]) {
+		result, err = s.scan(ctx, r, model, "", &filters[0], limit, cursor, reverse)
+	} else if b := branches(filters[0]); b != nil {
+		result, err = s.union(ctx, r, model, b, limit, cursor, reverse)
+	} else {
+		// a negation, so every document is a candidate
+		result, err = s.scan(ctx, r, model, "", nil, limit, cursor, reverse)
+		checks = filters
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var matchedDocs []openapi.Document
+	for i, doc := range result.documents {
+		allMatch := true
+
+		for _, filter := range checks {
+			found, err := s.check(ctx, r, model, doc.Id, filter)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !found {
+				allMatch = false
+				break
+			}
+		}
+		if allMatch {
+			matchedDocs = append(matchedDocs, result.documents[i])
+		}
+	}
+	return matchedDocs, result.cursor, nil
+}
+
 func (s *server) query(ctx context.Context, r kv.Read, req openapi.SearchRequest) (*openapi.SearchResponse, error) {
 
 	ctx, span := tracer.Start(ctx, "query")
@@ -447,54 +631,100 @@ func (s *server) query(ctx context.Context, r kv.Read, req openapi.SearchRequest
 		limit = *req.Limit
 	}
 
-	var cursor *string
-	var matchedDocs []openapi.Document
-
-	if req.Filters == nil || len(*req.Filters) == 0 {
+	reverse := req.Reverse != nil && *req.Reverse
 
-		result, err := s.scan(ctx, r, req.Model, "", nil, limit, req.Cursor)
-		if err != nil {
-			return nil, err
+	var filters []openapi.Filter
+	if req.Filters != nil && len(*req.Filters) > 0 {
+		filters = mergeRangeFilters(*req.Filters)
+		for _, f := range filters {
+			for _, key := range filterKeys(f) {
+				if isCompositeKey(key) {
+					return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid filter key %q", key))
+				}
+			}
 		}
-		matchedDocs = result.documents
-		cursor = result.cursor
-
-	} else {
+	}
 
-		result, err := s.scan(ctx, r, req.Model, "", &(*req.Filters)[0], limit, req.Cursor)
-		if err != nil {
-			return nil, err
+	// an order that the scan of the first filter does not have is sorted in memory
+	var sortOrder *openapi.Order
+	if req.Order != nil {
+		if reverse {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "reverse can not be combined with order, use order.desc")
 		}
-		cursor = result.cursor
-
-		for i, doc := range result.documents {
-			allMatch := true
+		if orderedByScan(req.Order, filters) {
+			reverse = req.Order.Desc != nil && *req.Order.Desc
+		} else {
+			sortOrder = req.Order
+		}
+	}
 
-			for _, filter := range (*req.Filters)[1:] {
+	aggregating := (req.Aggregates != nil && len(*req.Aggregates) > 0) || req.GroupBy != nil
 
-				subResult, err := s.scan(ctx, r, req.Model, doc.Id, &filter, 1, nil)
-				if err != nil {
-					return nil, err
-				}
-
-				found := false
-				for _, subId := range subResult.documents {
-					if doc.Id == subId.Id {
-						found = true
-						break
+	if len(filters) > 0 || req.Order != nil || aggregating {
+		m, err := s.getModel(ctx, req.Model)
+		if err != nil && !isNotFound(err) {
+			return nil, readError(err)
+		}
+		// a model that does not exist has no documents to check the filters against
+		if m != nil {
+			// composite indexes are only complete once the backfill is done, and may not have existed at asOf.
+			// they would also change the order of a scan that is ordered by its first filter
+			if req.AsOf == nil && !m.Backfilling && (req.Order == nil || sortOrder != nil) {
+				filters = useCompositeIndex(m, filters)
+			}
+			for _, f := range filters {
+				for _, key := range filterKeys(f) {
+					if key != "id" && !isCompositeKey(key) && !m.indexed(key) {
+						return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s is not indexed by model %s", key, req.Model))
 					}
 				}
-				if !found {
-					allMatch = false
-					break
-				}
 			}
-			if allMatch {
-				matchedDocs = append(matchedDocs, result.documents[i])
+			if req.Order != nil && req.Order.Key != "id" && (!strings.HasPrefix(req.Order.Key, "val.") || !m.indexed(req.Order.Key)) {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("can not order by %s, it is not indexed by model %s", req.Order.Key, req.Model))
+			}
+			if req.GroupBy != nil && (!strings.HasPrefix(*req.GroupBy, "val.") || isCompositeKey(*req.GroupBy) || !m.indexed(*req.GroupBy)) {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("can not group by %s, it is not indexed by model %s", *req.GroupBy, req.Model))
 			}
 		}
 	}
 
+	at := time.Now()
+	if req.AsOf != nil {
+		at = *req.AsOf
+	}
+
+	if aggregating {
+		return s.aggregate(ctx, r, req, filters, at)
+	}
+
+	scanLimit, scanCursor := limit, req.Cursor
+	if sortOrder != nil {
+		// all of them, the cursor is a position in the sorted result
+		scanLimit, scanCursor = maxSortDocuments, nil
+	}
+
+	matchedDocs, cursor, err := s.match(ctx, r, req.Model, filters, scanLimit, scanCursor, reverse)
+	if err != nil {
+		return nil, err
+	}
+
+	matchedDocs, err = s.dropExpired(ctx, r, matchedDocs, at)
+	if err != nil {
+		return nil, err
+	}
+
+	if sortOrder != nil {
+		if cursor != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(
+				"more than %d documents to order by %s, filter by a single value or a range of numbers of %s first to use its index instead",
+				maxSortDocuments, sortOrder.Key, sortOrder.Key))
+		}
+		matchedDocs, cursor, err = s.sortDocuments(ctx, r, matchedDocs, sortOrder, req.Cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if req.Full != nil && *req.Full {
 		var err error
 		matchedDocs, err = s.resolveFullDocs(ctx, r, matchedDocs)
@@ -507,12 +737,19 @@ func (s *server) query(ctx context.Context, r kv.Read, req openapi.SearchRequest
 				matchedDocs[i] = doc
 			}
 		}
+		if req.Model == "Model" {
+			for i := range matchedDocs {
+				if err := withBackfillProgress(ctx, r, &matchedDocs[i]); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
 	if req.Links != nil && len(*req.Links) > 0 {
 
 		var modelDoc openapi.Document
-		err := s.getDocument(ctx, "Model", req.Model, &modelDoc)
+		err := s.readDocument(ctx, r, "Model", req.Model, &modelDoc)
 		if err != nil {
 			return nil, err
 		}
@@ -2,12 +2,15 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"encoding/json"
 	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
@@ -355,3 +358,228 @@ func TestSearchDocuments_MultipleFiltersIdSecond(t *testing.T) {
 		assert.Equal(t, "doc1", response.Documents[0].Id)
 	}
 }
+
+func TestSearchDocuments_AsOf(t *testing.T) {
+	e, s := setupTestServer(t)
+	setupSearchTestData(t, e, s)
+
+	time.Sleep(50 * time.Millisecond)
+	then := time.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodDelete, "/documents/com.example.SearchTest/doc1", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, s.DeleteDocument(e.NewContext(req, rec), "com.example.SearchTest", "doc1"))
+
+	search := func(asOf *time.Time) ([]openapi.Document, error) {
+		var equalInterface interface{} = "test"
+		filters := []openapi.Filter{
+			{
+				Key:   "val.type",
+				Equal: &equalInterface,
+			},
+		}
+		searchReq := openapi.SearchRequest{
+			Model:   "com.example.SearchTest",
+			Filters: &filters,
+			AsOf:    asOf,
+		}
+
+		reqBytes, _ := json.Marshal(searchReq)
+		req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes))
+		req.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+
+		if err := s.SearchDocuments(e.NewContext(req, rec)); err != nil {
+			return nil, err
+		}
+
+		var response openapi.SearchResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return response.Documents, nil
+	}
+
+	docs, err := search(nil)
+	assert.NoError(t, err)
+	assert.Len(t, docs, 1)
+
+	docs, err = search(&then)
+	if errors.Is(err, kv.ErrHistoryUnavailable) {
+		t.Skip("kv backend does not keep history")
+	}
+	assert.NoError(t, err)
+	assert.Len(t, docs, 2)
+}
+
+func TestSearchDocuments_Reverse(t *testing.T) {
+	e, s := setupTestServer(t)
+	setupSearchTestData(t, e, s)
+
+	search := func(req openapi.SearchRequest) openapi.SearchResponse {
+		reqBytes, _ := json.Marshal(req)
+		httpReq := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes))
+		httpReq.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+		assert.NoError(t, s.SearchDocuments(e.NewContext(httpReq, rec)))
+
+		var response openapi.SearchResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return response
+	}
+
+	ids := func(docs []openapi.Document) []string {
+		var ret []string
+		for _, doc := range docs {
+			ret = append(ret, doc.Id)
+		}
+		return ret
+	}
+
+	reverse := true
+	limit := 1
+
+	// page through all documents backwards
+	var got []string
+	req := openapi.SearchRequest{
+		Model:   "com.example.SearchTest",
+		Reverse: &reverse,
+		Limit:   &limit,
+	}
+	for range 5 {
+		rsp := search(req)
+		got = append(got, ids(rsp.Documents)...)
+		if rsp.Cursor == nil {
+			break
+		}
+		req.Cursor = rsp.Cursor
+	}
+	assert.Equal(t, []string{"doc3", "doc2", "doc1"}, got)
+
+	// descending by the first filter
+	var equalInterface interface{} = "test"
+	filters := []openapi.Filter{
+		{
+			Key:   "val.type",
+			Equal: &equalInterface,
+		},
+	}
+	rsp := search(openapi.SearchRequest{
+		Model:   "com.example.SearchTest",
+		Filters: &filters,
+		Reverse: &reverse,
+	})
+	assert.Equal(t, []string{"doc2", "doc1"}, ids(rsp.Documents))
+}
+
+func TestSearchDocuments_NumericRange(t *testing.T) {
+	e, s := setupTestServer(t)
+	setupSearchTestData(t, e, s)
+
+	ids := func(docs []openapi.Document) []string {
+		ret := []string{}
+		for _, doc := range docs {
+			ret = append(ret, doc.Id)
+		}
+		return ret
+	}
+
+	search := func(filters ...openapi.Filter) []string {
+		reqBytes, _ := json.Marshal(openapi.SearchRequest{
+			Model:   "com.example.SearchTest",
+			Filters: &filters,
+		})
+		req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(reqBytes))
+		req.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+		assert.NoError(t, s.SearchDocuments(e.NewContext(req, rec)))
+
+		var response openapi.SearchResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return ids(response.Documents)
+	}
+
+	query := func(q string) []string {
+		reqBytes, _ := json.Marshal(openapi.Query{Q: q})
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(reqBytes))
+		req.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+		assert.NoError(t, s.QueryDocuments(e.NewContext(req, rec)))
+
+		var response openapi.SearchResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return ids(response.Documents)
+	}
+
+	value := func(v any) *interface{} {
+		return &v
+	}
+
+	// the counts are 10, 20 and 30
+	assert.Equal(t, []string{"doc2", "doc3"}, search(openapi.Filter{Key: "val.count", Greater: value(10)}))
+	assert.Equal(t, []string{"doc1", "doc2"}, search(openapi.Filter{Key: "val.count", Less: value(30)}))
+	assert.Equal(t, []string{"doc1", "doc2", "doc3"}, search(openapi.Filter{Key: "val.count", Greater: value(-1.5)}))
+	assert.Equal(t, []string{}, search(openapi.Filter{Key: "val.count", Greater: value(30)}))
+	assert.Equal(t, []string{"doc2"}, search(openapi.Filter{Key: "val.count", Equal: value(20.0)}))
+	assert.Equal(t, []string{"doc2"}, search(openapi.Filter{Key: "val.count", Greater: value(10), Less: value(30)}))
+	assert.Equal(t, []string{"doc2"}, search(
+		openapi.Filter{Key: "val.count", Greater: value(10.5)},
+		openapi.Filter{Key: "val.count", Less: value(29.5)},
+	))
+
+	assert.Equal(t, []string{"doc3"}, query(`com.example.SearchTest(val.count>20)`))
+	assert.Equal(t, []string{"doc1", "doc2"}, query(`com.example.SearchTest(val.count<25.5)`))
+	assert.Equal(t, []string{"doc2"}, query(`com.example.SearchTest(val.count>15 val.count<25)`))
+	assert.Equal(t, []string{"doc1"}, query(`com.example.SearchTest(val.count=10 val.type="test")`))
+}
+
+func TestSearchDocuments_BoolAndNull(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	assert.NoError(t, putTestDoc(e, s, openapi.Document{Model: "Model", Id: "com.example.Flags", Val: map[string]interface{}{}}))
+	assert.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Flags", Id: "a", Val: map[string]interface{}{"active": true, "deleted": nil, "code": "true"}}))
+	assert.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Flags", Id: "b", Val: map[string]interface{}{"active": false, "deleted": "yesterday", "code": 1}}))
+	assert.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Flags", Id: "c", Val: map[string]interface{}{"active": true, "code": "1"}}))
+
+	ids := func(body []byte) []string {
+		var response openapi.SearchResponse
+		assert.NoError(t, json.Unmarshal(body, &response))
+		ret := []string{}
+		for _, doc := range response.Documents {
+			ret = append(ret, doc.Id)
+		}
+		return ret
+	}
+
+	search := func(body string) []string {
+		req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader([]byte(body)))
+		req.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+		assert.NoError(t, s.SearchDocuments(e.NewContext(req, rec)))
+		return ids(rec.Body.Bytes())
+	}
+
+	query := func(q string) []string {
+		reqBytes, _ := json.Marshal(openapi.Query{Q: q})
+		req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(reqBytes))
+		req.Header.Set(echo.HeaderContentType, "application/json")
+		rec := httptest.NewRecorder()
+		assert.NoError(t, s.QueryDocuments(e.NewContext(req, rec)))
+		return ids(rec.Body.Bytes())
+	}
+
+	assert.Equal(t, []string{"a", "c"}, query(`com.example.Flags(val.active=true)`))
+	assert.Equal(t, []string{"b"}, query(`com.example.Flags(val.active=false)`))
+	assert.Equal(t, []string{"a"}, query(`com.example.Flags(val.deleted=null)`))
+	assert.Equal(t, []string{"c"}, query(`com.example.Flags(val.active=true val.code="1")`))
+
+	assert.Equal(t, []string{"a"}, search(`{"model": "com.example.Flags", "filters": [{"key": "val.deleted", "equal": null}]}`))
+	// without equal, any value
+	assert.ElementsMatch(t, []string{"a", "b"}, search(`{"model": "com.example.Flags", "filters": [{"key": "val.deleted"}]}`))
+
+	// a string, a number and a bool with the same text are different values
+	assert.Equal(t, []string{"a"}, search(`{"model": "com.example.Flags", "filters": [{"key": "val.code", "equal": "true"}]}`))
+	assert.Equal(t, []string{"b"}, search(`{"model": "com.example.Flags", "filters": [{"key": "val.code", "equal": 1}]}`))
+	assert.Equal(t, []string{"c"}, search(`{"model": "com.example.Flags", "filters": [{"key": "val.code", "equal": "1"}]}`))
+	assert.Equal(t, []string{"b"}, search(`{"model": "com.example.Flags", "filters": [{"key": "val.code", "greater": 0}]}`))
+	assert.ElementsMatch(t, []string{"a", "c"}, search(`{"model": "com.example.Flags", "filters": [{"key": "val.code", "greater": ""}]}`))
+}
@@ -1,28 +1,29 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/codec"
 )
 
-func DeserializeStore(b []byte, doc *openapi.Document) error {
-	if len(b) < 1 {
-		return nil
+// serializeStore encodes a document for path, encrypting it if keys are configured
+func (s *server) serializeStore(path []byte, doc *openapi.Document) ([]byte, error) {
+	b, err := codec.SerializeStore(doc, s.encoding)
+	if err != nil || s.keys == nil {
+		return b, err
 	}
-	if b[0] != 'j' {
-		return errors.New("invalid encoding stored in database")
-	}
-	dec := json.NewDecoder(bytes.NewReader(b[1:]))
-	dec.UseNumber()
-	return dec.Decode(doc)
+	return sealStore(s.keys, path, b)
 }
 
-func SerializeStore(doc *openapi.Document) ([]byte, error) {
-	b, err := json.Marshal(doc)
-	if err != nil {
-		return nil, err
+// deserializeStore decodes the document stored at path
+func (s *server) deserializeStore(path []byte, b []byte, doc *openapi.Document) error {
+	if len(b) > 0 && b[0] == 'e' {
+		var err error
+		b, err = openStore(s.keys, path, b)
+		if err != nil {
+			return err
+		}
+	} else if s.keys != nil {
+		s.plainSeen.Store(true)
 	}
-	return append([]byte{'j'}, b...), nil
+	return codec.DeserializeStore(b, doc)
 }
@@ -7,10 +7,13 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	openapi "github.com/aep/apogy/api/go"
 	"github.com/aep/apogy/bus"
+	"github.com/aep/apogy/codec"
 	"github.com/aep/apogy/kv"
 	"github.com/aep/apogy/reactor"
 
@@ -24,33 +27,25 @@ type server struct {
 	bs         bus.Bus
 	ro         *reactor.Reactor
 	modelCache otter.Cache[string, *Model]
-}
-
-func Main(caCertPath, serverCertPath, serverKeyPath string) {
 
-	kv, err := kv.NewTikv()
-	if err != nil {
-		panic(err)
-	}
-
-	bs, err := bus.NewSolo()
-	if err != nil {
-		panic(err)
-	}
+	// how new documents are written
+	encoding codec.Encoding
+	// encrypts documents at rest if set
+	keys KeyProvider
+	// set at start and when a plain document was read while keys are configured, so the re-encryption pass runs again
+	plainSeen atomic.Bool
+	// models with an index backfill running in this process
+	backfills sync.Map
+}
 
-	cache, err := otter.MustBuilder[string, *Model](100000).
-		WithTTL(60 * time.Second).
-		Build()
+func Main(kvBackend, leveldbPath, kvNamespace, storageEncoding, encryptionKeyFile, caCertPath, serverCertPath, serverKeyPath string) {
 
+	s, err := newServer(kvBackend, leveldbPath, kvNamespace, storageEncoding, encryptionKeyFile)
 	if err != nil {
 		panic(err)
 	}
-
-	s := &server{
-		kv:         kv,
-		bs:         bs,
-		modelCache: cache,
-	}
+	// outside of the namespace, so the keys are labeled by what they are
+	s.kv = kv.WithMetrics(s.kv, kvMetrics)
 
 	s.ro = reactor.NewReactor(caCertPath, serverCertPath, serverKeyPath)
 
@@ -60,6 +55,7 @@ func Main(caCertPath, serverCertPath, serverKeyPath string) {
 	e.Binder = &Binder{
 		defaultBinder: &echo.DefaultBinder{},
 	}
+	e.HTTPErrorHandler = httpErrorHandler(e)
 
 	// Add middleware
 	e.Use(TracingMiddleware)    // Add OpenTelemetry tracing middleware
@@ -70,11 +66,24 @@ func Main(caCertPath, serverCertPath, serverKeyPath string) {
 	// Register OpenAPI handlers
 	openapi.RegisterHandlers(e, s)
 
+	if kvBackend == "" {
+		kvBackend = "tikv"
+	}
+	if kvNamespace != "" {
+		kvBackend += "/" + kvNamespace
+	}
+
 	// Start server
 	s.startup()
 
 	go s.statsd()
 
+	if s.keys != nil {
+		go s.reencryptLoop(time.Minute)
+	}
+
+	go s.sweepExpiredLoop(10 * time.Second)
+
 	if caCertPath != "" && serverCertPath != "" && serverKeyPath != "" {
 		// Load CA certificate for client verification
 		caCert, err := os.ReadFile(caCertPath)
@@ -100,12 +109,12 @@ func Main(caCertPath, serverCertPath, serverKeyPath string) {
 			Handler:   e,
 		}
 
-		fmt.Println("⇨ APOGY [tikv, solo, mTLS]")
+		fmt.Printf("⇨ APOGY [%s, solo, mTLS]\n", kvBackend)
 		if err := s.ListenAndServeTLS(serverCertPath, serverKeyPath); err != http.ErrServerClosed {
 			panic(fmt.Sprintf("failed to serve with TLS: %v", err))
 		}
 	} else {
-		fmt.Println("⇨ APOGY [tikv, solo, insecure]")
+		fmt.Printf("⇨ APOGY [%s, solo, insecure]\n", kvBackend)
 		// Wrap Echo handler with OpenTelemetry
 		handler := e
 		s := &http.Server{
@@ -118,6 +127,59 @@ func Main(caCertPath, serverCertPath, serverKeyPath string) {
 	}
 }
 
+// newServer opens the storage without serving anything, which is also what the offline commands like backup use
+func newServer(kvBackend, leveldbPath, kvNamespace, storageEncoding, encryptionKeyFile string) (*server, error) {
+
+	encoding, err := codec.ParseEncoding(storageEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys KeyProvider
+	if encryptionKeyFile != "" {
+		keys, err = NewFileKeyProvider(encryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := kv.New(kvBackend, leveldbPath)
+	if err != nil {
+		return nil, err
+	}
+	if kvNamespace != "" {
+		db, err = kv.WithNamespace(db, kvNamespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bs, err := bus.NewSolo()
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := otter.MustBuilder[string, *Model](100000).
+		WithTTL(60 * time.Second).
+		Build()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		kv:         db,
+		bs:         bs,
+		modelCache: cache,
+		encoding:   encoding,
+		keys:       keys,
+	}
+	// a server without keys may have written plain documents that this one never reads,
+	// so the first re-encryption pass after a start checks all of them
+	s.plainSeen.Store(keys != nil)
+	return s, nil
+}
+
 // Logging middleware
 func loggingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -12,7 +12,7 @@ func (s *server) startup() {
 	dbr := s.kv.Read()
 	defer dbr.Close()
 
-	docs, err := s.scan(ctx, dbr, "Reactor", "", nil, 100000, nil)
+	docs, err := s.scan(ctx, dbr, "Reactor", "", nil, 100000, nil, false)
 	if err != nil {
 		panic(err)
 	}
@@ -33,7 +33,7 @@ func (s *server) startup() {
 		}
 	}
 
-	docs, err = s.scan(ctx, dbr, "Model", "", nil, 100000, nil)
+	docs, err = s.scan(ctx, dbr, "Model", "", nil, 100000, nil, false)
 	if err != nil {
 		panic(err)
 	}
@@ -53,4 +53,6 @@ func (s *server) startup() {
 			slog.Error("startup error", "err", err)
 		}
 	}
+
+	s.resumeBackfills(docs.documents)
 }
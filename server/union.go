@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/aep/apogy/kv"
+	"github.com/labstack/echo/v4"
+)
+
+// a filter can match any of several values, any of several filters, or negate itself:
+//
+//	{key: val.status, in: [pending, failed]}
+//	{or: [{key: val.author, equal: Frank Herbert}, {key: val.title, contains: dune}]}
+//	{key: val.deleted, equal: true, not: true}
+//
+// as the first filter, an in or an or is a union of the scans of its values or filters, one after the other.
+// a document is only returned by the first scan that finds it, every later one checks it against the ones before,
+// so a union pages like any other scan and its cursor is the position of the scan and the cursor of that scan.
+// a page is only cut short when the last branch ends, never because a scan found only documents seen before.
+// a negation can not be scanned, so a search that starts with one checks every document of the model.
+
+func isNegated(f openapi.Filter) bool {
+	return f.Not != nil && *f.Not
+}
+
+// isPlainFilter tells if a filter is a single scan of its key
+func isPlainFilter(f openapi.Filter) bool {
+	return f.In == nil && f.Or == nil && !isNegated(f)
+}
+
+// filterKeys returns the keys a filter looks at, including the ones of its or
+func filterKeys(f openapi.Filter) []string {
+	if f.Or == nil {
+		return []string{f.Key}
+	}
+	var keys []string
+	for _, o := range *f.Or {
+		keys = append(keys, filterKeys(o)...)
+	}
+	return keys
+}
+
+// branches returns the plain filters whose union is the filter, or nil if it contains a negation
+func branches(f openapi.Filter) []openapi.Filter {
+	if isNegated(f) {
+		return nil
+	}
+	ret := []openapi.Filter{}
+	if f.In != nil {
+		for _, v := range *f.In {
+			ret = append(ret, openapi.Filter{Key: f.Key, Equal: &v})
+		}
+		return ret
+	}
+	if f.Or != nil {
+		for _, o := range *f.Or {
+			b := branches(o)
+			if b == nil {
+				return nil
+			}
+			ret = append(ret, b...)
+		}
+		return ret
+	}
+	return append(ret, f)
+}
+
+// check tells if the document with the id matches the filter
+func (s *server) check(ctx context.Context, r kv.Read, model string, id string, f openapi.Filter) (bool, error) {
+	found := false
+
+	if f.Or != nil {
+		for _, o := range *f.Or {
+			ok, err := s.check(ctx, r, model, id, o)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				found = true
+				break
+			}
+		}
+	} else if f.In != nil {
+		for _, v := range *f.In {
+			ok, err := s.check(ctx, r, model, id, openapi.Filter{Key: f.Key, Equal: &v})
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				found = true
+				break
+			}
+		}
+	} else {
+		plain := f
+		plain.Not = nil
+		result, err := s.scan(ctx, r, model, id, &plain, 1, nil, false)
+		if err != nil {
+			return false, err
+		}
+		for _, doc := range result.documents {
+			if doc.Id == id {
+				found = true
+				break
+			}
+		}
+	}
+
+	return found != isNegated(f), nil
+}
+
+// union scans the branches one after the other, starting at the cursor
+func (s *server) union(ctx context.Context, r kv.Read, model string, branches []openapi.Filter, limit int, cursor *string, reverse bool) (findResult, error) {
+	i := 0
+	var branchCursor *string
+	if cursor != nil {
+		n, c, ok := strings.Cut(*cursor, ".")
+		var err error
+		i, err = strconv.Atoi(n)
+		if !ok || err != nil || i < 0 || i >= len(branches) {
+			return findResult{}, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		if c != "" {
+			branchCursor = &c
+		}
+	}
+
+	// like a scan, a page has at least one document
+	limit = max(limit, 1)
+
+	documents := []openapi.Document{}
+	for i < len(branches) {
+		result, err := s.scan(ctx, r, model, "", &branches[i], limit-len(documents), branchCursor, reverse)
+		if err != nil {
+			return findResult{}, err
+		}
+
+		for _, doc := range result.documents {
+			seen := false
+			for _, b := range branches[:i] {
+				seen, err = s.check(ctx, r, model, doc.Id, b)
+				if err != nil {
+					return findResult{}, err
+				}
+				if seen {
+					break
+				}
+			}
+			if !seen {
+				documents = append(documents, doc)
+			}
+		}
+
+		if result.cursor != nil {
+			// the earlier branches may have found all of them, so the branch goes on until the page is full
+			if len(documents) < limit {
+				branchCursor = result.cursor
+				continue
+			}
+			next := fmt.Sprintf("%d.%s", i, *result.cursor)
+			return findResult{documents: documents, cursor: &next}, nil
+		}
+
+		branchCursor = nil
+		i++
+		if len(documents) >= limit && i < len(branches) {
+			next := fmt.Sprintf("%d.", i)
+			return findResult{documents: documents, cursor: &next}, nil
+		}
+	}
+
+	return findResult{documents: documents}, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	openapi "github.com/aep/apogy/api/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchDocuments_Union(t *testing.T) {
+	e, s := setupTestServer(t)
+
+	require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "Model", Id: "com.example.Union"}))
+
+	jobs := map[string]map[string]interface{}{
+		"a": {"status": "pending", "lang": "en"},
+		"b": {"status": "failed", "lang": "de"},
+		"c": {"status": "done", "lang": "en"},
+		"d": {"status": []interface{}{"pending", "failed"}, "lang": "en"},
+		"e": {"lang": "fr"},
+	}
+	for id, val := range jobs {
+		require.NoError(t, putTestDoc(e, s, openapi.Document{Model: "com.example.Union", Id: id, Val: val}))
+	}
+
+	search := func(filters []openapi.Filter, limit int, cursor *string) ([]string, *string) {
+		r := s.kv.Read()
+		defer r.Close()
+		res, err := s.query(context.Background(), r, openapi.SearchRequest{
+			Model:   "com.example.Union",
+			Filters: &filters,
+			Limit:   &limit,
+			Cursor:  cursor,
+		})
+		require.NoError(t, err)
+		ids := []string{}
+		for _, doc := range res.Documents {
+			ids = append(ids, doc.Id)
+		}
+		return ids, res.Cursor
+	}
+
+	all := func(filters ...openapi.Filter) []string {
+		ids, _ := search(filters, 100, nil)
+		return ids
+	}
+
+	var pending, failed, done, de, en interface{} = "pending", "failed", "done", "de", "en"
+	not := true
+	inFlight := openapi.Filter{Key: "val.status", In: &[]interface{}{pending, failed}}
+
+	assert.ElementsMatch(t, []string{"a", "b", "d"}, all(inFlight))
+	assert.ElementsMatch(t, []string{"a", "d"}, all(inFlight, openapi.Filter{Key: "val.lang", Equal: &de, Not: &not}))
+	assert.ElementsMatch(t, []string{"b"}, all(openapi.Filter{Key: "val.lang", Equal: &de}, inFlight))
+	assert.ElementsMatch(t, []string{"a", "b", "d", "e"}, all(openapi.Filter{Key: "val.status", Equal: &done, Not: &not}))
+	assert.ElementsMatch(t, []string{"b", "c"}, all(openapi.Filter{Or: &[]openapi.Filter{
+		{Key: "val.status", Equal: &done},
+		{Key: "val.lang", Equal: &de},
+	}}))
+	assert.ElementsMatch(t, []string{"a", "c"}, all(
+		openapi.Filter{Key: "val.lang", Equal: &en},
+		openapi.Filter{Or: &[]openapi.Filter{inFlight, {Key: "val.status", Equal: &done}}},
+		openapi.Filter{Key: "val.status", Equal: &failed, Not: &not},
+	))
+	assert.Empty(t, all(openapi.Filter{Key: "val.status", In: &[]interface{}{}}))
+
+	// pages of a union continue where the last one ended, and d is only found by the first value.
+	// the failed scan finds d again after b, which must not end in an empty page. a limit of 0 pages like 1
+	for _, limit := range []int{1, 0} {
+		var pages []string
+		var cursor *string
+		for range 10 {
+			var ids []string
+			ids, cursor = search([]openapi.Filter{inFlight}, limit, cursor)
+			if cursor != nil {
+				assert.Len(t, ids, 1)
+			}
+			pages = append(pages, ids...)
+			if cursor == nil {
+				break
+			}
+		}
+		assert.ElementsMatch(t, []string{"a", "b", "d"}, pages)
+	}
+
+	// AQL
+	reqBytes, _ := json.Marshal(openapi.Query{Q: `com.example.Union(val.status in ("pending", "failed") | val.lang="fr" !val.lang="de")`})
+	req := httptest.NewRequest(http.MethodPost, "/query", bytes.NewReader(reqBytes))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.QueryDocuments(e.NewContext(req, rec)))
+	var response openapi.SearchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	ids := []string{}
+	for _, doc := range response.Documents {
+		ids = append(ids, doc.Id)
+	}
+	assert.ElementsMatch(t, []string{"a", "d", "e"}, ids)
+}